@@ -4,10 +4,16 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
 	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+	"github.com/vhybZApp/api/tokenizer"
 	"google.golang.org/genai"
 )
 
@@ -29,6 +35,9 @@ func Init() {
 type HTMLRequest struct {
 	// Contents contains the parts of the content to be processed
 	Contents []*genai.Content `json:"parts" binding:"required"`
+	// Tags attribute the cost of the call, e.g. {"feature": "landing-page"}.
+	// They are merged over the X-Usage-Tags header.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // HTMLResponse represents the response from HTML generation
@@ -36,18 +45,37 @@ type HTMLRequest struct {
 type HTMLResponse struct {
 	// HTML contains the generated HTML code
 	HTML string `json:"html"`
+	// FinishReason is quota_exceeded when the generation was cut short
+	// because the user's quota ran out
+	FinishReason string `json:"finish_reason,omitempty"`
 }
 
+// model is the Gemini model generating HTML
+const model = "gemini-2.0-flash"
+
+// imageTokens is what Gemini charges for an image or other inline media part
+const imageTokens = 258
+
 // MakeHTML godoc
 // @Summary Generate HTML using Gemini AI
 // @Description Generates HTML code based on the provided content using Gemini AI
 // @Tags agent
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Param request body HTMLRequest true "Request body containing content parts"
+// @Param X-Usage-Tags header string false "Cost attribution tags, e.g. feature=landing-page,environment=prod"
 // @Success 200 {object} HTMLResponse
 // @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 402 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse
 // @Failure 500 {object} models.ErrorResponse
+// @Header 200,429 {integer} X-RateLimit-Limit "Limit of the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Remaining "Remaining tokens, requests or micro-dollars in the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Reset "Seconds until the most constrained quota window resets"
+// @Header 429 {integer} Retry-After "Seconds until the exceeded quota window resets"
 // @Router /agent/make-html [post]
 func MakeHTML(c *gin.Context) {
 	var req HTMLRequest
@@ -59,15 +87,158 @@ func MakeHTML(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, models.NewErrorResponse("No contents provided"))
 		return
 	}
+	tags, err := services.UsageTags(c.GetHeader(services.HeaderUsageTags), req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
 	if len(req.Contents) == 1 {
 		req.Contents = append(req.Contents, genai.Text("You are a ultimate software engineer that generates HTML code.")[0])
 	}
 
-	resp, err := client.Models.GenerateContent(context.Background(), "gemini-2.0-flash", req.Contents, nil)
+	// Get user ID from context (set by auth middleware)
+	userID, exists := c.Get("user_id")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, models.NewErrorResponse("User not authenticated"))
+		return
+	}
+	if client == nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Gemini configuration is incomplete"))
+		return
+	}
+
+	// Check that the user's plan includes the model
+	tokenQuotaService := services.NewTokenQuotaService(database.GetDB())
+	limits, err := tokenQuotaService.GetLimits(userID.(uuid.UUID))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.NewErrorResponse(err.Error()))
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+		return
+	}
+	if !limits.AllowsModel(model) {
+		c.JSON(http.StatusForbidden, models.NewErrorResponse(services.ErrModelNotAllowed.Error()))
+		return
+	}
+
+	// Reserve the worst case usage of the call: its prompt plus the longest
+	// output it is allowed to generate, capped to what is left of the quota
+	promptTokens := estimatePromptTokens(req.Contents)
+	scope := services.QuotaScope{Provider: "gemini", Model: model, Endpoint: services.EndpointMakeHTML}
+	reservation, maxOutputTokens, err := tokenQuotaService.ReserveCompletion(userID.(uuid.UUID), scope, promptTokens, config.AppConfig.DefaultMaxTokens)
+	if err != nil {
+		status := services.ReserveErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			c.JSON(status, models.NewErrorResponse("Error checking token quota"))
+			return
+		}
+		if services.SetRetryAfter(c.Writer.Header(), err, time.Now()) {
+			writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+		}
+		c.JSON(status, models.NewErrorResponse(err.Error()))
+		return
+	}
+	// Give the reservation back if the call fails before it is settled
+	defer func() {
+		if err := tokenQuotaService.Release(reservation); err != nil {
+			log.Printf("Error releasing token reservation for user %s: %v", userID, err)
+		}
+	}()
+	capped := maxOutputTokens < config.AppConfig.DefaultMaxTokens
+
+	// Stream the generation so that it can be stopped as soon as the
+	// reserved output is used up, should Gemini overrun max output tokens
+	budget := services.NewOutputBudget(model, maxOutputTokens)
+	var html strings.Builder
+	var last *genai.GenerateContentResponse
+	finishReason := ""
+	for resp, err := range client.Models.GenerateContentStream(c.Request.Context(), model, req.Contents, &genai.GenerateContentConfig{
+		MaxOutputTokens: int32(maxOutputTokens),
+	}) {
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse(err.Error()))
+			return
+		}
+		last = resp
+		text := resp.Text()
+		if !budget.Add(text) {
+			// Leaving the loop closes the upstream stream
+			finishReason = services.FinishReasonQuotaExceeded
+			break
+		}
+		html.WriteString(text)
+		if capped && hitMaxTokens(resp) {
+			finishReason = services.FinishReasonQuotaExceeded
+		}
+	}
+	if last == nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Gemini returned no response"))
 		return
 	}
 
-	c.JSON(http.StatusOK, HTMLResponse{HTML: resp.Text()})
+	// Record the actual tokens used and their cost
+	usage := callUsage(last, promptTokens, budget.Used())
+	usage.Tags = tags
+	if _, err := tokenQuotaService.Settle(reservation, usage); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error recording token usage"))
+		return
+	}
+	writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+
+	c.JSON(http.StatusOK, HTMLResponse{HTML: html.String(), FinishReason: finishReason})
+}
+
+// estimatePromptTokens estimates the prompt tokens of Gemini contents. There
+// is no offline Gemini tokenizer, so text is estimated heuristically.
+func estimatePromptTokens(contents []*genai.Content) int {
+	tokens := 0
+	for _, content := range contents {
+		if content == nil {
+			continue
+		}
+		for _, part := range content.Parts {
+			if part == nil {
+				continue
+			}
+			if part.Text != "" {
+				n, _ := tokenizer.Count(model, part.Text)
+				tokens += n
+			}
+			if part.InlineData != nil || part.FileData != nil {
+				tokens += imageTokens
+			}
+		}
+	}
+	return tokens
+}
+
+// callUsage returns the usage of a Gemini call from the usage metadata of
+// its last response, falling back to estimates when it has none
+func callUsage(resp *genai.GenerateContentResponse, promptTokens, completionTokens int) services.CallUsage {
+	usage := services.CallUsage{Provider: "gemini", Model: model, ModelVersion: resp.ModelVersion, Endpoint: services.EndpointMakeHTML}
+	if metadata := resp.UsageMetadata; metadata != nil {
+		usage.PromptTokens = int(metadata.PromptTokenCount + metadata.ToolUsePromptTokenCount)
+		usage.CompletionTokens = int(metadata.CandidatesTokenCount + metadata.ThoughtsTokenCount)
+		return usage
+	}
+	log.Printf("Gemini response has no usage metadata, recording estimated usage")
+	usage.PromptTokens = promptTokens
+	usage.CompletionTokens = completionTokens
+	return usage
+}
+
+// hitMaxTokens reports whether a response stopped at the max output tokens
+func hitMaxTokens(resp *genai.GenerateContentResponse) bool {
+	for _, candidate := range resp.Candidates {
+		if candidate != nil && candidate.FinishReason == genai.FinishReasonMaxTokens {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRateLimitHeaders adds the user's quota windows to the response
+// headers. Failing to load them only costs the headers, not the call.
+func writeRateLimitHeaders(c *gin.Context, tokenQuotaService *services.TokenQuotaService, userID uuid.UUID, scope services.QuotaScope) {
+	if err := tokenQuotaService.WriteRateLimitHeaders(c.Writer.Header(), userID, scope); err != nil {
+		log.Printf("Error loading quota windows for user %s: %v", userID, err)
+	}
 }
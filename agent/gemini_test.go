@@ -9,19 +9,31 @@ import (
 	"testing"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
 	"github.com/vhybZApp/api/models"
 	"google.golang.org/genai"
 )
 
 func setupTestRouter() *gin.Engine {
 	config.LoadConfig()
+	config.AppConfig.DBPath = "file:" + uuid.NewString() + "?mode=memory&cache=shared"
+	if err := database.Initialize(); err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+	user := database.DBUser{Username: "agent", Email: "agent@example.com", Password: "x"}
+	if err := database.GetDB().Create(&user).Error; err != nil {
+		log.Fatalf("Error creating user: %v", err)
+	}
 	Init()
 	log.Println(config.AppConfig.GeminiAPIKey)
 	gin.SetMode(gin.TestMode)
 	router := gin.New()
-	router.POST("/html", MakeHTML)
+	router.POST("/html", func(c *gin.Context) {
+		c.Set("user_id", user.ID)
+	}, MakeHTML)
 	return router
 }
 
@@ -107,3 +119,26 @@ func TestMakeHTML_InvalidJSON(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEmpty(t, response.Error)
 }
+
+func TestCallUsage_FromUsageMetadata(t *testing.T) {
+	resp := &genai.GenerateContentResponse{
+		ModelVersion: "gemini-2.0-flash-001",
+		UsageMetadata: &genai.GenerateContentResponseUsageMetadata{
+			PromptTokenCount:     120,
+			CandidatesTokenCount: 800,
+			ThoughtsTokenCount:   50,
+		},
+	}
+	usage := callUsage(resp, 999, 999)
+	assert.Equal(t, "gemini", usage.Provider)
+	assert.Equal(t, model, usage.Model)
+	assert.Equal(t, "gemini-2.0-flash-001", usage.ModelVersion)
+	assert.Equal(t, 120, usage.PromptTokens)
+	assert.Equal(t, 850, usage.CompletionTokens)
+
+	// Without metadata the estimates are recorded
+	usage = callUsage(&genai.GenerateContentResponse{}, 40, 3)
+	assert.Equal(t, model, usage.Model)
+	assert.Equal(t, 40, usage.PromptTokens)
+	assert.Equal(t, 3, usage.CompletionTokens)
+}
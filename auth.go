@@ -7,9 +7,11 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/vhybZApp/api/config"
 	"github.com/vhybZApp/api/database"
 	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
 )
 
 type Claims struct {
@@ -85,6 +87,44 @@ func authMiddleware() gin.HandlerFunc {
 	}
 }
 
+// adminMiddleware only lets through users listed in ADMIN_USER_IDS. It must
+// run after authMiddleware.
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("user_id").(uuid.UUID)
+		for _, admin := range config.AppConfig.AdminUserIDs {
+			if admin == userID {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, models.NewErrorResponse("Admin access required"))
+		c.Abort()
+	}
+}
+
+// featureMiddleware only lets through users whose plan enables the given
+// feature flag. It must run after authMiddleware.
+func featureMiddleware(feature string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.MustGet("user_id").(uuid.UUID)
+		limits, err := services.NewTokenQuotaService(database.GetDB()).GetLimits(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+			c.Abort()
+			return
+		}
+
+		if !limits.HasFeature(feature) {
+			c.JSON(http.StatusForbidden, models.NewErrorResponse("Feature not available on the "+limits.Plan+" plan"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 // @Summary Register a new user
 // @Description Create a new user account with username, email, and password
 // @Tags auth
@@ -94,6 +134,8 @@ func authMiddleware() gin.HandlerFunc {
 // @Success 201 {object} models.RegisterResponse
 // @Failure 400 {object} models.ErrorResponse
 // @Failure 500 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse
+// @Header 429 {integer} Retry-After "Seconds until the client IP may call the route again"
 // @Router /auth/register [post]
 func register(c *gin.Context) {
 	var req models.RegisterRequest
@@ -127,6 +169,8 @@ func register(c *gin.Context) {
 // @Success 200 {object} models.TokenResponse
 // @Failure 400 {object} models.ErrorResponse
 // @Failure 401 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse
+// @Header 429 {integer} Retry-After "Seconds until the client IP may call the route again"
 // @Router /auth/login [post]
 func login(c *gin.Context) {
 	var req models.LoginRequest
@@ -172,6 +216,8 @@ func login(c *gin.Context) {
 // @Success 200 {object} models.TokenResponse
 // @Failure 400 {object} models.ErrorResponse
 // @Failure 401 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse
+// @Header 429 {integer} Retry-After "Seconds until the client IP may call the route again"
 // @Router /auth/refresh [post]
 func refresh(c *gin.Context) {
 	var req models.RefreshRequest
@@ -228,5 +274,45 @@ func getProfile(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, models.NewProfileResponse(user.Username, user.Email))
+	c.JSON(http.StatusOK, models.NewProfileResponse(user.Username, user.Email, user.Timezone))
+}
+
+// @Summary Update user profile
+// @Description Update the authenticated user's profile. The timezone decides when daily quotas reset.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param profile body models.UpdateProfileRequest true "Profile fields"
+// @Success 200 {object} models.ProfileResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /auth/profile [put]
+func updateProfile(c *gin.Context) {
+	var req models.UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := services.LoadTimezone(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid timezone"))
+			return
+		}
+	}
+
+	var user database.DBUser
+	if err := database.GetDB().Where("id = ?", c.MustGet("user_id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, models.NewErrorResponse("User not found"))
+		return
+	}
+
+	if err := database.GetDB().Model(&user).Update("timezone", req.Timezone).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error updating profile"))
+		return
+	}
+	user.Timezone = req.Timezone
+
+	c.JSON(http.StatusOK, models.NewProfileResponse(user.Username, user.Email, user.Timezone))
 }
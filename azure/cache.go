@@ -0,0 +1,86 @@
+package azure
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/services"
+)
+
+// HeaderCache reports whether a completion was answered from the response
+// cache, HIT, or called and cacheable, MISS
+const HeaderCache = "X-Cache"
+
+// responseCache holds the completions of deterministic chat requests, nil to
+// disable caching
+var responseCache services.ResponseCache
+
+// SetResponseCache sets the cache of the chat routes. Pass nil to disable
+// caching.
+func SetResponseCache(cache services.ResponseCache) {
+	responseCache = cache
+}
+
+// cacheControl holds the directives of a request's Cache-Control header
+type cacheControl struct {
+	// noCache skips the lookup; the fresh completion is still cached
+	noCache bool
+	// noStore keeps the completion out of the cache
+	noStore bool
+	// onlyIfCached answers from the cache without calling Azure
+	onlyIfCached bool
+}
+
+func parseCacheControl(header string) cacheControl {
+	var cc cacheControl
+	for _, directive := range strings.Split(header, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-cache":
+			cc.noCache = true
+		case "no-store":
+			cc.noStore = true
+		case "only-if-cached":
+			cc.onlyIfCached = true
+		}
+	}
+	return cc
+}
+
+// cacheKey returns the key of the completion of a request and whether it may
+// be cached: only requests sent at temperature 0 and not streamed are. The
+// key hashes the user, the deployment and the request in canonical form,
+// members sorted and numbers normalized, leaving out what doesn't change the
+// completion: tags, the model alias and the stream settings. Keys are per
+// user so that completions are never shared between tenants.
+func cacheKey(userID uuid.UUID, deployment *Deployment, body []byte, req *ChatCompletionRequest) (string, bool) {
+	if req.Stream {
+		return "", false
+	}
+	var request map[string]any
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", false
+	}
+	if temperature, ok := request["temperature"].(float64); !ok || temperature != 0 {
+		return "", false
+	}
+	delete(request, "tags")
+	delete(request, "model")
+	delete(request, "stream")
+	delete(request, "stream_options")
+
+	// Maps are marshalled with sorted keys
+	canonical, err := json.Marshal(map[string]any{
+		"user":       userID.String(),
+		"deployment": deployment.Alias,
+		"resource":   deployment.Name,
+		"request":    request,
+	})
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), true
+}
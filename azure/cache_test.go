@@ -0,0 +1,58 @@
+package azure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	user := uuid.New()
+	deployment := &Deployment{Alias: "gpt-4o", Name: "gpt-4o-prod"}
+	key := func(t *testing.T, userID uuid.UUID, d *Deployment, body string) (string, bool) {
+		var req ChatCompletionRequest
+		require.NoError(t, json.Unmarshal([]byte(body), &req))
+		return cacheKey(userID, d, []byte(body), &req)
+	}
+
+	base, ok := key(t, user, deployment, `{"messages":[{"role":"user","content":"Hi"}],"temperature":0,"seed":1}`)
+	require.True(t, ok)
+
+	// Member order, number formatting, tags and the model alias don't
+	// change the completion
+	same, ok := key(t, user, deployment, `{"model":"gpt-4o","seed":1.0,"temperature":0.0,"tags":{"feature":"eval"},"stream":false,"messages":[{"content":"Hi","role":"user"}]}`)
+	require.True(t, ok)
+	assert.Equal(t, base, same)
+
+	for name, body := range map[string]string{
+		"messages":   `{"messages":[{"role":"user","content":"Hello"}],"temperature":0,"seed":1}`,
+		"parameters": `{"messages":[{"role":"user","content":"Hi"}],"temperature":0,"seed":2}`,
+	} {
+		other, ok := key(t, user, deployment, body)
+		require.True(t, ok, name)
+		assert.NotEqual(t, base, other, name)
+	}
+	other, _ := key(t, uuid.New(), deployment, `{"messages":[{"role":"user","content":"Hi"}],"temperature":0,"seed":1}`)
+	assert.NotEqual(t, base, other, "user")
+	other, _ = key(t, user, &Deployment{Alias: "gpt-4o", Name: "gpt-4o-next"}, `{"messages":[{"role":"user","content":"Hi"}],"temperature":0,"seed":1}`)
+	assert.NotEqual(t, base, other, "deployment")
+
+	// Sampled and streamed completions aren't cached
+	for _, body := range []string{
+		`{"messages":[{"role":"user","content":"Hi"}]}`,
+		`{"messages":[{"role":"user","content":"Hi"}],"temperature":0.7}`,
+		`{"messages":[{"role":"user","content":"Hi"}],"temperature":0,"stream":true}`,
+	} {
+		_, ok := key(t, user, deployment, body)
+		assert.False(t, ok, body)
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	assert.Equal(t, cacheControl{}, parseCacheControl(""))
+	assert.Equal(t, cacheControl{noCache: true, onlyIfCached: true}, parseCacheControl("No-Cache, only-if-cached"))
+	assert.Equal(t, cacheControl{noStore: true}, parseCacheControl("max-age=0, no-store"))
+}
@@ -0,0 +1,67 @@
+package azure
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/upstream"
+)
+
+var (
+	upstreamOnce   sync.Once
+	upstreamClient *upstream.Client
+)
+
+// Upstream returns the client calling the Azure deployments, created from
+// the configuration on first use. Its connections are shared by every call.
+func Upstream() *upstream.Client {
+	upstreamOnce.Do(func() {
+		transport, err := upstream.NewTransport(upstream.TransportConfig{
+			MaxIdleConnsPerHost: config.AppConfig.UpstreamMaxIdleConnsPerHost,
+			IdleConnTimeout:     90 * time.Second,
+			DialTimeout:         10 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+			ProxyURL:            config.AppConfig.UpstreamProxy,
+		})
+		if err != nil {
+			log.Fatalf("Invalid UPSTREAM_PROXY: %v", err)
+		}
+		upstreamClient = upstream.NewClient(&http.Client{Transport: transport}, upstream.Policy{
+			Timeouts: map[string]time.Duration{
+				upstream.RouteChat:       config.AppConfig.UpstreamChatTimeout,
+				upstream.RouteStream:     config.AppConfig.UpstreamStreamTimeout,
+				upstream.RouteEmbeddings: config.AppConfig.UpstreamEmbeddingsTimeout,
+			},
+
+			MaxAttempts: config.AppConfig.UpstreamMaxAttempts,
+			BaseDelay:   config.AppConfig.UpstreamRetryBaseDelay,
+			MaxDelay:    config.AppConfig.UpstreamRetryMaxDelay,
+
+			FailureThreshold: config.AppConfig.UpstreamBreakerFailures,
+			OpenTimeout:      config.AppConfig.UpstreamBreakerOpenTimeout,
+			HalfOpenProbes:   config.AppConfig.UpstreamBreakerHalfOpenProbes,
+		})
+	})
+	return upstreamClient
+}
+
+// writeUpstreamError answers a call that could not reach Azure: 503 with a
+// Retry-After when its circuits are open, 500 otherwise
+func writeUpstreamError(c *gin.Context, err error) {
+	var open *upstream.CircuitOpenError
+	if errors.As(err, &open) {
+		// Round up so that clients retrying on time find a probe
+		seconds := (open.RetryAfter + time.Second - 1) / time.Second
+		c.Header("Retry-After", strconv.FormatInt(int64(seconds), 10))
+		c.JSON(http.StatusServiceUnavailable, models.NewErrorResponse("Azure OpenAI is unavailable, retry later"))
+		return
+	}
+	c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error sending request to Azure OpenAI"))
+}
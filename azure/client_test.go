@@ -0,0 +1,29 @@
+package azure
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/vhybZApp/api/upstream"
+)
+
+func TestWriteUpstreamError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeUpstreamError(c, &upstream.CircuitOpenError{RetryAfter: 1500 * time.Millisecond})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	c, _ = gin.CreateTestContext(w)
+	writeUpstreamError(c, errors.New("connection refused"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Header().Get("Retry-After"))
+}
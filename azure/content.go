@@ -0,0 +1,201 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/tokenizer"
+)
+
+// Types of message content parts
+const (
+	ContentPartText     = "text"
+	ContentPartImageURL = "image_url"
+)
+
+// ImageMIMETypes are the image formats accepted by the vision deployments
+var ImageMIMETypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// ErrInvalidContent is returned when message content is malformed or holds
+// an unsupported image
+var ErrInvalidContent = errors.New("invalid message content")
+
+// MessageContent is the content of a message: a string, or an array of text
+// and image parts. It is written back as it was read, including null.
+type MessageContent struct {
+	Text  string
+	Parts []ContentPart
+	null  bool
+}
+
+// ContentPart is a typed part of a message's content
+type ContentPart struct {
+	// Type is text or image_url
+	Type     string    `json:"type" example:"text"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL is an image input, given by URL or inline as a data: URI
+type ImageURL struct {
+	URL string `json:"url" example:"data:image/png;base64,iVBORw0KGgo..."`
+	// Detail is low, high or auto
+	Detail string `json:"detail,omitempty" example:"auto"`
+}
+
+// TextContent returns string content
+func TextContent(text string) MessageContent {
+	return MessageContent{Text: text}
+}
+
+// MarshalJSON encodes the content as a string, an array of parts or null
+func (m MessageContent) MarshalJSON() ([]byte, error) {
+	switch {
+	case m.Parts != nil:
+		return json.Marshal(m.Parts)
+	case m.null:
+		return []byte("null"), nil
+	}
+	return json.Marshal(m.Text)
+}
+
+// UnmarshalJSON decodes a string, an array of parts or null
+func (m *MessageContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*m = MessageContent{null: true}
+		return nil
+	case len(data) > 0 && data[0] == '[':
+		var parts []ContentPart
+		if err := json.Unmarshal(data, &parts); err != nil {
+			return err
+		}
+		*m = MessageContent{Parts: parts}
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return fmt.Errorf("content: expected a string or an array of parts: %w", err)
+	}
+	*m = MessageContent{Text: text}
+	return nil
+}
+
+// String returns the text of the content, its text parts joined by newlines
+func (m MessageContent) String() string {
+	if m.Parts == nil {
+		return m.Text
+	}
+	var texts []string
+	for _, part := range m.Parts {
+		if part.Type == ContentPartText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// hasImages reports whether the content holds an image
+func (m MessageContent) hasImages() bool {
+	for _, part := range m.Parts {
+		if part.Type == ContentPartImageURL {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the parts of the content. Inline images must be of an
+// accepted type and at most MaxImageBytes; images given by URL are fetched
+// by Azure, which checks them itself.
+func (m MessageContent) Validate() error {
+	for i, part := range m.Parts {
+		switch part.Type {
+		case ContentPartText:
+		case ContentPartImageURL:
+			if part.ImageURL == nil || part.ImageURL.URL == "" {
+				return fmt.Errorf("%w: part %d: image_url.url is required", ErrInvalidContent, i)
+			}
+			switch part.ImageURL.Detail {
+			case "", "auto", "low", "high":
+			default:
+				return fmt.Errorf("%w: part %d: detail must be low, high or auto", ErrInvalidContent, i)
+			}
+			if _, err := part.ImageURL.inline(); err != nil {
+				return fmt.Errorf("%w: part %d: %v", ErrInvalidContent, i, err)
+			}
+		default:
+			return fmt.Errorf("%w: part %d: unknown type %q", ErrInvalidContent, i, part.Type)
+		}
+	}
+	return nil
+}
+
+// ImageTokens returns the prompt tokens of the images of the content.
+// Images whose size is unknown, given by URL or in a format whose header
+// can't be read, are counted at their most.
+func (m MessageContent) ImageTokens() int {
+	tokens := 0
+	for _, part := range m.Parts {
+		if part.Type != ContentPartImageURL || part.ImageURL == nil {
+			continue
+		}
+		width, height := 0, 0
+		if data, err := part.ImageURL.inline(); err == nil && data != nil {
+			if img, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+				width, height = img.Width, img.Height
+			}
+		}
+		tokens += tokenizer.CountImage(width, height, part.ImageURL.Detail)
+	}
+	return tokens
+}
+
+// inline returns the image of a data: URI after checking its type and size,
+// or nil for http(s) URLs
+func (i *ImageURL) inline() ([]byte, error) {
+	if !strings.HasPrefix(i.URL, "data:") {
+		u, err := url.Parse(i.URL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, errors.New("image url must be an http(s) URL or a data: URI")
+		}
+		return nil, nil
+	}
+
+	header, encoded, ok := strings.Cut(strings.TrimPrefix(i.URL, "data:"), ",")
+	mimeType, isBase64 := strings.CutSuffix(header, ";base64")
+	if !ok || !isBase64 {
+		return nil, errors.New("image data: URI must be base64 encoded")
+	}
+	if !slices.Contains(ImageMIMETypes, mimeType) {
+		return nil, fmt.Errorf("image type %q is not one of %s", mimeType, strings.Join(ImageMIMETypes, ", "))
+	}
+	if base64.StdEncoding.DecodedLen(len(encoded)) > config.AppConfig.MaxImageBytes+2 {
+		return nil, fmt.Errorf("image is larger than %d bytes", config.AppConfig.MaxImageBytes)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("image data: %v", err)
+	}
+	if len(data) > config.AppConfig.MaxImageBytes {
+		return nil, fmt.Errorf("image is larger than %d bytes", config.AppConfig.MaxImageBytes)
+	}
+	// Don't trust the declared type
+	if sniffed := http.DetectContentType(data); sniffed != mimeType {
+		return nil, fmt.Errorf("image data is %s, not %s", sniffed, mimeType)
+	}
+	return data, nil
+}
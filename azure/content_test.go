@@ -0,0 +1,79 @@
+package azure
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/config"
+)
+
+// pngDataURI returns a data: URI of a blank PNG image of the given size
+func pngDataURI(t *testing.T, width, height int) string {
+	var b bytes.Buffer
+	require.NoError(t, png.Encode(&b, image.NewGray(image.Rect(0, 0, width, height))))
+	return "data:image/png;base64," + base64.StdEncoding.EncodeToString(b.Bytes())
+}
+
+func TestMessageContent_JSON(t *testing.T) {
+	// Every form of content is written back as it was read
+	for _, content := range []string{
+		`"Hello"`,
+		`null`,
+		`[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"https://example.com/cat.png","detail":"low"}}]`,
+	} {
+		var m MessageContent
+		require.NoError(t, json.Unmarshal([]byte(content), &m))
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		assert.JSONEq(t, content, string(data))
+	}
+
+	var m MessageContent
+	require.NoError(t, json.Unmarshal([]byte(`[{"type":"text","text":"a"},{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}},{"type":"text","text":"b"}]`), &m))
+	assert.Equal(t, "a\nb", m.String())
+	assert.Error(t, json.Unmarshal([]byte(`42`), &m))
+}
+
+func TestMessageContent_Validate(t *testing.T) {
+	config.AppConfig.MaxImageBytes = 1024
+	image := func(url, detail string) MessageContent {
+		return MessageContent{Parts: []ContentPart{{Type: ContentPartImageURL, ImageURL: &ImageURL{URL: url, Detail: detail}}}}
+	}
+
+	assert.NoError(t, TextContent("Hello").Validate())
+	assert.NoError(t, image("https://example.com/cat.png", "").Validate())
+	assert.NoError(t, image(pngDataURI(t, 16, 16), "high").Validate())
+
+	gif := "data:image/png;base64," + base64.StdEncoding.EncodeToString([]byte("GIF89a"))
+	for _, invalid := range []MessageContent{
+		{Parts: []ContentPart{{Type: "audio"}}},
+		{Parts: []ContentPart{{Type: ContentPartImageURL}}},
+		image("https://example.com/cat.png", "ultra"),
+		image("file:///etc/passwd", ""),
+		image("data:image/png,raw", ""),
+		image("data:image/svg+xml;base64,PHN2Zz4=", ""),
+		image("data:image/png;base64,not base64!", ""),
+		image(gif, ""),
+		image(pngDataURI(t, 2000, 2000), ""),
+	} {
+		assert.ErrorIs(t, invalid.Validate(), ErrInvalidContent)
+	}
+}
+
+func TestMessageContent_ImageTokens(t *testing.T) {
+	config.AppConfig.MaxImageBytes = 1 << 20
+	content := MessageContent{Parts: []ContentPart{
+		{Type: ContentPartText, Text: "Compare these"},
+		{Type: ContentPartImageURL, ImageURL: &ImageURL{URL: pngDataURI(t, 1024, 1024)}},
+		{Type: ContentPartImageURL, ImageURL: &ImageURL{URL: "https://example.com/cat.png", Detail: "low"}},
+		{Type: ContentPartImageURL, ImageURL: &ImageURL{URL: "https://example.com/dog.png"}},
+	}}
+	assert.Equal(t, 765+85+1445, content.ImageTokens())
+	assert.Zero(t, TextContent("Hello").ImageTokens())
+}
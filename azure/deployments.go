@@ -0,0 +1,263 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/upstream"
+)
+
+// Capabilities of a deployment
+const (
+	CapabilityChat      = "chat"
+	CapabilityStreaming = "streaming"
+	CapabilityTools     = "tools"
+	CapabilityVision    = "vision"
+	// CapabilityEmbeddings marks embedding deployments, which only serve
+	// POST /azure/embeddings
+	CapabilityEmbeddings = "embeddings"
+)
+
+// ErrModelNotFound is returned when a request names no known model
+var ErrModelNotFound = errors.New("model not found")
+
+// Deployment is an Azure OpenAI deployment clients select by its alias
+type Deployment struct {
+	// Alias is the model name clients send, e.g. gpt-4o-mini
+	Alias    string `json:"alias"`
+	Endpoint string `json:"endpoint"`
+	// Name is the name of the deployment on the Azure resource
+	Name       string `json:"deployment"`
+	APIVersion string `json:"api_version"`
+	// Key is the API key of the resource; ${VAR} is replaced by the
+	// environment variable VAR to keep keys out of the file
+	Key string `json:"key"`
+	// Model is the OpenAI model served, used to count tokens; the
+	// deployment name by default
+	Model        string   `json:"model,omitempty"`
+	Capabilities []string `json:"capabilities"`
+	// Fallbacks are other resources, e.g. in other regions, serving the
+	// same model. Calls fail over to them in order when the deployment
+	// fails; their empty fields are those of the deployment.
+	Fallbacks []Resource `json:"fallbacks,omitempty"`
+}
+
+// Resource is an Azure resource serving a deployment
+type Resource struct {
+	Endpoint   string `json:"endpoint"`
+	Name       string `json:"deployment,omitempty"`
+	APIVersion string `json:"api_version,omitempty"`
+	Key        string `json:"key,omitempty"`
+}
+
+// Can reports whether the deployment has a capability
+func (d *Deployment) Can(capability string) bool {
+	return slices.Contains(d.Capabilities, capability)
+}
+
+// TokenizerModel returns the model whose tokenizer counts the deployment's
+// tokens
+func (d *Deployment) TokenizerModel() string {
+	if d.Model != "" {
+		return d.Model
+	}
+	return d.Name
+}
+
+// Configured reports whether the deployment can be called
+func (d *Deployment) Configured() bool {
+	return d.Endpoint != "" && d.Key != "" && d.Name != ""
+}
+
+// resources returns the resources serving the deployment, itself first
+func (d *Deployment) resources() []Resource {
+	resources := []Resource{{Endpoint: d.Endpoint, Name: d.Name, APIVersion: d.APIVersion, Key: d.Key}}
+	for _, fallback := range d.Fallbacks {
+		r := resources[0]
+		r.Endpoint = fallback.Endpoint
+		if fallback.Name != "" {
+			r.Name = fallback.Name
+		}
+		if fallback.APIVersion != "" {
+			r.APIVersion = fallback.APIVersion
+		}
+		if fallback.Key != "" {
+			r.Key = fallback.Key
+		}
+		resources = append(resources, r)
+	}
+	return resources
+}
+
+// targets returns the upstream targets of an operation of the deployment,
+// e.g. chat/completions, in failover order
+func (d *Deployment) targets(operation string) []upstream.Target {
+	var targets []upstream.Target
+	for _, r := range d.resources() {
+		header := http.Header{}
+		header.Set("Content-Type", "application/json")
+		header.Set("api-key", r.Key)
+		targets = append(targets, upstream.Target{
+			Name:   r.name(),
+			URL:    r.url(operation),
+			Header: header,
+		})
+	}
+	return targets
+}
+
+// name identifies the resource in upstream health stats
+func (r Resource) name() string {
+	host := r.Endpoint
+	if u, err := url.Parse(r.Endpoint); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return host + "/" + r.Name
+}
+
+// url returns the URL of an operation of the deployment, e.g. chat/completions
+func (r Resource) url(operation string) string {
+	return strings.TrimSuffix(r.Endpoint, "/") + "/openai/deployments/" + r.Name + "/" + operation + "?api-version=" + r.APIVersion
+}
+
+// Registry holds the deployments by alias. The first one is the default for
+// requests that don't name a model.
+type Registry struct {
+	deployments []*Deployment
+}
+
+// NewRegistry returns a registry of deployments with unique aliases
+func NewRegistry(deployments []*Deployment) (*Registry, error) {
+	seen := make(map[string]bool)
+	for i, d := range deployments {
+		if d.Alias == "" || d.Endpoint == "" || d.Name == "" || d.APIVersion == "" || d.Key == "" {
+			return nil, fmt.Errorf("deployment %d: alias, endpoint, deployment, api_version and key are required", i)
+		}
+		if seen[d.Alias] {
+			return nil, fmt.Errorf("deployment %d: duplicate alias %q", i, d.Alias)
+		}
+		for j, fallback := range d.Fallbacks {
+			if fallback.Endpoint == "" {
+				return nil, fmt.Errorf("deployment %d: fallback %d: endpoint is required", i, j)
+			}
+		}
+		seen[d.Alias] = true
+	}
+	return &Registry{deployments: deployments}, nil
+}
+
+// LoadRegistry reads the deployments from a JSON file holding an array of
+// Deployment
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var deployments []*Deployment
+	if err := json.Unmarshal(data, &deployments); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, d := range deployments {
+		d.Key = os.ExpandEnv(d.Key)
+		for i := range d.Fallbacks {
+			d.Fallbacks[i].Key = os.ExpandEnv(d.Fallbacks[i].Key)
+		}
+	}
+	registry, err := NewRegistry(deployments)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return registry, nil
+}
+
+// Get returns the deployment of an alias, or the default one for ""
+func (r *Registry) Get(alias string) (*Deployment, error) {
+	if alias == "" && len(r.deployments) > 0 {
+		return r.deployments[0], nil
+	}
+	for _, d := range r.deployments {
+		if d.Alias == alias {
+			return d, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %q", ErrModelNotFound, alias)
+}
+
+// Embedding returns the embedding deployment of an alias, or the first one
+// for ""
+func (r *Registry) Embedding(alias string) (*Deployment, error) {
+	if alias == "" {
+		for _, d := range r.deployments {
+			if d.Can(CapabilityEmbeddings) {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: no embedding model is configured", ErrModelNotFound)
+	}
+	d, err := r.Get(alias)
+	if err != nil {
+		return nil, err
+	}
+	if !d.Can(CapabilityEmbeddings) {
+		return nil, fmt.Errorf("model %q does not support %s", d.Alias, CapabilityEmbeddings)
+	}
+	return d, nil
+}
+
+// List returns every deployment, the default first
+func (r *Registry) List() []*Deployment {
+	return r.deployments
+}
+
+// registry holds the deployments of the chat routes, nil to serve the single
+// deployment of the AZURE_OPENAI_* variables
+var registry *Registry
+
+// SetRegistry sets the deployments clients may choose from
+func SetRegistry(r *Registry) {
+	registry = r
+}
+
+// TokenizerModel returns the alias of the deployment a client names, ""
+// for the default one, and the model whose tokenizer counts its tokens
+func TokenizerModel(alias string) (string, string, error) {
+	d, err := deployments().Get(alias)
+	if err != nil {
+		return "", "", err
+	}
+	return d.Alias, d.TokenizerModel(), nil
+}
+
+// deployments returns the registry in use
+func deployments() *Registry {
+	if registry != nil {
+		return registry
+	}
+	r := &Registry{deployments: []*Deployment{{
+		Alias:        config.AppConfig.AzureOpenAIDeployment,
+		Endpoint:     config.AppConfig.AzureOpenAIEndpoint,
+		Name:         config.AppConfig.AzureOpenAIDeployment,
+		APIVersion:   config.AppConfig.AzureOpenAIDeploymentVersion,
+		Key:          config.AppConfig.AzureOpenAIKey,
+		Capabilities: []string{CapabilityChat, CapabilityStreaming, CapabilityTools, CapabilityVision},
+	}}}
+	// The embedding deployment lives on the same resource
+	if name := config.AppConfig.AzureOpenAIEmbeddingDeployment; name != "" {
+		r.deployments = append(r.deployments, &Deployment{
+			Alias:        name,
+			Endpoint:     config.AppConfig.AzureOpenAIEndpoint,
+			Name:         name,
+			APIVersion:   config.AppConfig.AzureOpenAIDeploymentVersion,
+			Key:          config.AppConfig.AzureOpenAIKey,
+			Capabilities: []string{CapabilityEmbeddings},
+		})
+	}
+	return r
+}
@@ -0,0 +1,102 @@
+package azure
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/services"
+)
+
+func TestLoadRegistry(t *testing.T) {
+	t.Setenv("AZURE_KEY_EU", "eu-secret")
+	path := filepath.Join(t.TempDir(), "deployments.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"alias": "gpt-4o", "endpoint": "https://us.openai.azure.com/", "deployment": "gpt4o-prod", "api_version": "2024-12-01-preview", "key": "us-secret", "model": "gpt-4o", "capabilities": ["chat", "streaming", "tools", "vision"],
+			"fallbacks": [{"endpoint": "https://eu.openai.azure.com", "key": "${AZURE_KEY_EU}"}]},
+		{"alias": "gpt-4o-mini", "endpoint": "https://eu.openai.azure.com", "deployment": "mini", "api_version": "2024-12-01-preview", "key": "${AZURE_KEY_EU}", "capabilities": ["chat"]}
+	]`), 0o644))
+
+	registry, err := LoadRegistry(path)
+	require.NoError(t, err)
+
+	// Requests without a model get the first deployment
+	d, err := registry.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4o", d.Alias)
+	targets := d.targets("chat/completions")
+	require.Len(t, targets, 2)
+	assert.Equal(t, "us.openai.azure.com/gpt4o-prod", targets[0].Name)
+	assert.Equal(t, "https://us.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version=2024-12-01-preview", targets[0].URL)
+	assert.Equal(t, "us-secret", targets[0].Header.Get("api-key"))
+
+	// Fallbacks inherit what they don't set
+	assert.Equal(t, "https://eu.openai.azure.com/openai/deployments/gpt4o-prod/chat/completions?api-version=2024-12-01-preview", targets[1].URL)
+	assert.Equal(t, "eu-secret", targets[1].Header.Get("api-key"))
+
+	d, err = registry.Get("gpt-4o-mini")
+	require.NoError(t, err)
+	assert.Equal(t, "eu-secret", d.Key)
+	assert.Equal(t, "mini", d.TokenizerModel())
+	assert.True(t, d.Can(CapabilityChat))
+	assert.False(t, d.Can(CapabilityVision))
+
+	_, err = registry.Get("gpt-5")
+	assert.ErrorIs(t, err, ErrModelNotFound)
+
+	// Plans only list the models they allow
+	list := listModels(registry, &services.QuotaLimits{AllowedModels: []string{"*-mini"}})
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, Model{ID: "gpt-4o-mini", Object: "model", OwnedBy: "azure", Capabilities: []string{"chat"}}, list.Data[0])
+	assert.Len(t, listModels(registry, &services.QuotaLimits{}).Data, 2)
+}
+
+func TestNewRegistry_Invalid(t *testing.T) {
+	valid := func() *Deployment {
+		return &Deployment{Alias: "gpt-4o", Endpoint: "https://us.openai.azure.com", Name: "gpt-4o", APIVersion: "2024-12-01-preview", Key: "secret"}
+	}
+	_, err := NewRegistry([]*Deployment{valid(), valid()})
+	assert.ErrorContains(t, err, "duplicate alias")
+
+	missingKey := valid()
+	missingKey.Key = ""
+	_, err = NewRegistry([]*Deployment{missingKey})
+	assert.Error(t, err)
+}
+
+func TestChatCompletionRequest_Capabilities(t *testing.T) {
+	req := ChatCompletionRequest{
+		Stream:   true,
+		Tools:    []Tool{{Type: "function", Function: FunctionDefinition{Name: "get_weather"}}},
+		Messages: []Message{{Role: "user", Content: MessageContent{Parts: []ContentPart{{Type: ContentPartImageURL, ImageURL: &ImageURL{URL: "https://example.com/cat.png"}}}}}},
+	}
+	assert.Equal(t, []string{CapabilityChat, CapabilityStreaming, CapabilityTools, CapabilityVision}, req.capabilities())
+	assert.Equal(t, []string{CapabilityChat}, (&ChatCompletionRequest{Messages: []Message{{Role: "user", Content: TextContent("Hi")}}}).capabilities())
+}
+
+func TestRegistry_Embedding(t *testing.T) {
+	chat := &Deployment{Alias: "gpt-4o", Endpoint: "https://us.openai.azure.com", Name: "gpt-4o", APIVersion: "2024-12-01-preview", Key: "k", Capabilities: []string{CapabilityChat}}
+	small := &Deployment{Alias: "embed-small", Endpoint: "https://us.openai.azure.com", Name: "text-embedding-3-small", APIVersion: "2024-12-01-preview", Key: "k", Capabilities: []string{CapabilityEmbeddings}}
+	large := &Deployment{Alias: "embed-large", Endpoint: "https://us.openai.azure.com", Name: "text-embedding-3-large", APIVersion: "2024-12-01-preview", Key: "k", Capabilities: []string{CapabilityEmbeddings}}
+	registry, err := NewRegistry([]*Deployment{chat, small, large})
+	require.NoError(t, err)
+
+	d, err := registry.Embedding("")
+	require.NoError(t, err)
+	assert.Same(t, small, d)
+	d, err = registry.Embedding("embed-large")
+	require.NoError(t, err)
+	assert.Same(t, large, d)
+
+	_, err = registry.Embedding("gpt-4o")
+	assert.EqualError(t, err, `model "gpt-4o" does not support embeddings`)
+	_, err = registry.Embedding("missing")
+	assert.ErrorIs(t, err, ErrModelNotFound)
+
+	registry, err = NewRegistry([]*Deployment{chat})
+	require.NoError(t, err)
+	_, err = registry.Embedding("")
+	assert.ErrorIs(t, err, ErrModelNotFound)
+}
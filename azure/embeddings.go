@@ -0,0 +1,340 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+	"github.com/vhybZApp/api/tokenizer"
+	"github.com/vhybZApp/api/upstream"
+)
+
+// EmbeddingRequest represents the request body for embeddings. Parameters it
+// doesn't model, e.g. user, are passed to Azure as they were sent.
+type EmbeddingRequest struct {
+	// Model is the alias of an embedding deployment, the first one when
+	// omitted
+	Model string `json:"model,omitempty" example:"text-embedding-3-small"`
+	// Input is a string or an array of strings, embedded in order
+	Input EmbeddingInput `json:"input" swaggertype:"array,string" example:"first document,second document"`
+	// Dimensions shortens the embeddings on models that support it
+	Dimensions int `json:"dimensions,omitempty" example:"256"`
+	// EncodingFormat is float, the default, or base64
+	EncodingFormat string `json:"encoding_format,omitempty" enums:"float,base64"`
+	// Tags attribute the cost of the call, e.g. {"feature": "search"}. They
+	// are merged over the X-Usage-Tags header and not sent upstream.
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// EmbeddingInput is the input of an embeddings request, sent as a string or
+// an array of strings
+type EmbeddingInput []string
+
+func (in *EmbeddingInput) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*in = EmbeddingInput{text}
+		return nil
+	}
+	var texts []string
+	if err := json.Unmarshal(data, &texts); err != nil {
+		return errors.New("input must be a string or an array of strings")
+	}
+	*in = texts
+	return nil
+}
+
+// EmbeddingResponse represents the embeddings of a request's inputs
+type EmbeddingResponse struct {
+	Object string      `json:"object" example:"list"`
+	Data   []Embedding `json:"data"`
+	Model  string      `json:"model"`
+	Usage  struct {
+		PromptTokens int `json:"prompt_tokens"`
+		TotalTokens  int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// Embedding is the embedding of the input at Index
+type Embedding struct {
+	Object string `json:"object" example:"embedding"`
+	Index  int    `json:"index"`
+	// Embedding is an array of floats, or a base64 string of little-endian
+	// float32 with encoding_format base64
+	Embedding json.RawMessage `json:"embedding" swaggertype:"array,number"`
+}
+
+// @Summary Create embeddings with Azure OpenAI
+// @Description Embed a string or an array of strings with an Azure OpenAI embedding deployment. The tokens of the inputs are reserved against the quota.
+// @Description model is the alias of an embedding deployment listed by GET /models, the first one when omitted.
+// @Description Batches larger than EMBEDDINGS_MAX_BATCH_INPUTS inputs or EMBEDDINGS_MAX_BATCH_TOKENS tokens are split into several calls to Azure and answered as one response, in input order.
+// @Tags azure
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body EmbeddingRequest true "Embeddings request parameters"
+// @Param X-Usage-Tags header string false "Cost attribution tags, e.g. feature=search,environment=prod"
+// @Success 200 {object} EmbeddingResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 402 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 429 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Failure 503 {object} models.ErrorResponse
+// @Header 200,429 {integer} X-RateLimit-Limit "Limit of the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Remaining "Remaining tokens, requests or micro-dollars in the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Reset "Seconds until the most constrained quota window resets"
+// @Header 429 {integer} Retry-After "Seconds until the exceeded quota window resets"
+// @Header 503 {integer} Retry-After "Seconds until Azure OpenAI is probed again"
+// @Router /azure/embeddings [post]
+func Embeddings(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	tokenQuotaService := services.NewTokenQuotaService(database.GetDB())
+
+	// Parse request body, keeping it to pass on what isn't modeled
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Error reading request body"))
+		return
+	}
+	var req EmbeddingRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if err := req.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	var raw rawObject
+	if err := json.Unmarshal(body, &raw); err != nil || raw == nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("request body must be a JSON object"))
+		return
+	}
+	tags, err := services.UsageTags(c.GetHeader(services.HeaderUsageTags), req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	// Check that the user's plan includes the deployment
+	deployment, err := deployments().Embedding(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	limits, err := tokenQuotaService.GetLimits(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+		return
+	}
+	if !limits.AllowsModel(deployment.Alias) {
+		c.JSON(http.StatusForbidden, models.NewErrorResponse(services.ErrModelNotAllowed.Error()))
+		return
+	}
+	if !deployment.Configured() {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Azure OpenAI configuration is incomplete"))
+		return
+	}
+
+	// Reserve the tokens of every input against the user's quota; the whole
+	// request is one call however many batches it is split into
+	scope := services.QuotaScope{Provider: "azure", Model: deployment.Alias, Endpoint: services.EndpointEmbeddings, PricedModel: deployment.TokenizerModel()}
+	tokens := make([]int, len(req.Input))
+	total := 0
+	for i, input := range req.Input {
+		tokens[i], _ = tokenizer.Count(deployment.TokenizerModel(), input)
+		total += tokens[i]
+	}
+	reservation, err := tokenQuotaService.Reserve(userID, scope, total)
+	if err != nil {
+		status := services.ReserveErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			c.JSON(status, models.NewErrorResponse("Error checking token quota"))
+			return
+		}
+		if services.SetRetryAfter(c.Writer.Header(), err, time.Now()) {
+			writeRateLimitHeaders(c, tokenQuotaService, userID, scope)
+		}
+		c.JSON(status, models.NewErrorResponse(err.Error()))
+		return
+	}
+	// Give the reservation back if no batch is embedded
+	defer func() {
+		if err := tokenQuotaService.Release(reservation); err != nil {
+			log.Printf("Error releasing token reservation for user %s: %v", userID, err)
+		}
+	}()
+
+	// Embed the batches in order. Batches Azure embedded are charged even
+	// when a later one fails, since they were paid for.
+	resp := EmbeddingResponse{Object: "list", Data: make([]Embedding, 0, len(req.Input)), Model: deployment.Alias}
+	settle := func() error {
+		// Price the model Azure reported, or the one the deployment serves
+		version := deployment.TokenizerModel()
+		if resp.Model != deployment.Alias {
+			version = resp.Model
+		}
+		_, err := tokenQuotaService.Settle(reservation, services.CallUsage{
+			Provider:     "azure",
+			Model:        deployment.Alias,
+			ModelVersion: version,
+			Endpoint:     services.EndpointEmbeddings,
+			PromptTokens: resp.Usage.PromptTokens,
+			Tags:         tags,
+		})
+		return err
+	}
+	// settleEmbedded charges the batches embedded before a failure
+	settleEmbedded := func() {
+		if resp.Usage.PromptTokens == 0 {
+			return
+		}
+		if err := settle(); err != nil {
+			log.Printf("Error recording embeddings usage for user %s: %v", userID, err)
+		}
+	}
+	for _, batch := range embeddingBatches(tokens, config.AppConfig.EmbeddingsMaxBatchInputs, config.AppConfig.EmbeddingsMaxBatchTokens) {
+		status, data, err := embedBatch(c.Request.Context(), deployment, raw, req.Input[batch.start:batch.end])
+		if err != nil {
+			settleEmbedded()
+			writeUpstreamError(c, err)
+			return
+		}
+		if status != http.StatusOK {
+			settleEmbedded()
+			c.JSON(status, models.NewErrorResponse(string(data)))
+			return
+		}
+		if err := resp.merge(data, batch.start, batch.end-batch.start); err != nil {
+			settleEmbedded()
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error parsing response"))
+			return
+		}
+	}
+
+	// Record the actual tokens used and their cost
+	if err := settle(); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error recording token usage"))
+		return
+	}
+	writeRateLimitHeaders(c, tokenQuotaService, userID, scope)
+	c.JSON(http.StatusOK, resp)
+}
+
+// validate checks the request before any quota is reserved for it
+func (req *EmbeddingRequest) validate() error {
+	if len(req.Input) == 0 {
+		return errors.New("input is required")
+	}
+	for i, input := range req.Input {
+		if input == "" {
+			return fmt.Errorf("input %d is empty", i)
+		}
+	}
+	if req.Dimensions < 0 {
+		return errors.New("dimensions must be positive")
+	}
+	switch req.EncodingFormat {
+	case "", "float", "base64":
+	default:
+		return fmt.Errorf("encoding_format must be float or base64, got %q", req.EncodingFormat)
+	}
+	return nil
+}
+
+// embeddingBatch is the range of inputs [start, end) sent in one call
+type embeddingBatch struct {
+	start, end int
+}
+
+// embeddingBatches splits inputs of the given token counts into batches of
+// at most maxInputs inputs and maxTokens tokens, in order. An input longer
+// than maxTokens is sent on its own, for Azure to accept or reject.
+func embeddingBatches(tokens []int, maxInputs, maxTokens int) []embeddingBatch {
+	var batches []embeddingBatch
+	batch, batchTokens := embeddingBatch{}, 0
+	for i, n := range tokens {
+		full := maxInputs > 0 && batch.end-batch.start >= maxInputs
+		if maxTokens > 0 && batchTokens+n > maxTokens {
+			full = true
+		}
+		if full && batch.end > batch.start {
+			batches = append(batches, batch)
+			batch, batchTokens = embeddingBatch{start: i, end: i}, 0
+		}
+		batch.end = i + 1
+		batchTokens += n
+	}
+	if batch.end > batch.start {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// embedBatch sends a batch of inputs to the deployment with the other
+// members of the client's body, returning Azure's status and body
+func embedBatch(ctx context.Context, deployment *Deployment, raw rawObject, inputs []string) (int, []byte, error) {
+	batch := maps.Clone(raw)
+	delete(batch, "tags")
+	// The deployment is chosen by the URL
+	delete(batch, "model")
+	if err := batch.set("input", inputs); err != nil {
+		return 0, nil, err
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := Upstream().Do(ctx, upstream.RouteEmbeddings, deployment.targets("embeddings"), body)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// merge adds the embeddings of a batch of n inputs starting at start to the
+// response, numbering them by input
+func (r *EmbeddingResponse) merge(data []byte, start, n int) error {
+	var batch EmbeddingResponse
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return err
+	}
+	if len(batch.Data) != n {
+		return fmt.Errorf("got %d embeddings for %d inputs", len(batch.Data), n)
+	}
+	embeddings := make([]Embedding, n)
+	for _, e := range batch.Data {
+		if e.Index < 0 || e.Index >= n || embeddings[e.Index].Embedding != nil {
+			return fmt.Errorf("embedding index %d out of range or repeated", e.Index)
+		}
+		e.Index += start
+		embeddings[e.Index-start] = e
+	}
+	r.Data = append(r.Data, embeddings...)
+	if batch.Model != "" {
+		r.Model = batch.Model
+	}
+	r.Usage.PromptTokens += batch.Usage.PromptTokens
+	r.Usage.TotalTokens += batch.Usage.TotalTokens
+	return nil
+}
@@ -0,0 +1,65 @@
+package azure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmbeddingRequest_Input(t *testing.T) {
+	var req EmbeddingRequest
+	require.NoError(t, json.Unmarshal([]byte(`{"input": "hello"}`), &req))
+	assert.Equal(t, EmbeddingInput{"hello"}, req.Input)
+	require.NoError(t, json.Unmarshal([]byte(`{"input": ["a", "b"], "dimensions": 256, "encoding_format": "base64"}`), &req))
+	assert.Equal(t, EmbeddingInput{"a", "b"}, req.Input)
+	assert.NoError(t, req.validate())
+
+	assert.Error(t, json.Unmarshal([]byte(`{"input": [1, 2]}`), &req))
+
+	for body, want := range map[string]string{
+		`{"input": []}`:                               "input is required",
+		`{"input": ["a", ""]}`:                        "input 1 is empty",
+		`{"input": "a", "dimensions": -1}`:            "dimensions must be positive",
+		`{"input": "a", "encoding_format": "binary"}`: `encoding_format must be float or base64, got "binary"`,
+	} {
+		req := EmbeddingRequest{}
+		require.NoError(t, json.Unmarshal([]byte(body), &req))
+		assert.EqualError(t, req.validate(), want, body)
+	}
+}
+
+func TestEmbeddingBatches(t *testing.T) {
+	// Split by count
+	assert.Equal(t, []embeddingBatch{{0, 2}, {2, 4}, {4, 5}}, embeddingBatches([]int{1, 1, 1, 1, 1}, 2, 100))
+	// Split by tokens, an input over the limit goes alone
+	assert.Equal(t, []embeddingBatch{{0, 2}, {2, 3}, {3, 4}, {4, 5}}, embeddingBatches([]int{4, 5, 3, 20, 2}, 10, 10))
+	// No limits
+	assert.Equal(t, []embeddingBatch{{0, 3}}, embeddingBatches([]int{4, 5, 3}, 0, 0))
+}
+
+func TestEmbeddingResponse_Merge(t *testing.T) {
+	resp := EmbeddingResponse{Object: "list", Model: "embed-small"}
+	require.NoError(t, resp.merge([]byte(`{"object": "list", "model": "text-embedding-3-small", "data": [
+		{"object": "embedding", "index": 1, "embedding": [0.3, 0.4]},
+		{"object": "embedding", "index": 0, "embedding": [0.1, 0.2]}
+	], "usage": {"prompt_tokens": 5, "total_tokens": 5}}`), 0, 2))
+	require.NoError(t, resp.merge([]byte(`{"object": "list", "model": "text-embedding-3-small", "data": [
+		{"object": "embedding", "index": 0, "embedding": "AAAAAA=="}
+	], "usage": {"prompt_tokens": 3, "total_tokens": 3}}`), 2, 1))
+
+	assert.Equal(t, "text-embedding-3-small", resp.Model)
+	assert.Equal(t, 8, resp.Usage.PromptTokens)
+	assert.Equal(t, 8, resp.Usage.TotalTokens)
+	require.Len(t, resp.Data, 3)
+	for i, want := range []string{`[0.1, 0.2]`, `[0.3, 0.4]`, `"AAAAAA=="`} {
+		assert.Equal(t, i, resp.Data[i].Index)
+		assert.JSONEq(t, want, string(resp.Data[i].Embedding))
+	}
+
+	// Azure must answer every input of the batch
+	assert.Error(t, resp.merge([]byte(`{"data": [{"index": 0, "embedding": []}]}`), 3, 2))
+	assert.Error(t, resp.merge([]byte(`{"data": [{"index": 2, "embedding": []}]}`), 3, 1))
+	assert.Len(t, resp.Data, 3)
+}
@@ -0,0 +1,67 @@
+package azure
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// Model is a model clients may select by its ID
+type Model struct {
+	ID     string `json:"id" example:"gpt-4o"`
+	Object string `json:"object" example:"model"`
+	// OwnedBy is the provider serving the model
+	OwnedBy      string   `json:"owned_by" example:"azure"`
+	Capabilities []string `json:"capabilities" example:"chat,streaming,tools,vision"`
+	// Default is set on the model used when a request names none
+	Default bool `json:"default,omitempty"`
+}
+
+// ModelList is the list of models of a user
+type ModelList struct {
+	Object string  `json:"object" example:"list"`
+	Data   []Model `json:"data"`
+}
+
+// ListModels godoc
+// @Summary List models
+// @Description List the models the authenticated user may select with the model field of chat completions, and their capabilities
+// @Tags azure
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} ModelList
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /models [get]
+func ListModels(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	limits, err := services.NewTokenQuotaService(database.GetDB()).GetLimits(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+		return
+	}
+
+	c.JSON(http.StatusOK, listModels(deployments(), limits))
+}
+
+// listModels returns the deployments the limits allow
+func listModels(r *Registry, limits *services.QuotaLimits) ModelList {
+	list := ModelList{Object: "list", Data: []Model{}}
+	for i, d := range r.List() {
+		if !limits.AllowsModel(d.Alias) {
+			continue
+		}
+		list.Data = append(list.Data, Model{
+			ID:           d.Alias,
+			Object:       "model",
+			OwnedBy:      "azure",
+			Capabilities: append([]string{}, d.Capabilities...),
+			Default:      i == 0,
+		})
+	}
+	return list
+}
@@ -1,9 +1,11 @@
 package azure
 
 import (
-	"bytes"
+	"cmp"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"time"
 
@@ -13,23 +15,126 @@ import (
 	"github.com/vhybZApp/api/database"
 	"github.com/vhybZApp/api/models"
 	"github.com/vhybZApp/api/services"
+	"github.com/vhybZApp/api/tokenizer"
+	"github.com/vhybZApp/api/upstream"
 )
 
-// ChatCompletionRequest represents the request body for chat completion
+// ChatCompletionRequest represents the request body for chat completion.
+// Parameters it doesn't model, e.g. seed or response_format, are passed to
+// Azure as they were sent.
 type ChatCompletionRequest struct {
-	Messages         []Message `json:"messages"`
-	MaxTokens        int       `json:"max_tokens,omitempty"`
-	Temperature      float64   `json:"temperature,omitempty"`
-	TopP             float64   `json:"top_p,omitempty"`
-	FrequencyPenalty float64   `json:"frequency_penalty,omitempty"`
-	PresencePenalty  float64   `json:"presence_penalty,omitempty"`
-	Stop             []string  `json:"stop,omitempty"`
+	// Model is the alias of the deployment, the default one when omitted
+	Model     string    `json:"model,omitempty" example:"gpt-4o"`
+	Messages  []Message `json:"messages"`
+	MaxTokens int       `json:"max_tokens,omitempty"`
+	// MaxCompletionTokens replaces max_tokens on newer models
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"`
+	// N is the number of choices generated, each up to the completion limit
+	N                int      `json:"n,omitempty"`
+	Temperature      float64  `json:"temperature,omitempty"`
+	TopP             float64  `json:"top_p,omitempty"`
+	FrequencyPenalty float64  `json:"frequency_penalty,omitempty"`
+	PresencePenalty  float64  `json:"presence_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+	// Tools are the functions the model may call
+	Tools      []Tool      `json:"tools,omitempty"`
+	ToolChoice *ToolChoice `json:"tool_choice,omitempty" swaggertype:"string" example:"auto"`
+	// ParallelToolCalls lets the model call several tools in one turn
+	ParallelToolCalls *bool `json:"parallel_tool_calls,omitempty"`
+	// Stream sends the completion as Server-Sent Events as it is generated
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// Tags attribute the cost of the call, e.g. {"feature": "search"}. They
+	// are merged over the X-Usage-Tags header and not sent upstream.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 // Message represents a single message in the chat
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	// Role is system, user, assistant or tool
+	Role string `json:"role"`
+	// Content is a string, or an array of ContentPart to send images
+	Content MessageContent `json:"content" swaggertype:"string" example:"Hello"`
+	Name    string         `json:"name,omitempty"`
+	// ToolCalls are the tools called by an assistant message
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+	// ToolCallID is the call a tool message answers
+	ToolCallID string `json:"tool_call_id,omitempty"`
+}
+
+// Tool is a function the model may call
+type Tool struct {
+	// Type is always function
+	Type     string             `json:"type" example:"function"`
+	Function FunctionDefinition `json:"function"`
+}
+
+// FunctionDefinition describes a function to the model
+type FunctionDefinition struct {
+	Name        string `json:"name" example:"get_weather"`
+	Description string `json:"description,omitempty"`
+	// Parameters is the JSON Schema of the arguments
+	Parameters json.RawMessage `json:"parameters,omitempty" swaggertype:"object"`
+	Strict     *bool           `json:"strict,omitempty"`
+}
+
+// ToolCall is a call of a tool by the model
+type ToolCall struct {
+	// Index identifies the call across the chunks of a stream
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id,omitempty"`
+	Type     string       `json:"type,omitempty" example:"function"`
+	Function FunctionCall `json:"function"`
+}
+
+// FunctionCall is the function a tool call calls
+type FunctionCall struct {
+	Name string `json:"name,omitempty"`
+	// Arguments are JSON encoded, as generated by the model
+	Arguments string `json:"arguments"`
+}
+
+// ToolChoice controls which tool the model calls: none, auto, required, or
+// the function named by Function. It is a string in JSON unless Function is
+// set.
+type ToolChoice struct {
+	Mode     string
+	Function string
+}
+
+// MarshalJSON encodes the choice as a mode or a named function
+func (t ToolChoice) MarshalJSON() ([]byte, error) {
+	if t.Function != "" {
+		return json.Marshal(namedToolChoice{Type: "function", Function: FunctionCall{Name: t.Function}})
+	}
+	return json.Marshal(t.Mode)
+}
+
+// UnmarshalJSON decodes a mode or a named function
+func (t *ToolChoice) UnmarshalJSON(data []byte) error {
+	var mode string
+	if err := json.Unmarshal(data, &mode); err == nil {
+		switch mode {
+		case "none", "auto", "required":
+			*t = ToolChoice{Mode: mode}
+			return nil
+		}
+		return fmt.Errorf("tool_choice: unknown mode %q", mode)
+	}
+	var named namedToolChoice
+	if err := json.Unmarshal(data, &named); err != nil {
+		return fmt.Errorf("tool_choice: expected a mode or a function: %w", err)
+	}
+	if named.Type != "function" || named.Function.Name == "" {
+		return fmt.Errorf("tool_choice: expected a function name")
+	}
+	*t = ToolChoice{Function: named.Function.Name}
+	return nil
+}
+
+type namedToolChoice struct {
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
 }
 
 // ChatCompletionResponse represents the response from Azure OpenAI
@@ -44,9 +149,12 @@ type ChatCompletionResponse struct {
 
 // Choice represents a single choice in the completion response
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message"`
-	FinishReason string  `json:"finish_reason"`
+	Index   int     `json:"index"`
+	Message Message `json:"message"`
+	// FinishReason is tool_calls when the message calls tools, and
+	// quota_exceeded when max_tokens was capped to the user's remaining
+	// quota and the completion reached it
+	FinishReason string `json:"finish_reason"`
 }
 
 // Usage represents token usage information
@@ -57,17 +165,35 @@ type Usage struct {
 }
 
 // @Summary Get chat completion from Azure OpenAI
-// @Description Get a chat completion response from Azure OpenAI API
+// @Description Get a chat completion response from Azure OpenAI API. max_tokens is capped to the user's remaining quota, shared by the n choices requested.
+// @Description Message content is a string or an array of {"type": "text", "text": "..."} and {"type": "image_url", "image_url": {"url": "...", "detail": "auto"}} parts. Inline images are data: URIs of PNG, JPEG, GIF or WebP up to MAX_IMAGE_BYTES.
+// @Description tool_choice is none, auto, required or {"type": "function", "function": {"name": "..."}}; tool calls are answered with tool messages carrying their tool_call_id.
+// @Description model is the alias of a deployment listed by GET /models, the first one when omitted.
+// @Description With stream set, the completion is sent as Server-Sent Events of ChatCompletionChunk, ending with data: [DONE].
+// @Description When RESPONSE_CACHE is set, completions of requests at temperature 0 that aren't streamed are cached per user for RESPONSE_CACHE_TTL. Completions answered from the cache carry X-Cache: HIT and aren't charged against the quota.
 // @Tags azure
 // @Accept json
 // @Produce json
+// @Produce text/event-stream
 // @Security BearerAuth
 // @Param request body ChatCompletionRequest true "Chat completion request parameters"
+// @Param X-Usage-Tags header string false "Cost attribution tags, e.g. feature=search,environment=prod"
+// @Param Cache-Control header string false "no-cache skips the response cache, no-store keeps the completion out of it, only-if-cached answers from it or fails with 504"
 // @Success 200 {object} ChatCompletionResponse
 // @Failure 400 {object} models.ErrorResponse
 // @Failure 401 {object} models.ErrorResponse
+// @Failure 402 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
 // @Failure 429 {object} models.ErrorResponse
 // @Failure 500 {object} models.ErrorResponse
+// @Failure 503 {object} models.ErrorResponse
+// @Failure 504 {object} models.ErrorResponse
+// @Header 200 {string} X-Cache "HIT when answered from the response cache, MISS when the completion was cacheable but called"
+// @Header 200,429 {integer} X-RateLimit-Limit "Limit of the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Remaining "Remaining tokens, requests or micro-dollars in the most constrained quota window"
+// @Header 200,429 {integer} X-RateLimit-Reset "Seconds until the most constrained quota window resets"
+// @Header 429 {integer} Retry-After "Seconds until the exceeded quota window resets"
+// @Header 503 {integer} Retry-After "Seconds until Azure OpenAI is probed again"
 // @Router /azure/chat/completions [post]
 func ChatCompletion(c *gin.Context) {
 	// Get user ID from context (assuming it's set by auth middleware)
@@ -80,61 +206,147 @@ func ChatCompletion(c *gin.Context) {
 	// Initialize token quota service
 	tokenQuotaService := services.NewTokenQuotaService(database.GetDB())
 
-	// Check if user has enough quota for a reasonable estimate (e.g., 1000 tokens)
-	if err := tokenQuotaService.UpdateUsage(userID.(uuid.UUID), 1000); err != nil {
-		c.JSON(http.StatusTooManyRequests, models.NewErrorResponse(err.Error()))
+	// Parse request body, keeping it to pass on what isn't modeled
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Error reading request body"))
 		return
 	}
+	var req ChatCompletionRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	for i, message := range req.Messages {
+		if err := message.Content.Validate(); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse(fmt.Sprintf("message %d: %v", i, err)))
+			return
+		}
+	}
+	tags, err := services.UsageTags(c.GetHeader(services.HeaderUsageTags), req.Tags)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	// Check that the user's plan includes the deployment and that it can
+	// serve the request
+	deployment, err := deployments().Get(req.Model)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	limits, err := tokenQuotaService.GetLimits(userID.(uuid.UUID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+		return
+	}
+	if !limits.AllowsModel(deployment.Alias) {
+		c.JSON(http.StatusForbidden, models.NewErrorResponse(services.ErrModelNotAllowed.Error()))
+		return
+	}
+	for _, capability := range req.capabilities() {
+		if !deployment.Can(capability) {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse(fmt.Sprintf("model %q does not support %s", deployment.Alias, capability)))
+			return
+		}
+	}
 
 	// Validate Azure OpenAI configuration
-	if config.AppConfig.AzureOpenAIEndpoint == "" || config.AppConfig.AzureOpenAIKey == "" || config.AppConfig.AzureOpenAIDeployment == "" {
+	if !deployment.Configured() {
 		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Azure OpenAI configuration is incomplete"))
 		return
 	}
 
-	// Parse request body
-	var req ChatCompletionRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+	scope := services.QuotaScope{Provider: "azure", Model: deployment.Alias, Endpoint: services.EndpointChatCompletions, PricedModel: deployment.TokenizerModel()}
+
+	// Answer deterministic requests from the cache when it holds their
+	// completion, without charging the quota
+	control := parseCacheControl(c.GetHeader("Cache-Control"))
+	key, cacheable := cacheKey(userID.(uuid.UUID), deployment, body, &req)
+	cacheable = cacheable && responseCache != nil
+	if cacheable && !control.noCache {
+		cached, ok, err := responseCache.Get(c.Request.Context(), key)
+		if err != nil {
+			log.Printf("Error reading the response cache: %v", err)
+		}
+		if ok {
+			c.Header(HeaderCache, "HIT")
+			writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+			c.Data(http.StatusOK, "application/json; charset=utf-8", cached)
+			return
+		}
+	}
+	if control.onlyIfCached {
+		c.JSON(http.StatusGatewayTimeout, models.NewErrorResponse("Completion not in the response cache"))
 		return
 	}
 
-	// Create HTTP client
-	client := &http.Client{
-		Timeout: 300 * time.Second,
+	// Reserve the worst case usage of the call against the user's quota,
+	// capping max_tokens to what is left of it
+	maxTokens := req.MaxTokens
+	if req.MaxCompletionTokens > 0 {
+		maxTokens = req.MaxCompletionTokens
 	}
-
-	// Marshal request body
-	reqBody, err := json.Marshal(req)
+	if maxTokens <= 0 {
+		maxTokens = config.AppConfig.DefaultMaxTokens
+	}
+	prompt := promptTokens(deployment.TokenizerModel(), &req)
+	// Every choice may run to the limit, so the reservation covers n of them
+	choices := max(req.N, 1)
+	reservation, allowedTokens, err := tokenQuotaService.ReserveCompletions(userID.(uuid.UUID), scope, prompt, maxTokens, choices)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error marshaling request body"))
+		status := services.ReserveErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			c.JSON(status, models.NewErrorResponse("Error checking token quota"))
+			return
+		}
+		if services.SetRetryAfter(c.Writer.Header(), err, time.Now()) {
+			writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+		}
+		c.JSON(status, models.NewErrorResponse(err.Error()))
 		return
 	}
+	// Give the reservation back if the call fails before it is settled
+	defer func() {
+		if err := tokenQuotaService.Release(reservation); err != nil {
+			log.Printf("Error releasing token reservation for user %s: %v", userID, err)
+		}
+	}()
+	writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+	capped := allowedTokens < maxTokens
+	// Streams always ask for the usage chunk so that the call can be settled
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
 
-	// Create request
-	url := config.AppConfig.AzureOpenAIEndpoint + "/openai/deployments/" +
-		config.AppConfig.AzureOpenAIDeployment + "/chat/completions?api-version=" + config.AppConfig.AzureOpenAIDeploymentVersion
-
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(reqBody))
+	// Marshal request body
+	reqBody, err := upstreamBody(body, &req, allowedTokens, capped)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error creating request"))
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
 		return
 	}
 
-	// Set headers
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("api-key", config.AppConfig.AzureOpenAIKey)
-
-	// Send request
-	resp, err := client.Do(httpReq)
+	// Send request, retrying and failing over to the deployment's other
+	// resources. The call holds a single reservation however many attempts
+	// it takes. It is cancelled when the client goes away.
+	route := upstream.RouteChat
+	if req.Stream {
+		route = upstream.RouteStream
+	}
+	resp, err := Upstream().Do(c.Request.Context(), route, deployment.targets("chat/completions"), reqBody)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error sending request to Azure OpenAI"))
+		writeUpstreamError(c, err)
 		return
 	}
 	defer resp.Body.Close()
 
+	if req.Stream && resp.StatusCode == http.StatusOK {
+		budget := services.NewOutputBudget(deployment.TokenizerModel(), allowedTokens*choices)
+		streamChatCompletion(c, tokenQuotaService, reservation, deployment, resp.Body, budget, tags, prompt, capped, includeUsage)
+		return
+	}
+
 	// Read response body
-	body, err := io.ReadAll(resp.Body)
+	body, err = io.ReadAll(resp.Body)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error reading response body"))
 		return
@@ -153,11 +365,125 @@ func ChatCompletion(c *gin.Context) {
 		return
 	}
 
-	// Update token usage with actual tokens used
-	if err := tokenQuotaService.UpdateUsage(userID.(uuid.UUID), chatResp.Usage.TotalTokens); err != nil {
-		c.JSON(http.StatusTooManyRequests, models.NewErrorResponse(err.Error()))
+	// Record the actual tokens used and their cost
+	if _, err := tokenQuotaService.Settle(reservation, services.CallUsage{
+		Provider:         "azure",
+		Model:            deployment.Alias,
+		ModelVersion:     cmp.Or(chatResp.Model, deployment.TokenizerModel()),
+		Endpoint:         services.EndpointChatCompletions,
+		PromptTokens:     chatResp.Usage.PromptTokens,
+		CompletionTokens: chatResp.Usage.CompletionTokens,
+		Tags:             tags,
+	}); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error recording token usage"))
+		return
+	}
+	writeRateLimitHeaders(c, tokenQuotaService, userID.(uuid.UUID), scope)
+
+	// Send Azure's completion as it came, only reporting the quota on
+	// completions stopped by the cap
+	body, err = rewriteCompletion(body, capped, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error parsing response"))
 		return
 	}
 
-	c.JSON(http.StatusOK, chatResp)
+	if cacheable {
+		c.Header(HeaderCache, "MISS")
+		// Completions cut short by the quota depend on it, don't cache them
+		if !capped && !control.noStore && len(body) <= config.AppConfig.ResponseCacheMaxEntryBytes {
+			expiresAt := time.Now().Add(config.AppConfig.ResponseCacheTTL)
+			if err := responseCache.Set(c.Request.Context(), key, body, expiresAt); err != nil {
+				log.Printf("Error writing the response cache: %v", err)
+			}
+		}
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// streamChatCompletion relays a streamed completion to the client and settles
+// it. Streams that end before their usage chunk, e.g. because the client
+// went away or the quota ran out, are settled with the tokens counted along
+// the way.
+func streamChatCompletion(c *gin.Context, tokenQuotaService *services.TokenQuotaService, reservation *services.Reservation, deployment *Deployment, body io.Reader, budget *services.OutputBudget, tags map[string]string, prompt int, capped, includeUsage bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	result := relayStream(c.Writer, body, budget, capped, includeUsage)
+	if result.Err != nil {
+		log.Printf("Chat completion stream for user %s ended early: %v", reservation.UserID, result.Err)
+	}
+
+	usage := services.CallUsage{
+		Provider:     "azure",
+		Model:        deployment.Alias,
+		ModelVersion: cmp.Or(result.Model, deployment.TokenizerModel()),
+		Endpoint:     services.EndpointChatCompletions,
+		Tags:         tags,
+	}
+	if result.Usage != nil {
+		usage.PromptTokens = result.Usage.PromptTokens
+		usage.CompletionTokens = result.Usage.CompletionTokens
+	} else {
+		usage.PromptTokens = prompt
+		usage.CompletionTokens = budget.Used()
+	}
+	// The response has started, so failures can only be logged
+	if _, err := tokenQuotaService.Settle(reservation, usage); err != nil {
+		log.Printf("Error recording token usage for user %s: %v", reservation.UserID, err)
+	}
+}
+
+// capabilities returns the deployment capabilities the request needs
+func (req *ChatCompletionRequest) capabilities() []string {
+	capabilities := []string{CapabilityChat}
+	if req.Stream {
+		capabilities = append(capabilities, CapabilityStreaming)
+	}
+	if len(req.Tools) > 0 {
+		capabilities = append(capabilities, CapabilityTools)
+	}
+	for _, message := range req.Messages {
+		if message.Content.hasImages() {
+			capabilities = append(capabilities, CapabilityVision)
+			break
+		}
+	}
+	return capabilities
+}
+
+// promptTokens counts the tokens of the prompt of a chat completion. Tool
+// calls and definitions are counted as the JSON the model is shown, which
+// errs on the high side, and images by their size and detail.
+func promptTokens(model string, req *ChatCompletionRequest) int {
+	messages := make([]tokenizer.Message, 0, len(req.Messages))
+	images := 0
+	for _, message := range req.Messages {
+		content := message.Content.String()
+		images += message.Content.ImageTokens()
+		for _, call := range message.ToolCalls {
+			content += call.Function.Name + call.Function.Arguments
+		}
+		messages = append(messages, tokenizer.Message{Role: message.Role, Name: message.Name, Content: content})
+	}
+	tokens, _ := tokenizer.CountMessages(model, messages)
+	tokens += images
+	if len(req.Tools) > 0 {
+		if tools, err := json.Marshal(req.Tools); err == nil {
+			n, _ := tokenizer.Count(model, string(tools))
+			tokens += n
+		}
+	}
+	return tokens
+}
+
+// writeRateLimitHeaders adds the user's quota windows to the response
+// headers. Failing to load them only costs the headers, not the call.
+func writeRateLimitHeaders(c *gin.Context, tokenQuotaService *services.TokenQuotaService, userID uuid.UUID, scope services.QuotaScope) {
+	if err := tokenQuotaService.WriteRateLimitHeaders(c.Writer.Header(), userID, scope); err != nil {
+		log.Printf("Error loading quota windows for user %s: %v", userID, err)
+	}
 }
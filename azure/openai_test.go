@@ -0,0 +1,66 @@
+package azure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestToolChoice_JSON(t *testing.T) {
+	for _, tt := range []struct {
+		json   string
+		choice ToolChoice
+	}{
+		{json: `"auto"`, choice: ToolChoice{Mode: "auto"}},
+		{json: `"required"`, choice: ToolChoice{Mode: "required"}},
+		{json: `{"type":"function","function":{"name":"get_weather","arguments":""}}`, choice: ToolChoice{Function: "get_weather"}},
+	} {
+		var choice ToolChoice
+		require.NoError(t, json.Unmarshal([]byte(tt.json), &choice))
+		assert.Equal(t, tt.choice, choice)
+		data, err := json.Marshal(choice)
+		require.NoError(t, err)
+		assert.JSONEq(t, tt.json, string(data))
+	}
+
+	for _, invalid := range []string{`"sometimes"`, `{"type":"function","function":{}}`, `42`} {
+		var choice ToolChoice
+		assert.Error(t, json.Unmarshal([]byte(invalid), &choice), invalid)
+	}
+}
+
+func TestChatCompletionRequest_Tools(t *testing.T) {
+	body := `{
+		"messages": [
+			{"role": "user", "content": "Weather in Paris?"},
+			{"role": "assistant", "content": null, "tool_calls": [{"id": "call_1", "type": "function", "function": {"name": "get_weather", "arguments": "{\"city\":\"Paris\"}"}}]},
+			{"role": "tool", "tool_call_id": "call_1", "content": "{\"celsius\":21}"}
+		],
+		"tools": [{"type": "function", "function": {"name": "get_weather", "parameters": {"type": "object", "properties": {"city": {"type": "string"}}}}}],
+		"tool_choice": "auto"
+	}`
+	var req ChatCompletionRequest
+	require.NoError(t, json.Unmarshal([]byte(body), &req))
+	require.Len(t, req.Messages, 3)
+	assert.Equal(t, "get_weather", req.Messages[1].ToolCalls[0].Function.Name)
+	assert.Equal(t, "call_1", req.Messages[2].ToolCallID)
+
+	// Tools survive the trip upstream
+	data, err := json.Marshal(req)
+	require.NoError(t, err)
+	var upstream map[string]any
+	require.NoError(t, json.Unmarshal(data, &upstream))
+	assert.Equal(t, "auto", upstream["tool_choice"])
+	tools := upstream["tools"].([]any)
+	require.Len(t, tools, 1)
+	assert.Equal(t, "object", tools[0].(map[string]any)["function"].(map[string]any)["parameters"].(map[string]any)["type"])
+	assert.Equal(t, "call_1", upstream["messages"].([]any)[2].(map[string]any)["tool_call_id"])
+
+	// Tool definitions and calls count towards the prompt
+	withoutTools := req
+	withoutTools.Tools = nil
+	withoutTools.Messages = req.Messages[:1]
+	assert.Greater(t, promptTokens("gpt-4o", &req), promptTokens("gpt-4o", &withoutTools))
+}
@@ -0,0 +1,99 @@
+package azure
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/vhybZApp/api/services"
+)
+
+// rawObject is a JSON object whose members are kept as they were written,
+// so that parameters the proxy doesn't model reach Azure untouched
+type rawObject map[string]json.RawMessage
+
+func (o rawObject) set(key string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	o[key] = data
+	return nil
+}
+
+// upstreamBody returns the request body sent to Azure: the client's body
+// with only the members the proxy controls rewritten. Tags and model are
+// dropped; a completion limit capped to the quota replaces the client's,
+// and the reserved one is sent when the client set none so that Azure
+// can't generate past the reservation; streams always ask for their usage.
+func upstreamBody(body []byte, req *ChatCompletionRequest, maxTokens int, capped bool) ([]byte, error) {
+	var raw rawObject
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, errors.New("request body must be a JSON object")
+	}
+
+	delete(raw, "tags")
+	// The deployment is chosen by the URL
+	delete(raw, "model")
+	if capped || (req.MaxTokens <= 0 && req.MaxCompletionTokens <= 0) {
+		// Newer models take max_completion_tokens, keep the client's choice
+		key := "max_tokens"
+		if req.MaxCompletionTokens > 0 {
+			key = "max_completion_tokens"
+		}
+		if err := raw.set(key, maxTokens); err != nil {
+			return nil, err
+		}
+	}
+	if req.Stream {
+		if err := raw.set("stream_options", StreamOptions{IncludeUsage: true}); err != nil {
+			return nil, err
+		}
+	} else {
+		delete(raw, "stream_options")
+	}
+	return json.Marshal(raw)
+}
+
+// rewriteCompletion patches a completion or chunk from Azure, leaving the
+// members the proxy doesn't control untouched. When capped, choices stopped
+// by max_tokens report quota_exceeded since the quota stopped them, not the
+// client. With dropUsage, the usage the client didn't ask for is removed.
+func rewriteCompletion(data []byte, capped, dropUsage bool) ([]byte, error) {
+	if !capped && !dropUsage {
+		return data, nil
+	}
+	var raw rawObject
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	if _, ok := raw["usage"]; ok && dropUsage {
+		delete(raw, "usage")
+		changed = true
+	}
+	var choices []rawObject
+	if capped && json.Unmarshal(raw["choices"], &choices) == nil {
+		for _, choice := range choices {
+			var reason string
+			if json.Unmarshal(choice["finish_reason"], &reason) == nil && reason == "length" {
+				if err := choice.set("finish_reason", services.FinishReasonQuotaExceeded); err != nil {
+					return nil, err
+				}
+				changed = true
+			}
+		}
+		if changed {
+			if err := raw.set("choices", choices); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(raw)
+}
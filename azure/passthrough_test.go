@@ -0,0 +1,73 @@
+package azure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamBody(t *testing.T) {
+	body := []byte(`{
+		"model": "gpt-4o",
+		"messages": [{"role": "user", "content": "Hi"}],
+		"temperature": 0,
+		"seed": 42,
+		"n": 2,
+		"logit_bias": {"50256": -100},
+		"response_format": {"type": "json_object"},
+		"max_tokens": 1000,
+		"tags": {"feature": "search"}
+	}`)
+	var req ChatCompletionRequest
+	require.NoError(t, json.Unmarshal(body, &req))
+
+	// Parameters the proxy doesn't control are passed as they were sent
+	upstream, err := upstreamBody(body, &req, 1000, false)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"messages": [{"role": "user", "content": "Hi"}],
+		"temperature": 0,
+		"seed": 42,
+		"n": 2,
+		"logit_bias": {"50256": -100},
+		"response_format": {"type": "json_object"},
+		"max_tokens": 1000
+	}`, string(upstream))
+
+	// The quota caps the completion limit the client used
+	upstream, err = upstreamBody(body, &req, 100, true)
+	require.NoError(t, err)
+	assert.Contains(t, string(upstream), `"max_tokens":100`)
+
+	body = []byte(`{"messages": [], "max_completion_tokens": 1000, "stream": true, "stream_options": {"include_usage": false}}`)
+	req = ChatCompletionRequest{}
+	require.NoError(t, json.Unmarshal(body, &req))
+	upstream, err = upstreamBody(body, &req, 100, true)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"messages": [], "max_completion_tokens": 100, "stream": true, "stream_options": {"include_usage": true}}`, string(upstream))
+
+	// Completions without a limit are limited to the reservation
+	body = []byte(`{"messages": []}`)
+	req = ChatCompletionRequest{}
+	require.NoError(t, json.Unmarshal(body, &req))
+	upstream, err = upstreamBody(body, &req, 4096, false)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"messages": [], "max_tokens": 4096}`, string(upstream))
+
+	_, err = upstreamBody([]byte(`null`), &req, 100, false)
+	assert.Error(t, err)
+}
+
+func TestRewriteCompletion(t *testing.T) {
+	completion := []byte(`{"id":"1","system_fingerprint":"fp_1","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"logprobs":null,"finish_reason":"length"},{"index":1,"message":{"role":"assistant","content":"Hey"},"finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":1,"total_tokens":2}}`)
+
+	unchanged, err := rewriteCompletion(completion, false, false)
+	require.NoError(t, err)
+	assert.Equal(t, completion, unchanged)
+
+	rewritten, err := rewriteCompletion(completion, true, true)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id":"1","system_fingerprint":"fp_1","choices":[{"index":0,"message":{"role":"assistant","content":"Hi"},"logprobs":null,"finish_reason":"quota_exceeded"},{"index":1,"message":{"role":"assistant","content":"Hey"},"finish_reason":"stop"}]}`, string(rewritten))
+}
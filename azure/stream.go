@@ -0,0 +1,167 @@
+package azure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+
+	"github.com/vhybZApp/api/services"
+)
+
+// StreamOptions configures streamed chat completions
+type StreamOptions struct {
+	// IncludeUsage adds a final chunk with the token usage of the call
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ChatCompletionChunk is one Server-Sent Event of a streamed chat completion
+type ChatCompletionChunk struct {
+	ID      string        `json:"id"`
+	Object  string        `json:"object"`
+	Created int64         `json:"created"`
+	Model   string        `json:"model"`
+	Choices []ChunkChoice `json:"choices"`
+	// Usage is only set on the final chunk, whose choices are empty
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// ChunkChoice is the part of a choice carried by a chunk
+type ChunkChoice struct {
+	Index        int     `json:"index"`
+	Delta        Delta   `json:"delta"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// Delta is the part of a message carried by a chunk. Tool calls are spread
+// over chunks by their index, with the arguments arriving in pieces.
+type Delta struct {
+	Role      string     `json:"role,omitempty"`
+	Content   string     `json:"content,omitempty"`
+	ToolCalls []ToolCall `json:"tool_calls,omitempty"`
+}
+
+// streamResult is what a relayed stream tells about the call
+type streamResult struct {
+	// Model is the model reported by the chunks, if any
+	Model string
+	// Usage is the usage of the final chunk, nil when the stream ended
+	// before it
+	Usage *Usage
+	// Err is the error that interrupted the stream, nil once it is done
+	Err error
+}
+
+// sseWriter is the part of gin.ResponseWriter a stream is relayed to
+type sseWriter interface {
+	io.Writer
+	http.Flusher
+}
+
+// relayStream forwards the Server-Sent Events of an upstream chat completion
+// to w as they arrive, flushing after every event. Completion tokens are
+// counted on budget so that streams cut short can still be accounted for.
+// When capped, completions stopped by max_tokens report quota_exceeded. The
+// usage chunk is only forwarded when the client asked for it.
+//
+// Once the budget is used up the stream is cut off: the chunk running past
+// it is dropped, the choices still generating finish with quota_exceeded
+// and relayStream returns so that the caller closes the upstream.
+func relayStream(w sseWriter, body io.Reader, budget *services.OutputBudget, capped, includeUsage bool) streamResult {
+	var result streamResult
+	// generating holds the choices that have not finished yet
+	generating := make(map[int]bool)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := bytes.CutPrefix(scanner.Bytes(), []byte("data:"))
+		if !ok {
+			// Blank separators and comments carry nothing to forward
+			continue
+		}
+		data = bytes.TrimSpace(data)
+
+		if !bytes.Equal(data, []byte("[DONE]")) {
+			var chunk ChatCompletionChunk
+			if err := json.Unmarshal(data, &chunk); err != nil {
+				result.Err = err
+				return result
+			}
+			if chunk.Model != "" {
+				result.Model = chunk.Model
+			}
+			if chunk.Usage != nil {
+				result.Usage = chunk.Usage
+				if len(chunk.Choices) == 0 && !includeUsage {
+					continue
+				}
+			}
+
+			fits := true
+			for _, choice := range chunk.Choices {
+				fits = budget.Add(choice.Delta.Content) && fits
+				for _, call := range choice.Delta.ToolCalls {
+					fits = budget.Add(call.Function.Name+call.Function.Arguments) && fits
+				}
+				generating[choice.Index] = true
+			}
+			if !fits {
+				result.Err = writeQuotaExceeded(w, &chunk, generating)
+				return result
+			}
+			for _, choice := range chunk.Choices {
+				if choice.FinishReason != nil {
+					delete(generating, choice.Index)
+				}
+			}
+			var err error
+			if data, err = rewriteCompletion(data, capped, !includeUsage); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+
+		if err := writeEvent(w, data); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	result.Err = scanner.Err()
+	return result
+}
+
+// writeQuotaExceeded ends a stream cut off by the quota with a chunk
+// finishing the choices still generating, followed by [DONE]
+func writeQuotaExceeded(w sseWriter, last *ChatCompletionChunk, generating map[int]bool) error {
+	reason := services.FinishReasonQuotaExceeded
+	chunk := ChatCompletionChunk{ID: last.ID, Object: last.Object, Created: last.Created, Model: last.Model, Choices: []ChunkChoice{}}
+	for _, index := range slices.Sorted(maps.Keys(generating)) {
+		chunk.Choices = append(chunk.Choices, ChunkChoice{Index: index, FinishReason: &reason})
+	}
+	data, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	if err := writeEvent(w, data); err != nil {
+		return err
+	}
+	return writeEvent(w, []byte("[DONE]"))
+}
+
+// writeEvent writes one Server-Sent Event and flushes it to the client
+func writeEvent(w sseWriter, data []byte) error {
+	if _, err := w.Write([]byte("data: ")); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte("\n\n")); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
@@ -0,0 +1,83 @@
+package azure
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/services"
+	"github.com/vhybZApp/api/tokenizer"
+)
+
+const upstreamStream = `data: {"id":"1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"},"finish_reason":null}]}
+
+: keep-alive
+
+data: {"id":"1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{"role":"","content":" world"},"finish_reason":"length"}]}
+
+data: {"id":"1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":2,"total_tokens":14}}
+
+data: [DONE]
+
+`
+
+func TestRelayStream(t *testing.T) {
+	w := httptest.NewRecorder()
+	budget := services.NewOutputBudget("gpt-4o", 100)
+	result := relayStream(w, strings.NewReader(upstreamStream), budget, true, false)
+	require.NoError(t, result.Err)
+	assert.Equal(t, "gpt-4o", result.Model)
+	assert.Equal(t, &Usage{PromptTokens: 12, CompletionTokens: 2, TotalTokens: 14}, result.Usage)
+	assert.Positive(t, budget.Used())
+	assert.True(t, w.Flushed)
+
+	// The usage chunk the client did not ask for is dropped and the capped
+	// completion reports the quota
+	events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	require.Len(t, events, 3)
+	assert.Contains(t, events[0], `"content":"Hello"`)
+	assert.Contains(t, events[1], `"finish_reason":"quota_exceeded"`)
+	assert.Equal(t, "data: [DONE]", events[2])
+
+	// Clients asking for usage get it, and uncapped completions keep their
+	// finish reason
+	w = httptest.NewRecorder()
+	result = relayStream(w, strings.NewReader(upstreamStream), services.NewOutputBudget("gpt-4o", 100), false, true)
+	require.NoError(t, result.Err)
+	events = strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	require.Len(t, events, 4)
+	assert.Contains(t, events[1], `"finish_reason":"length"`)
+	assert.Contains(t, events[2], `"completion_tokens":2`)
+}
+
+func TestRelayStream_Interrupted(t *testing.T) {
+	// A stream cut before its usage chunk leaves the counted tokens to settle
+	interrupted := strings.SplitAfter(upstreamStream, "\n\n")[0] + "data: {not json"
+	budget := services.NewOutputBudget("gpt-4o", 100)
+	result := relayStream(httptest.NewRecorder(), strings.NewReader(interrupted), budget, false, false)
+	assert.Error(t, result.Err)
+	assert.Nil(t, result.Usage)
+	assert.Positive(t, budget.Used())
+}
+
+func TestRelayStream_QuotaExceeded(t *testing.T) {
+	// The budget holds the first chunk but not the second
+	hello, _ := tokenizer.Count("gpt-4o", "Hello")
+	budget := services.NewOutputBudget("gpt-4o", hello)
+	w := httptest.NewRecorder()
+	result := relayStream(w, strings.NewReader(upstreamStream), budget, true, true)
+	require.NoError(t, result.Err)
+	assert.Nil(t, result.Usage)
+	assert.Greater(t, budget.Used(), hello)
+
+	// The chunk past the budget is dropped and the choice finishes with the
+	// quota, ending the stream before the usage chunk
+	events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	require.Len(t, events, 3)
+	assert.Contains(t, events[0], `"content":"Hello"`)
+	assert.JSONEq(t, `{"id":"1","object":"chat.completion.chunk","created":1,"model":"gpt-4o","choices":[{"index":0,"delta":{},"finish_reason":"quota_exceeded"}]}`, strings.TrimPrefix(events[1], "data: "))
+	assert.Equal(t, "data: [DONE]", events[2])
+	assert.NotContains(t, w.Body.String(), "world")
+}
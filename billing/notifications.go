@@ -0,0 +1,124 @@
+package billing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/notify"
+	"github.com/vhybZApp/api/services"
+)
+
+// NotificationSettings represents where quota alerts are delivered
+// @Description Quota alert delivery settings. Webhooks are signed with the secret, see the X-Vhybz-Signature header.
+type NotificationSettings struct {
+	WebhookURL    string `json:"webhook_url"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+	EmailEnabled  bool   `json:"email_enabled"`
+	// Thresholds are percentages of any quota window, empty for the defaults
+	Thresholds []int `json:"thresholds"`
+}
+
+// UpdateNotificationSettingsRequest represents the request body for updating notification settings
+type UpdateNotificationSettingsRequest struct {
+	// WebhookURL must be https and resolve to public addresses only
+	WebhookURL string `json:"webhook_url"`
+	// WebhookSecret signs webhook deliveries, generated when empty
+	WebhookSecret string `json:"webhook_secret"`
+	EmailEnabled  bool   `json:"email_enabled"`
+	Thresholds    []int  `json:"thresholds" binding:"dive,min=1,max=100"`
+}
+
+func newNotificationSettings(settings *database.DBNotificationSettings) NotificationSettings {
+	return NotificationSettings{
+		WebhookURL:    settings.WebhookURL,
+		WebhookSecret: settings.WebhookSecret,
+		EmailEnabled:  settings.EmailEnabled,
+		Thresholds:    services.Thresholds(settings),
+	}
+}
+
+// GetNotificationSettings godoc
+// @Summary Get notification settings
+// @Description Get where the authenticated user's quota alerts are delivered
+// @Tags billing
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} NotificationSettings
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /notifications [get]
+func GetNotificationSettings(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	settings, err := services.NewAlertService(database.GetDB()).GetSettings(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading notification settings"))
+		return
+	}
+	if settings == nil {
+		settings = &database.DBNotificationSettings{UserID: userID}
+	}
+
+	c.JSON(http.StatusOK, newNotificationSettings(settings))
+}
+
+// UpdateNotificationSettings godoc
+// @Summary Update notification settings
+// @Description Set where the authenticated user's quota alerts are delivered. Each threshold fires at most once per quota window.
+// @Tags billing
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body UpdateNotificationSettingsRequest true "Notification settings"
+// @Success 200 {object} NotificationSettings
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /notifications [put]
+func UpdateNotificationSettings(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+
+	var req UpdateNotificationSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if req.WebhookURL != "" {
+		if err := notify.ValidateWebhookURL(c.Request.Context(), req.WebhookURL); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid webhook URL: "+err.Error()))
+			return
+		}
+		if req.WebhookSecret == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error generating webhook secret"))
+				return
+			}
+			req.WebhookSecret = hex.EncodeToString(secret)
+		}
+	}
+
+	thresholds := make([]string, 0, len(req.Thresholds))
+	for _, threshold := range req.Thresholds {
+		thresholds = append(thresholds, strconv.Itoa(threshold))
+	}
+	settings := database.DBNotificationSettings{
+		UserID:        userID,
+		WebhookURL:    req.WebhookURL,
+		WebhookSecret: req.WebhookSecret,
+		EmailEnabled:  req.EmailEnabled,
+		Thresholds:    strings.Join(thresholds, ","),
+	}
+	if err := services.NewAlertService(database.GetDB()).SaveSettings(&settings); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error saving notification settings"))
+		return
+	}
+
+	c.JSON(http.StatusOK, newNotificationSettings(&settings))
+}
@@ -0,0 +1,200 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// Organization represents an organization grouping users
+type Organization struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Timezone string `json:"timezone"`
+}
+
+// CreateOrganizationRequest represents the request body for creating an organization
+type CreateOrganizationRequest struct {
+	Name string `json:"name" binding:"required"`
+	// Timezone is the IANA timezone of its members' quota windows, empty for the default
+	Timezone string `json:"timezone"`
+}
+
+// OrganizationTimezoneRequest represents the request body for setting an organization's timezone
+type OrganizationTimezoneRequest struct {
+	// Timezone is an IANA timezone name such as "Asia/Tokyo", empty for the default
+	Timezone string `json:"timezone"`
+}
+
+// UserOrganizationRequest represents the request body for moving a user into an organization
+type UserOrganizationRequest struct {
+	// OrganizationID is the organization to join, null to leave the current one
+	OrganizationID *string `json:"organization_id"`
+}
+
+func newOrganization(organization database.DBOrganization) Organization {
+	return Organization{ID: organization.ID.String(), Name: organization.Name, Timezone: organization.Timezone}
+}
+
+// ListOrganizations godoc
+// @Summary List organizations
+// @Description List every organization
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} Organization
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/organizations [get]
+func ListOrganizations(c *gin.Context) {
+	organizations, err := services.NewOrganizationService(database.GetDB()).ListOrganizations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing organizations"))
+		return
+	}
+
+	resp := make([]Organization, 0, len(organizations))
+	for _, organization := range organizations {
+		resp = append(resp, newOrganization(organization))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateOrganization godoc
+// @Summary Create an organization
+// @Description Create an organization whose wallet pays for its members' calls
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body CreateOrganizationRequest true "Organization"
+// @Success 201 {object} Organization
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/organizations [post]
+func CreateOrganization(c *gin.Context) {
+	var req CreateOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	if req.Timezone != "" {
+		if _, err := services.LoadTimezone(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid timezone"))
+			return
+		}
+	}
+
+	organization, err := services.NewOrganizationService(database.GetDB()).CreateOrganization(req.Name, req.Timezone)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error creating organization"))
+		return
+	}
+	c.JSON(http.StatusCreated, newOrganization(*organization))
+}
+
+// SetOrganizationTimezone godoc
+// @Summary Set an organization's timezone
+// @Description Set the timezone deciding when the daily quotas of the organization's members reset. Members' own timezones take precedence.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "Organization ID"
+// @Param request body OrganizationTimezoneRequest true "Timezone"
+// @Success 200 {object} Organization
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/organizations/{id}/timezone [put]
+func SetOrganizationTimezone(c *gin.Context) {
+	organizationID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid organization ID"))
+		return
+	}
+
+	var req OrganizationTimezoneRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if req.Timezone != "" {
+		if _, err := services.LoadTimezone(req.Timezone); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid timezone"))
+			return
+		}
+	}
+
+	organization, err := services.NewOrganizationService(database.GetDB()).SetOrganizationTimezone(organizationID, req.Timezone)
+	if err != nil {
+		if errors.Is(err, services.ErrOrganizationNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error setting timezone"))
+		return
+	}
+	c.JSON(http.StatusOK, newOrganization(*organization))
+}
+
+// SetUserOrganization godoc
+// @Summary Set a user's organization
+// @Description Move a user into an organization, or out of their organization when organization_id is null
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Param request body UserOrganizationRequest true "Organization membership"
+// @Success 204
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/users/{id}/organization [put]
+func SetUserOrganization(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid user ID"))
+		return
+	}
+
+	var req UserOrganizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	var organizationID *uuid.UUID
+	if req.OrganizationID != nil {
+		id, err := uuid.Parse(*req.OrganizationID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid organization ID"))
+			return
+		}
+		organizationID = &id
+	}
+
+	if err := services.NewOrganizationService(database.GetDB()).SetUserOrganization(userID, organizationID); err != nil {
+		if errors.Is(err, services.ErrOrganizationNotFound) || errors.Is(err, services.ErrUserNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error setting organization"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
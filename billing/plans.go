@@ -0,0 +1,345 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// Plan represents a subscription plan
+// @Description Subscription plan bundling quota limits, models and features. Zero limits mean unlimited.
+type Plan struct {
+	Name              string   `json:"name"`
+	IsDefault         bool     `json:"is_default"`
+	DailyQuota        int      `json:"daily_quota" binding:"min=0"`
+	MonthlyQuota      int      `json:"monthly_quota" binding:"min=0"`
+	DailyCostBudget   int64    `json:"daily_cost_budget" binding:"min=0"`
+	MonthlyCostBudget int64    `json:"monthly_cost_budget" binding:"min=0"`
+	AllowedModels     []string `json:"allowed_models"`
+	Features          []string `json:"features"`
+}
+
+// Limits represents the effective limits of the authenticated user
+// @Description Effective quota limits, zero means unlimited. Cost budgets are in micro-dollars.
+type Limits struct {
+	Plan              string   `json:"plan"`
+	DailyQuota        int      `json:"daily_quota"`
+	MonthlyQuota      int      `json:"monthly_quota"`
+	DailyCostBudget   int64    `json:"daily_cost_budget"`
+	MonthlyCostBudget int64    `json:"monthly_cost_budget"`
+	AllowedModels     []string `json:"allowed_models"`
+	Features          []string `json:"features"`
+}
+
+// AssignPlanRequest represents the request body for assigning a plan to a user
+type AssignPlanRequest struct {
+	Plan     string     `json:"plan" binding:"required"`
+	StartsAt *time.Time `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at"`
+}
+
+// UserPlan represents the assignment of a plan to a user
+type UserPlan struct {
+	UserID   string     `json:"user_id"`
+	Plan     string     `json:"plan"`
+	StartsAt time.Time  `json:"starts_at"`
+	EndsAt   *time.Time `json:"ends_at,omitempty"`
+}
+
+// QuotaOverride represents a user-level quota override. Omitted limits are
+// inherited from the user's plan, zero means unlimited.
+type QuotaOverride struct {
+	DailyQuota        *int   `json:"daily_quota,omitempty" binding:"omitempty,min=0"`
+	MonthlyQuota      *int   `json:"monthly_quota,omitempty" binding:"omitempty,min=0"`
+	DailyCostBudget   *int64 `json:"daily_cost_budget,omitempty" binding:"omitempty,min=0"`
+	MonthlyCostBudget *int64 `json:"monthly_cost_budget,omitempty" binding:"omitempty,min=0"`
+	// AllowedModels replaces the plan's model patterns, empty allows every model
+	AllowedModels *[]string `json:"allowed_models,omitempty"`
+}
+
+// GrantBoostRequest represents the request body for temporarily raising a user's daily quota
+type GrantBoostRequest struct {
+	DailyTokens int       `json:"daily_tokens" binding:"required,gt=0"`
+	ExpiresAt   time.Time `json:"expires_at" binding:"required"`
+	Reason      string    `json:"reason"`
+}
+
+// QuotaBoost represents extra daily tokens temporarily granted to a user
+type QuotaBoost struct {
+	UserID      string    `json:"user_id"`
+	DailyTokens int       `json:"daily_tokens"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+func newPlan(plan database.DBPlan) Plan {
+	return Plan{
+		Name:              plan.Name,
+		IsDefault:         plan.IsDefault,
+		DailyQuota:        plan.DailyQuota,
+		MonthlyQuota:      plan.MonthlyQuota,
+		DailyCostBudget:   plan.DailyCostBudget,
+		MonthlyCostBudget: plan.MonthlyCostBudget,
+		AllowedModels:     splitList(plan.AllowedModels),
+		Features:          splitList(plan.Features),
+	}
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// GetLimits godoc
+// @Summary Get quota limits
+// @Description Get the plan and effective quota limits of the authenticated user
+// @Tags billing
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} Limits
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /plan [get]
+func GetLimits(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	limits, err := services.NewTokenQuotaService(database.GetDB()).GetLimits(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading quota limits"))
+		return
+	}
+
+	c.JSON(http.StatusOK, Limits{
+		Plan:              limits.Plan,
+		DailyQuota:        limits.DailyQuota,
+		MonthlyQuota:      limits.MonthlyQuota,
+		DailyCostBudget:   limits.DailyCostBudget,
+		MonthlyCostBudget: limits.MonthlyCostBudget,
+		AllowedModels:     append([]string{}, limits.AllowedModels...),
+		Features:          append([]string{}, limits.Features...),
+	})
+}
+
+// ListPlans godoc
+// @Summary List plans
+// @Description List every subscription plan
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} Plan
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/plans [get]
+func ListPlans(c *gin.Context) {
+	plans, err := services.NewPlanService(database.GetDB()).ListPlans()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing plans"))
+		return
+	}
+
+	resp := make([]Plan, 0, len(plans))
+	for _, plan := range plans {
+		resp = append(resp, newPlan(plan))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SavePlan godoc
+// @Summary Create or update a plan
+// @Description Create a custom plan or update an existing one by name
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param name path string true "Plan name"
+// @Param plan body Plan true "Plan limits, models and features"
+// @Success 200 {object} Plan
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/plans/{name} [put]
+func SavePlan(c *gin.Context) {
+	var req Plan
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	plan := database.DBPlan{
+		Name:              c.Param("name"),
+		IsDefault:         req.IsDefault,
+		DailyQuota:        req.DailyQuota,
+		MonthlyQuota:      req.MonthlyQuota,
+		DailyCostBudget:   req.DailyCostBudget,
+		MonthlyCostBudget: req.MonthlyCostBudget,
+		AllowedModels:     strings.Join(req.AllowedModels, ","),
+		Features:          strings.Join(req.Features, ","),
+	}
+	if err := services.NewPlanService(database.GetDB()).SavePlan(&plan); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error saving plan"))
+		return
+	}
+
+	c.JSON(http.StatusOK, newPlan(plan))
+}
+
+// AssignPlan godoc
+// @Summary Assign a plan to a user
+// @Description Assign a plan to a user from starts_at (default now) until ends_at (default never). Once it ends the user reverts to the default plan.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Param request body AssignPlanRequest true "Plan assignment"
+// @Success 200 {object} UserPlan
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/users/{id}/plan [put]
+func AssignPlan(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid user ID"))
+		return
+	}
+
+	var req AssignPlanRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	startsAt := time.Now()
+	if req.StartsAt != nil {
+		startsAt = *req.StartsAt
+	}
+	if req.EndsAt != nil && !req.EndsAt.After(startsAt) {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("ends_at must be after starts_at"))
+		return
+	}
+
+	assignment, err := services.NewPlanService(database.GetDB()).AssignPlan(userID, req.Plan, startsAt, req.EndsAt)
+	if err != nil {
+		if errors.Is(err, services.ErrPlanNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error assigning plan"))
+		return
+	}
+
+	c.JSON(http.StatusOK, UserPlan{
+		UserID:   userID.String(),
+		Plan:     assignment.Plan.Name,
+		StartsAt: assignment.StartsAt,
+		EndsAt:   assignment.EndsAt,
+	})
+}
+
+// SetUserQuota godoc
+// @Summary Set a user's quota override
+// @Description Override some or all of the plan limits of a user. Omitted limits are inherited from the plan.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Param request body QuotaOverride true "Quota override"
+// @Success 200 {object} QuotaOverride
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/users/{id}/quota [put]
+func SetUserQuota(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid user ID"))
+		return
+	}
+
+	var req QuotaOverride
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	quota := database.DBTokenQuota{
+		UserID:            userID,
+		DailyQuota:        req.DailyQuota,
+		MonthlyQuota:      req.MonthlyQuota,
+		DailyCostBudget:   req.DailyCostBudget,
+		MonthlyCostBudget: req.MonthlyCostBudget,
+	}
+	if req.AllowedModels != nil {
+		allowedModels := strings.Join(*req.AllowedModels, ",")
+		quota.AllowedModels = &allowedModels
+	}
+	if err := services.NewTokenQuotaService(database.GetDB()).SetUserQuota(&quota); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error saving quota override"))
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+// GrantBoost godoc
+// @Summary Grant a temporary quota boost
+// @Description Temporarily add daily tokens to a user's quota until expires_at. Boosts do not apply to unlimited daily quotas.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path string true "User ID"
+// @Param request body GrantBoostRequest true "Quota boost"
+// @Success 201 {object} QuotaBoost
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/users/{id}/boosts [post]
+func GrantBoost(c *gin.Context) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid user ID"))
+		return
+	}
+
+	var req GrantBoostRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("expires_at must be in the future"))
+		return
+	}
+
+	boost, err := services.NewTokenQuotaService(database.GetDB()).GrantBoost(userID, req.DailyTokens, req.ExpiresAt, req.Reason)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error granting boost"))
+		return
+	}
+	c.JSON(http.StatusCreated, QuotaBoost{
+		UserID:      userID.String(),
+		DailyTokens: boost.DailyTokens,
+		ExpiresAt:   boost.ExpiresAt,
+		Reason:      boost.Reason,
+	})
+}
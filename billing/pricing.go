@@ -0,0 +1,101 @@
+package billing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// ModelPrice represents the price of a provider model
+// @Description Price of a provider model in micro-dollars per million tokens
+type ModelPrice struct {
+	Provider      string    `json:"provider"`
+	Model         string    `json:"model"`
+	InputPrice    int64     `json:"input_price"`
+	OutputPrice   int64     `json:"output_price"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// SetPriceRequest represents the request body for adding a model price
+type SetPriceRequest struct {
+	Provider      string     `json:"provider" binding:"required"`
+	Model         string     `json:"model" binding:"required"`
+	InputPrice    int64      `json:"input_price" binding:"min=0"`
+	OutputPrice   int64      `json:"output_price" binding:"min=0"`
+	EffectiveFrom *time.Time `json:"effective_from"`
+}
+
+func newModelPrice(price database.DBModelPrice) ModelPrice {
+	return ModelPrice{
+		Provider:      price.Provider,
+		Model:         price.ModelName,
+		InputPrice:    price.InputPrice,
+		OutputPrice:   price.OutputPrice,
+		EffectiveFrom: price.EffectiveFrom,
+	}
+}
+
+// ListPrices godoc
+// @Summary List model prices
+// @Description List the prices currently in effect for every provider model
+// @Tags billing
+// @Produce json
+// @Success 200 {array} ModelPrice
+// @Failure 500 {object} models.ErrorResponse
+// @Router /pricing [get]
+func ListPrices(c *gin.Context) {
+	prices, err := services.NewPricingService(database.GetDB()).ListPrices(time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing prices"))
+		return
+	}
+
+	resp := make([]ModelPrice, 0, len(prices))
+	for _, price := range prices {
+		resp = append(resp, newModelPrice(price))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// SetPrice godoc
+// @Summary Add a model price
+// @Description Add a price for a provider model, effective from effective_from (default now). Prices are in micro-dollars per million tokens.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body SetPriceRequest true "Model price"
+// @Success 201 {object} ModelPrice
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/pricing [post]
+func SetPrice(c *gin.Context) {
+	var req SetPriceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	price := database.DBModelPrice{
+		Provider:      req.Provider,
+		ModelName:     req.Model,
+		InputPrice:    req.InputPrice,
+		OutputPrice:   req.OutputPrice,
+		EffectiveFrom: time.Now(),
+	}
+	if req.EffectiveFrom != nil {
+		price.EffectiveFrom = *req.EffectiveFrom
+	}
+	if err := services.NewPricingService(database.GetDB()).SetPrice(&price); err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error saving price"))
+		return
+	}
+
+	c.JSON(http.StatusCreated, newModelPrice(price))
+}
@@ -0,0 +1,207 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// QuotaRule represents a quota bucket for the calls matching a provider,
+// model pattern and endpoint
+// @Description Quota bucket replacing the plan's token quotas for matching calls. The most specific matching rule wins: user rules over plan rules over rules for everyone, then endpoint, model and provider matchers. Empty matchers match anything and zero limits mean unlimited.
+type QuotaRule struct {
+	ID            uint   `json:"id"`
+	UserID        string `json:"user_id,omitempty"`
+	Plan          string `json:"plan,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	Model         string `json:"model,omitempty" example:"gpt-4o*"`
+	Endpoint      string `json:"endpoint,omitempty" enums:"chat-completions,embeddings,make-html"`
+	DailyTokens   int    `json:"daily_tokens" binding:"min=0"`
+	MonthlyTokens int    `json:"monthly_tokens" binding:"min=0"`
+	DailyRequests int    `json:"daily_requests" binding:"min=0"`
+}
+
+func newQuotaRule(rule *database.DBQuotaRule) QuotaRule {
+	resp := QuotaRule{
+		ID:            rule.ID,
+		Provider:      rule.Provider,
+		Model:         rule.ModelPattern,
+		Endpoint:      rule.Endpoint,
+		DailyTokens:   rule.DailyTokens,
+		MonthlyTokens: rule.MonthlyTokens,
+		DailyRequests: rule.DailyRequests,
+	}
+	if rule.UserID != nil {
+		resp.UserID = rule.UserID.String()
+	}
+	if rule.Plan != nil {
+		resp.Plan = rule.Plan.Name
+	}
+	return resp
+}
+
+// quotaRuleID parses the id path parameter of the quota rule routes
+func quotaRuleID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid quota rule ID"))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// saveQuotaRule binds a quota rule from the request body and saves it under
+// the given ID, zero creating a new rule
+func saveQuotaRule(c *gin.Context, id uint, status int) {
+	var req QuotaRule
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	rule := database.DBQuotaRule{
+		Provider:      req.Provider,
+		ModelPattern:  req.Model,
+		Endpoint:      req.Endpoint,
+		DailyTokens:   req.DailyTokens,
+		MonthlyTokens: req.MonthlyTokens,
+		DailyRequests: req.DailyRequests,
+	}
+	rule.ID = id
+	if req.UserID != "" {
+		userID, err := uuid.Parse(req.UserID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid user ID"))
+			return
+		}
+		rule.UserID = &userID
+	}
+	if req.Plan != "" {
+		plan, err := services.NewPlanService(database.GetDB()).GetPlan(req.Plan)
+		if err != nil {
+			if errors.Is(err, services.ErrPlanNotFound) {
+				c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+				return
+			}
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading plan"))
+			return
+		}
+		rule.PlanID = &plan.ID
+	}
+
+	if err := services.NewQuotaRuleService(database.GetDB()).SaveRule(&rule); err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidQuotaRule):
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		case errors.Is(err, services.ErrQuotaRuleNotFound):
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+		default:
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error saving quota rule"))
+		}
+		return
+	}
+	c.JSON(status, newQuotaRule(&rule))
+}
+
+// ListQuotaRules godoc
+// @Summary List quota rules
+// @Description List every per-model and per-endpoint quota rule
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} QuotaRule
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/quota-rules [get]
+func ListQuotaRules(c *gin.Context) {
+	rules, err := services.NewQuotaRuleService(database.GetDB()).ListRules()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing quota rules"))
+		return
+	}
+
+	resp := make([]QuotaRule, 0, len(rules))
+	for i := range rules {
+		resp = append(resp, newQuotaRule(&rules[i]))
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// CreateQuotaRule godoc
+// @Summary Create a quota rule
+// @Description Create a quota bucket for the calls of a user, of a plan's users or of everyone matching a provider, model pattern and endpoint
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body QuotaRule true "Quota rule"
+// @Success 201 {object} QuotaRule
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/quota-rules [post]
+func CreateQuotaRule(c *gin.Context) {
+	saveQuotaRule(c, 0, http.StatusCreated)
+}
+
+// UpdateQuotaRule godoc
+// @Summary Update a quota rule
+// @Description Replace a quota rule
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Quota rule ID"
+// @Param request body QuotaRule true "Quota rule"
+// @Success 200 {object} QuotaRule
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/quota-rules/{id} [put]
+func UpdateQuotaRule(c *gin.Context) {
+	id, ok := quotaRuleID(c)
+	if !ok {
+		return
+	}
+	saveQuotaRule(c, id, http.StatusOK)
+}
+
+// DeleteQuotaRule godoc
+// @Summary Delete a quota rule
+// @Description Delete a quota rule, matching calls fall back to the next most specific rule or to the plan's token quotas
+// @Tags admin
+// @Security BearerAuth
+// @Param id path int true "Quota rule ID"
+// @Success 204
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/quota-rules/{id} [delete]
+func DeleteQuotaRule(c *gin.Context) {
+	id, ok := quotaRuleID(c)
+	if !ok {
+		return
+	}
+
+	if err := services.NewQuotaRuleService(database.GetDB()).DeleteRule(id); err != nil {
+		if errors.Is(err, services.ErrQuotaRuleNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error deleting quota rule"))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
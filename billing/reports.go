@@ -0,0 +1,307 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// Date layouts of the report query parameters
+const (
+	dateLayout  = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+// UsageStatement represents the usage of every owner over a date range
+// @Description Usage grouped by owner, provider and model. Costs are in micro-dollars.
+type UsageStatement struct {
+	From        string                   `json:"from"`
+	To          string                   `json:"to"`
+	GroupBy     string                   `json:"group_by"`
+	Tags        map[string]string        `json:"tags,omitempty"`
+	Lines       []services.StatementLine `json:"lines"`
+	TotalTokens int                      `json:"total_tokens"`
+	TotalCost   int64                    `json:"total_cost"`
+}
+
+// Invoice represents the usage billed to a user or organization for a month
+// @Description Monthly invoice, immutable once closed. Costs are in micro-dollars.
+type Invoice struct {
+	ID          uint          `json:"id"`
+	OwnerType   string        `json:"owner_type"`
+	OwnerID     string        `json:"owner_id"`
+	Month       string        `json:"month"`
+	Status      string        `json:"status"`
+	ClosedAt    *time.Time    `json:"closed_at,omitempty"`
+	Requests    int           `json:"requests"`
+	TotalTokens int           `json:"total_tokens"`
+	Cost        int64         `json:"cost"`
+	Lines       []InvoiceLine `json:"lines,omitempty"`
+}
+
+// InvoiceLine represents the usage of one user, provider and model on an invoice
+type InvoiceLine struct {
+	UserID           string `json:"user_id"`
+	Username         string `json:"username"`
+	Provider         string `json:"provider"`
+	Model            string `json:"model"`
+	Requests         int    `json:"requests"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	TotalTokens      int    `json:"total_tokens"`
+	Cost             int64  `json:"cost"`
+}
+
+func newInvoice(invoice *database.DBInvoice) Invoice {
+	resp := Invoice{
+		ID:          invoice.ID,
+		OwnerType:   invoice.OwnerType,
+		OwnerID:     invoice.OwnerID.String(),
+		Month:       invoice.Month.Format(monthLayout),
+		Status:      invoice.Status,
+		ClosedAt:    invoice.ClosedAt,
+		Requests:    invoice.Requests,
+		TotalTokens: invoice.TotalTokens,
+		Cost:        invoice.Cost,
+	}
+	for _, line := range invoice.Lines {
+		resp.Lines = append(resp.Lines, InvoiceLine{
+			UserID:           line.UserID.String(),
+			Username:         line.Username,
+			Provider:         line.Provider,
+			Model:            line.ModelName,
+			Requests:         line.Requests,
+			PromptTokens:     line.PromptTokens,
+			CompletionTokens: line.CompletionTokens,
+			TotalTokens:      line.TotalTokens,
+			Cost:             line.Cost,
+		})
+	}
+	return resp
+}
+
+func newInvoices(invoices []database.DBInvoice) []Invoice {
+	resp := make([]Invoice, 0, len(invoices))
+	for i := range invoices {
+		resp = append(resp, newInvoice(&invoices[i]))
+	}
+	return resp
+}
+
+// invoiceMonth parses the month query parameter of the invoice routes
+func invoiceMonth(c *gin.Context) (time.Time, bool) {
+	month, err := time.Parse(monthLayout, c.Query("month"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Month must be formatted as YYYY-MM"))
+		return time.Time{}, false
+	}
+	return month, true
+}
+
+// invoiceID parses the id path parameter of the invoice routes
+func invoiceID(c *gin.Context) (uint, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid invoice ID"))
+		return 0, false
+	}
+	return uint(id), true
+}
+
+// GetUsageReport godoc
+// @Summary Usage report
+// @Description Report the usage of a date range (UTC, both days included) grouped by user or organization, provider and model, as JSON or CSV. Tag filters only count the calls carrying all the given tags.
+// @Tags admin
+// @Produce json
+// @Produce text/csv
+// @Security BearerAuth
+// @Param from query string true "First day, YYYY-MM-DD"
+// @Param to query string true "Last day, YYYY-MM-DD"
+// @Param group_by query string false "Grouping (default user)" Enums(user, organization)
+// @Param format query string false "Output format (default json)" Enums(json, csv)
+// @Param tag query []string false "Cost attribution tag filter, key=value" collectionFormat(multi)
+// @Success 200 {object} UsageStatement
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/reports/usage [get]
+func GetUsageReport(c *gin.Context) {
+	from, errFrom := time.Parse(dateLayout, c.Query("from"))
+	to, errTo := time.Parse(dateLayout, c.Query("to"))
+	if errFrom != nil || errTo != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("From and to must be formatted as YYYY-MM-DD"))
+		return
+	}
+	if to.Before(from) {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("To must not be before from"))
+		return
+	}
+	groupBy := c.DefaultQuery("group_by", database.WalletOwnerUser)
+	if groupBy != database.WalletOwnerUser && groupBy != database.WalletOwnerOrganization {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Group by must be user or organization"))
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Format must be json or csv"))
+		return
+	}
+
+	tags, err := services.ParseUsageTags(c.QueryArray("tag"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	lines, err := services.NewReportService(database.GetDB()).UsageStatement(from, to.AddDate(0, 0, 1), groupBy, tags)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error building usage report"))
+		return
+	}
+
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", "attachment; filename=usage-"+c.Query("from")+"-"+c.Query("to")+".csv")
+		c.Status(http.StatusOK)
+		if err := services.WriteStatementCSV(c.Writer, lines); err != nil {
+			c.Error(err)
+		}
+		return
+	}
+
+	statement := UsageStatement{From: c.Query("from"), To: c.Query("to"), GroupBy: groupBy, Tags: tags, Lines: lines}
+	for _, line := range lines {
+		statement.TotalTokens += line.TotalTokens
+		statement.TotalCost += line.Cost
+	}
+	c.JSON(http.StatusOK, statement)
+}
+
+// GenerateInvoices godoc
+// @Summary Generate monthly invoices
+// @Description Snapshot the usage of a month (UTC) into an invoice per organization, or per user for users without one. Open invoices are recomputed, closed invoices are left untouched.
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param month query string true "Month, YYYY-MM"
+// @Success 200 {array} Invoice
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/invoices [post]
+func GenerateInvoices(c *gin.Context) {
+	month, ok := invoiceMonth(c)
+	if !ok {
+		return
+	}
+
+	invoices, err := services.NewReportService(database.GetDB()).GenerateInvoices(month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error generating invoices"))
+		return
+	}
+	c.JSON(http.StatusOK, newInvoices(invoices))
+}
+
+// ListInvoices godoc
+// @Summary List monthly invoices
+// @Description List the invoices of a month without their lines
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param month query string true "Month, YYYY-MM"
+// @Success 200 {array} Invoice
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/invoices [get]
+func ListInvoices(c *gin.Context) {
+	month, ok := invoiceMonth(c)
+	if !ok {
+		return
+	}
+
+	invoices, err := services.NewReportService(database.GetDB()).ListInvoices(month)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing invoices"))
+		return
+	}
+	c.JSON(http.StatusOK, newInvoices(invoices))
+}
+
+// GetInvoice godoc
+// @Summary Get an invoice
+// @Description Get an invoice with a line per user, provider and model
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invoice ID"
+// @Success 200 {object} Invoice
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/invoices/{id} [get]
+func GetInvoice(c *gin.Context) {
+	id, ok := invoiceID(c)
+	if !ok {
+		return
+	}
+
+	invoice, err := services.NewReportService(database.GetDB()).GetInvoice(id)
+	if err != nil {
+		if errors.Is(err, services.ErrInvoiceNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading invoice"))
+		return
+	}
+	c.JSON(http.StatusOK, newInvoice(invoice))
+}
+
+// CloseInvoice godoc
+// @Summary Close an invoice
+// @Description Close the invoice of a month that has ended, after which it can no longer change
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Invoice ID"
+// @Success 200 {object} Invoice
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 409 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/invoices/{id}/close [post]
+func CloseInvoice(c *gin.Context) {
+	id, ok := invoiceID(c)
+	if !ok {
+		return
+	}
+
+	invoice, err := services.NewReportService(database.GetDB()).CloseInvoice(id, time.Now())
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvoiceNotFound):
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+		case errors.Is(err, services.ErrInvoiceClosed), errors.Is(err, services.ErrInvoiceMonthNotOver):
+			c.JSON(http.StatusConflict, models.NewErrorResponse(err.Error()))
+		default:
+			c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error closing invoice"))
+		}
+		return
+	}
+	c.JSON(http.StatusOK, newInvoice(invoice))
+}
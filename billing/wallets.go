@@ -0,0 +1,272 @@
+package billing
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/models"
+	"github.com/vhybZApp/api/services"
+)
+
+// Wallet represents a prepaid credit balance
+// @Description Prepaid credit balance in micro-dollars
+type Wallet struct {
+	OwnerType      string `json:"owner_type"`
+	OwnerID        string `json:"owner_id"`
+	Balance        int64  `json:"balance"`
+	OverdraftLimit int64  `json:"overdraft_limit"`
+	// Held is set aside for calls in flight until they are settled
+	Held int64 `json:"held"`
+}
+
+// WalletTransaction represents an entry in a wallet's transaction log
+// @Description Wallet transaction, negative amounts are debits
+type WalletTransaction struct {
+	ID           uint      `json:"id"`
+	Amount       int64     `json:"amount"`
+	BalanceAfter int64     `json:"balance_after"`
+	Reason       string    `json:"reason"`
+	Reference    string    `json:"reference,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TopUpRequest represents the request body for crediting a wallet
+type TopUpRequest struct {
+	Amount    int64  `json:"amount" binding:"required,gt=0"`
+	Reason    string `json:"reason"`
+	Reference string `json:"reference"`
+}
+
+// OverdraftRequest represents the request body for setting a wallet's overdraft limit
+type OverdraftRequest struct {
+	OverdraftLimit int64 `json:"overdraft_limit" binding:"min=0"`
+}
+
+func newWallet(wallet *database.DBWallet) Wallet {
+	return Wallet{
+		OwnerType:      wallet.OwnerType,
+		OwnerID:        wallet.OwnerID.String(),
+		Balance:        wallet.Balance,
+		OverdraftLimit: wallet.OverdraftLimit,
+		Held:           wallet.Held,
+	}
+}
+
+func newWalletTransactions(entries []database.DBWalletTransaction) []WalletTransaction {
+	resp := make([]WalletTransaction, 0, len(entries))
+	for _, entry := range entries {
+		resp = append(resp, WalletTransaction{
+			ID:           entry.ID,
+			Amount:       entry.Amount,
+			BalanceAfter: entry.BalanceAfter,
+			Reason:       entry.Reason,
+			Reference:    entry.Reference,
+			CreatedAt:    entry.CreatedAt,
+		})
+	}
+	return resp
+}
+
+// walletOwner parses the owner path parameters of the admin wallet routes
+func walletOwner(c *gin.Context) (string, uuid.UUID, bool) {
+	ownerType := c.Param("owner_type")
+	if ownerType != database.WalletOwnerUser && ownerType != database.WalletOwnerOrganization {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Owner type must be user or organization"))
+		return "", uuid.Nil, false
+	}
+	ownerID, err := uuid.Parse(c.Param("owner_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Invalid owner ID"))
+		return "", uuid.Nil, false
+	}
+	return ownerType, ownerID, true
+}
+
+// transactionLimit parses the limit query parameter of transaction listings
+func transactionLimit(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		return 50
+	}
+	return limit
+}
+
+// GetWallet godoc
+// @Summary Get wallet
+// @Description Get the prepaid wallet paying for the authenticated user's calls
+// @Tags billing
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} Wallet
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /wallet [get]
+func GetWallet(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	wallet, err := services.NewWalletService(database.GetDB()).WalletForUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading wallet"))
+		return
+	}
+	if wallet == nil {
+		c.JSON(http.StatusNotFound, models.NewErrorResponse(services.ErrWalletNotFound.Error()))
+		return
+	}
+
+	c.JSON(http.StatusOK, newWallet(wallet))
+}
+
+// ListWalletTransactions godoc
+// @Summary List wallet transactions
+// @Description List the most recent transactions of the wallet paying for the authenticated user's calls
+// @Tags billing
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "Maximum number of transactions (default 50)"
+// @Success 200 {array} WalletTransaction
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /wallet/transactions [get]
+func ListWalletTransactions(c *gin.Context) {
+	userID := c.MustGet("user_id").(uuid.UUID)
+	walletService := services.NewWalletService(database.GetDB())
+	wallet, err := walletService.WalletForUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading wallet"))
+		return
+	}
+	if wallet == nil {
+		c.JSON(http.StatusNotFound, models.NewErrorResponse(services.ErrWalletNotFound.Error()))
+		return
+	}
+
+	entries, err := walletService.ListTransactions(wallet.ID, transactionLimit(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing transactions"))
+		return
+	}
+	c.JSON(http.StatusOK, newWalletTransactions(entries))
+}
+
+// TopUpWallet godoc
+// @Summary Top up a wallet
+// @Description Credit the wallet of a user or organization, creating it if needed. Amounts are in micro-dollars.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param owner_type path string true "Owner type" Enums(user, organization)
+// @Param owner_id path string true "User or organization ID"
+// @Param request body TopUpRequest true "Top-up"
+// @Success 201 {object} WalletTransaction
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/wallets/{owner_type}/{owner_id}/top-ups [post]
+func TopUpWallet(c *gin.Context) {
+	ownerType, ownerID, ok := walletOwner(c)
+	if !ok {
+		return
+	}
+
+	var req TopUpRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if req.Reason == "" {
+		req.Reason = services.WalletReasonTopUp
+	}
+
+	entry, err := services.NewWalletService(database.GetDB()).TopUp(ownerType, ownerID, req.Amount, req.Reason, req.Reference)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error topping up wallet"))
+		return
+	}
+	c.JSON(http.StatusCreated, newWalletTransactions([]database.DBWalletTransaction{*entry})[0])
+}
+
+// SetWalletOverdraft godoc
+// @Summary Set a wallet's overdraft limit
+// @Description Set how far below zero the wallet of a user or organization may go, creating it if needed. Amounts are in micro-dollars.
+// @Tags admin
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param owner_type path string true "Owner type" Enums(user, organization)
+// @Param owner_id path string true "User or organization ID"
+// @Param request body OverdraftRequest true "Overdraft limit"
+// @Success 200 {object} Wallet
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/wallets/{owner_type}/{owner_id}/overdraft [put]
+func SetWalletOverdraft(c *gin.Context) {
+	ownerType, ownerID, ok := walletOwner(c)
+	if !ok {
+		return
+	}
+
+	var req OverdraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+
+	wallet, err := services.NewWalletService(database.GetDB()).SetOverdraftLimit(ownerType, ownerID, req.OverdraftLimit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error setting overdraft limit"))
+		return
+	}
+	c.JSON(http.StatusOK, newWallet(wallet))
+}
+
+// ListOwnerTransactions godoc
+// @Summary List a wallet's transactions
+// @Description List the most recent transactions of the wallet of a user or organization
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Param owner_type path string true "Owner type" Enums(user, organization)
+// @Param owner_id path string true "User or organization ID"
+// @Param limit query int false "Maximum number of transactions (default 50)"
+// @Success 200 {array} WalletTransaction
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Failure 404 {object} models.ErrorResponse
+// @Failure 500 {object} models.ErrorResponse
+// @Router /admin/wallets/{owner_type}/{owner_id}/transactions [get]
+func ListOwnerTransactions(c *gin.Context) {
+	ownerType, ownerID, ok := walletOwner(c)
+	if !ok {
+		return
+	}
+
+	walletService := services.NewWalletService(database.GetDB())
+	wallet, err := walletService.GetWallet(ownerType, ownerID)
+	if err != nil {
+		if errors.Is(err, services.ErrWalletNotFound) {
+			c.JSON(http.StatusNotFound, models.NewErrorResponse(err.Error()))
+			return
+		}
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error loading wallet"))
+		return
+	}
+
+	entries, err := walletService.ListTransactions(wallet.ID, transactionLimit(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, models.NewErrorResponse("Error listing transactions"))
+		return
+	}
+	c.JSON(http.StatusOK, newWalletTransactions(entries))
+}
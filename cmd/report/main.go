@@ -0,0 +1,97 @@
+// Command report writes a usage statement for a date range as CSV or JSON,
+// using the server's configuration and database.
+//
+//	go run ./cmd/report -from 2026-09-01 -to 2026-09-30 -group-by organization -format csv > september.csv
+//	go run ./cmd/report -from 2026-09-01 -to 2026-09-30 -tag feature=search -tag environment=prod
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/services"
+)
+
+func main() {
+	from := flag.String("from", "", "First day of the report, YYYY-MM-DD (UTC)")
+	to := flag.String("to", "", "Last day of the report, YYYY-MM-DD (UTC)")
+	groupBy := flag.String("group-by", database.WalletOwnerUser, "Grouping, user or organization")
+	format := flag.String("format", "csv", "Output format, csv or json")
+	output := flag.String("o", "", "Output file (default stdout)")
+	var tagFilters stringList
+	flag.Var(&tagFilters, "tag", "Only count calls with this key=value cost attribution tag, repeatable")
+	flag.Parse()
+
+	start, err := time.Parse("2006-01-02", *from)
+	if err != nil {
+		log.Fatalf("Invalid -from: %v", err)
+	}
+	end, err := time.Parse("2006-01-02", *to)
+	if err != nil {
+		log.Fatalf("Invalid -to: %v", err)
+	}
+	if end.Before(start) {
+		log.Fatal("-to must not be before -from")
+	}
+	if *format != "csv" && *format != "json" {
+		log.Fatalf("Invalid -format %q, must be csv or json", *format)
+	}
+	tags, err := services.ParseUsageTags(tagFilters)
+	if err != nil {
+		log.Fatalf("Invalid -tag: %v", err)
+	}
+
+	config.LoadConfig()
+	if err := database.Initialize(); err != nil {
+		log.Fatalf("Error initializing database: %v", err)
+	}
+
+	statement, err := services.NewReportService(database.GetDB()).UsageStatement(start, end.AddDate(0, 0, 1), *groupBy, tags)
+	if err != nil {
+		log.Fatalf("Error building usage report: %v", err)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatalf("Error creating %s: %v", *output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if err := write(w, *format, statement); err != nil {
+		log.Fatalf("Error writing usage report: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %d lines\n", len(statement))
+}
+
+func write(w io.Writer, format string, statement []services.StatementLine) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statement)
+	}
+	return services.WriteStatementCSV(w, statement)
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -3,7 +3,11 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/joho/godotenv"
 )
 
@@ -18,6 +22,75 @@ type Config struct {
 	AzureOpenAIDeploymentVersion string
 	// Gemini API Configuration
 	GeminiAPIKey string
+	// AdminUserIDs are the users allowed to call the admin endpoints. Users
+	// are keyed by ID since anyone can register a free username.
+	AdminUserIDs []uuid.UUID
+	// DefaultTimezone is the IANA timezone of quota windows for users without one
+	DefaultTimezone string
+	// Background job schedules, as cron specs
+	RollupSchedule      string
+	PruneSchedule       string
+	BoostExpirySchedule string
+	// UsageRetentionDays is how long raw usage rows are kept before pruning
+	UsageRetentionDays int
+	// QuotaAlertThresholds are the default percentages of a quota window that trigger alerts
+	QuotaAlertThresholds []int
+	// SMTP Configuration for email alerts
+	SMTPHost     string
+	SMTPPort     string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+	// TokenizerDir holds the BPE vocabulary files used to count tokens offline
+	TokenizerDir string
+	// DefaultMaxTokens is the completion length reserved for calls without max_tokens
+	DefaultMaxTokens int
+	// AzureOpenAIDeploymentsFile is a JSON file of the deployments clients may
+	// choose from, replacing the single AZURE_OPENAI_* deployment when set
+	AzureOpenAIDeploymentsFile string
+	// AzureOpenAIEmbeddingDeployment is the embedding deployment of the
+	// AZURE_OPENAI_* resource, used when there is no deployments file
+	AzureOpenAIEmbeddingDeployment string
+	// Largest batch of inputs sent to Azure in an embeddings call, larger
+	// requests are split
+	EmbeddingsMaxBatchInputs int
+	EmbeddingsMaxBatchTokens int
+	// UpstreamProxy is the HTTP proxy of calls to Azure, HTTPS_PROXY is used when empty
+	UpstreamProxy string
+	// UpstreamMaxIdleConnsPerHost is the number of idle connections kept to each Azure resource
+	UpstreamMaxIdleConnsPerHost int
+	// Timeouts of Azure calls by route, streams included until their last chunk
+	UpstreamChatTimeout       time.Duration
+	UpstreamStreamTimeout     time.Duration
+	UpstreamEmbeddingsTimeout time.Duration
+	// Retries of failed upstream calls: attempts across a deployment's
+	// resources, and the backoff between them
+	UpstreamMaxAttempts    int
+	UpstreamRetryBaseDelay time.Duration
+	UpstreamRetryMaxDelay  time.Duration
+	// Circuit breaker of each upstream resource: consecutive failures
+	// opening it, how long it stays open, and probes let through after
+	UpstreamBreakerFailures       int
+	UpstreamBreakerOpenTimeout    time.Duration
+	UpstreamBreakerHalfOpenProbes int
+	// MaxImageBytes is the largest image accepted inline in chat messages
+	MaxImageBytes int
+	// ResponseCache is where completions of deterministic chat requests are
+	// cached: memory, sql, or empty to disable the cache
+	ResponseCache              string
+	ResponseCacheTTL           time.Duration
+	ResponseCacheMaxEntries    int
+	ResponseCacheMaxEntryBytes int
+	// QuotaStore is where quota counters are kept: sql, or redis to share them between replicas
+	QuotaStore    string
+	RedisAddr     string
+	RedisPassword string
+	// TrustedProxies are the proxy IPs and CIDRs whose X-Forwarded-For is trusted
+	TrustedProxies []string
+	// Rate limits of the unauthenticated routes per client IP, as requests/period
+	RegisterRateLimit string
+	LoginRateLimit    string
+	RefreshRateLimit  string
 }
 
 var AppConfig Config
@@ -34,14 +107,55 @@ func LoadConfig() {
 
 	// Set default values
 	AppConfig = Config{
-		Port:                         getEnv("PORT", "8080"),
-		JWTSecret:                    getEnv("JWT_SECRET", "your-default-secret-key"),
-		DBPath:                       getEnv("DB_PATH", "app.db"),
-		AzureOpenAIEndpoint:          getEnv("AZURE_OPENAI_ENDPOINT", ""),
-		AzureOpenAIKey:               getEnv("AZURE_OPENAI_KEY", ""),
-		AzureOpenAIDeployment:        getEnv("AZURE_OPENAI_DEPLOYMENT", "gpt-4o"),
-		AzureOpenAIDeploymentVersion: getEnv("AZURE_OPENAI_DEPLOYMENT_VERSION", "gpt-4o"),
-		GeminiAPIKey:                 getEnv("GEMINI_API_KEY", ""),
+		Port:                           getEnv("PORT", "8080"),
+		JWTSecret:                      getEnv("JWT_SECRET", "your-default-secret-key"),
+		DBPath:                         getEnv("DB_PATH", "app.db"),
+		AzureOpenAIEndpoint:            getEnv("AZURE_OPENAI_ENDPOINT", ""),
+		AzureOpenAIKey:                 getEnv("AZURE_OPENAI_KEY", ""),
+		AzureOpenAIDeployment:          getEnv("AZURE_OPENAI_DEPLOYMENT", "gpt-4o"),
+		AzureOpenAIDeploymentVersion:   getEnv("AZURE_OPENAI_DEPLOYMENT_VERSION", "gpt-4o"),
+		GeminiAPIKey:                   getEnv("GEMINI_API_KEY", ""),
+		AdminUserIDs:                   getEnvUUIDList("ADMIN_USER_IDS"),
+		DefaultTimezone:                getEnv("QUOTA_TIMEZONE", "UTC"),
+		RollupSchedule:                 getEnv("ROLLUP_SCHEDULE", "15 * * * *"),
+		PruneSchedule:                  getEnv("PRUNE_SCHEDULE", "30 3 * * *"),
+		BoostExpirySchedule:            getEnv("BOOST_EXPIRY_SCHEDULE", "*/5 * * * *"),
+		UsageRetentionDays:             getEnvInt("USAGE_RETENTION_DAYS", 400),
+		QuotaAlertThresholds:           getEnvIntList("QUOTA_ALERT_THRESHOLDS", []int{50, 80, 100}),
+		SMTPHost:                       getEnv("SMTP_HOST", ""),
+		SMTPPort:                       getEnv("SMTP_PORT", "587"),
+		SMTPUsername:                   getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:                   getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:                       getEnv("SMTP_FROM", "no-reply@vhybz.com"),
+		TokenizerDir:                   getEnv("TOKENIZER_DIR", "vocab"),
+		DefaultMaxTokens:               getEnvInt("QUOTA_DEFAULT_MAX_TOKENS", 4096),
+		AzureOpenAIDeploymentsFile:     getEnv("AZURE_OPENAI_DEPLOYMENTS_FILE", ""),
+		AzureOpenAIEmbeddingDeployment: getEnv("AZURE_OPENAI_EMBEDDING_DEPLOYMENT", ""),
+		EmbeddingsMaxBatchInputs:       getEnvInt("EMBEDDINGS_MAX_BATCH_INPUTS", 2048),
+		EmbeddingsMaxBatchTokens:       getEnvInt("EMBEDDINGS_MAX_BATCH_TOKENS", 300000),
+		UpstreamProxy:                  getEnv("UPSTREAM_PROXY", ""),
+		UpstreamMaxIdleConnsPerHost:    getEnvInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", 100),
+		UpstreamChatTimeout:            getEnvDuration("UPSTREAM_TIMEOUT_CHAT", 300*time.Second),
+		UpstreamStreamTimeout:          getEnvDuration("UPSTREAM_TIMEOUT_STREAM", 10*time.Minute),
+		UpstreamEmbeddingsTimeout:      getEnvDuration("UPSTREAM_TIMEOUT_EMBEDDINGS", 60*time.Second),
+		UpstreamMaxAttempts:            getEnvInt("UPSTREAM_MAX_ATTEMPTS", 3),
+		UpstreamRetryBaseDelay:         getEnvDuration("UPSTREAM_RETRY_BASE_DELAY", 500*time.Millisecond),
+		UpstreamRetryMaxDelay:          getEnvDuration("UPSTREAM_RETRY_MAX_DELAY", 10*time.Second),
+		UpstreamBreakerFailures:        getEnvInt("UPSTREAM_BREAKER_FAILURES", 5),
+		UpstreamBreakerOpenTimeout:     getEnvDuration("UPSTREAM_BREAKER_OPEN_TIMEOUT", 30*time.Second),
+		UpstreamBreakerHalfOpenProbes:  getEnvInt("UPSTREAM_BREAKER_HALF_OPEN_PROBES", 1),
+		MaxImageBytes:                  getEnvInt("MAX_IMAGE_BYTES", 20<<20),
+		ResponseCache:                  getEnv("RESPONSE_CACHE", ""),
+		ResponseCacheTTL:               getEnvDuration("RESPONSE_CACHE_TTL", 24*time.Hour),
+		ResponseCacheMaxEntries:        getEnvInt("RESPONSE_CACHE_MAX_ENTRIES", 10000),
+		ResponseCacheMaxEntryBytes:     getEnvInt("RESPONSE_CACHE_MAX_ENTRY_BYTES", 1<<20),
+		QuotaStore:                     getEnv("QUOTA_STORE", "sql"),
+		RedisAddr:                      getEnv("REDIS_ADDR", "localhost:6379"),
+		RedisPassword:                  getEnv("REDIS_PASSWORD", ""),
+		TrustedProxies:                 getEnvList("TRUSTED_PROXIES"),
+		RegisterRateLimit:              getEnv("RATE_LIMIT_REGISTER", "5/1h"),
+		LoginRateLimit:                 getEnv("RATE_LIMIT_LOGIN", "10/1m"),
+		RefreshRateLimit:               getEnv("RATE_LIMIT_REFRESH", "30/1m"),
 	}
 
 	// Validate required configurations
@@ -49,6 +163,10 @@ func LoadConfig() {
 		log.Println("Warning: Using default JWT secret key. Please set JWT_SECRET in your environment variables.")
 	}
 
+	if os.Getenv("ADMIN_USERNAMES") != "" {
+		log.Println("Warning: ADMIN_USERNAMES is no longer supported, list the IDs of admin users in ADMIN_USER_IDS instead.")
+	}
+
 	// Validate Azure OpenAI configuration
 	if AppConfig.AzureOpenAIEndpoint == "" || AppConfig.AzureOpenAIKey == "" || AppConfig.AzureOpenAIDeployment == "" {
 		log.Println("Warning: Azure OpenAI configuration is incomplete. Please set AZURE_OPENAI_ENDPOINT, AZURE_OPENAI_KEY, and AZURE_OPENAI_DEPLOYMENT in your environment variables.")
@@ -62,3 +180,60 @@ func getEnv(key, defaultValue string) string {
 	}
 	return value
 }
+
+func getEnvList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+func getEnvIntList(key string, defaultValue []int) []int {
+	values := getEnvList(key)
+	if len(values) == 0 {
+		return defaultValue
+	}
+
+	ints := make([]int, 0, len(values))
+	for _, value := range values {
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid %s value %q", key, value)
+			continue
+		}
+		ints = append(ints, i)
+	}
+	return ints
+}
+
+func getEnvUUIDList(key string) []uuid.UUID {
+	var ids []uuid.UUID
+	for _, value := range getEnvList(key) {
+		id, err := uuid.Parse(value)
+		if err != nil {
+			log.Printf("Warning: ignoring invalid %s value %q", key, value)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"log"
+	"time"
 
 	"github.com/vhybZApp/api/config"
 	"gorm.io/driver/sqlite"
@@ -13,7 +14,10 @@ var DB *gorm.DB
 // Initialize initializes the database connection and performs auto-migration
 func Initialize() error {
 	var err error
-	DB, err = gorm.Open(sqlite.Open(config.AppConfig.DBPath), &gorm.Config{})
+	DB, err = gorm.Open(sqlite.Open(config.AppConfig.DBPath), &gorm.Config{
+		// Store timestamps in UTC so that they compare consistently
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 		return err
@@ -25,6 +29,24 @@ func Initialize() error {
 		return err
 	}
 
+	// Rewrite data left by earlier versions
+	if err := RunMigrations(DB); err != nil {
+		log.Fatal("Failed to migrate database data:", err)
+		return err
+	}
+
+	// Seed the pricing catalog
+	if err := SeedModelPrices(DB); err != nil {
+		log.Fatal("Failed to seed model prices:", err)
+		return err
+	}
+
+	// Seed the subscription plans
+	if err := SeedPlans(DB); err != nil {
+		log.Fatal("Failed to seed plans:", err)
+		return err
+	}
+
 	return nil
 }
 
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// DBMigration records a data migration applied to the database
+type DBMigration struct {
+	Name      string `gorm:"primaryKey"`
+	AppliedAt time.Time
+}
+
+// migration rewrites data that AutoMigrate can't, once per database
+type migration struct {
+	name string
+	up   func(tx *gorm.DB) error
+}
+
+// migrations are applied in order, each in its own transaction
+var migrations = []migration{
+	{
+		// Before plans, a quota row holding the 100k default was created for
+		// every user on first use. The table now holds overrides of the
+		// user's plan, so those rows would pin users to 100k whatever their
+		// plan.
+		name: "delete-default-token-quotas",
+		up: func(tx *gorm.DB) error {
+			return tx.Unscoped().
+				Where("daily_quota = ? AND monthly_quota IS NULL AND daily_cost_budget IS NULL AND monthly_cost_budget IS NULL AND allowed_models IS NULL", 100000).
+				Delete(&DBTokenQuota{}).Error
+		},
+	},
+	{
+		// The unique index of alerts now includes the quota rule, so the
+		// windows of rules can fire alongside the plan's
+		name: "drop-quota-alert-index",
+		up: func(tx *gorm.DB) error {
+			if !tx.Migrator().HasIndex(&DBQuotaAlert{}, "idx_quota_alert") {
+				return nil
+			}
+			return tx.Migrator().DropIndex(&DBQuotaAlert{}, "idx_quota_alert")
+		},
+	},
+}
+
+// RunMigrations applies the data migrations the database hasn't had yet
+func RunMigrations(db *gorm.DB) error {
+	if err := db.AutoMigrate(&DBMigration{}); err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var count int64
+			if err := tx.Model(&DBMigration{}).Where("name = ?", m.name).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				return nil
+			}
+			if err := m.up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&DBMigration{Name: m.name, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
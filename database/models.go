@@ -1,6 +1,7 @@
 package database
 
 import (
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
@@ -8,6 +9,9 @@ import (
 	"gorm.io/gorm"
 )
 
+// ErrImmutable is returned when modifying a record that may only be appended
+var ErrImmutable = errors.New("record is immutable")
+
 // DBUser represents the user data as stored in the database
 type DBUser struct {
 	ID           uuid.UUID `gorm:"type:uuid;primary_key"`
@@ -18,6 +22,10 @@ type DBUser struct {
 	Password     string         `gorm:"not null"`
 	Email        string         `gorm:"uniqueIndex;not null"`
 	RefreshToken string         `gorm:"-"` // Not stored in DB, only used temporarily
+	// OrganizationID is the organization the user belongs to, if any
+	OrganizationID *uuid.UUID `gorm:"type:uuid;index"`
+	// Timezone is the IANA timezone driving the user's daily quota windows
+	Timezone string
 }
 
 // BeforeCreate will set a UUID rather than numeric ID
@@ -26,21 +34,316 @@ func (u *DBUser) BeforeCreate(tx *gorm.DB) error {
 	return nil
 }
 
+// DBOrganization represents an organization grouping users in the database
+type DBOrganization struct {
+	ID        uuid.UUID `gorm:"type:uuid;primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+	Name      string         `gorm:"uniqueIndex;not null"`
+	// Timezone is the IANA timezone driving its members' daily quota windows
+	Timezone string
+}
+
+// BeforeCreate will set a UUID rather than numeric ID
+func (o *DBOrganization) BeforeCreate(tx *gorm.DB) error {
+	o.ID = uuid.New()
+	return nil
+}
+
 // DBTokenUsage represents the daily token usage for a user in the database
 type DBTokenUsage struct {
 	gorm.Model
 	UserID uuid.UUID `gorm:"type:uuid;index;foreignKey:ID;references:ID;onDelete:CASCADE"`
 	User   DBUser    `gorm:"foreignKey:UserID"`
-	Date   time.Time `gorm:"index"`
+	Date   time.Time `gorm:"index"` // Start of the day in the user's timezone, stored in UTC
 	Tokens int       `gorm:"default:0"`
+	Cost   int64     `gorm:"default:0"` // Micro-dollars spent on the day
 }
 
-// DBTokenQuota represents the daily token quota for a user in the database
+// DBTokenQuota represents a user-level quota override in the database.
+// Nil limits are inherited from the user's plan, zero means unlimited.
 type DBTokenQuota struct {
 	gorm.Model
-	UserID     uuid.UUID `gorm:"type:uuid;uniqueIndex;foreignKey:ID;references:ID;onDelete:CASCADE"`
-	User       DBUser    `gorm:"foreignKey:UserID"`
-	DailyQuota int       `gorm:"default:100000"` // Default 100k tokens per day
+	UserID            uuid.UUID `gorm:"type:uuid;uniqueIndex;foreignKey:ID;references:ID;onDelete:CASCADE"`
+	User              DBUser    `gorm:"foreignKey:UserID"`
+	DailyQuota        *int
+	MonthlyQuota      *int
+	DailyCostBudget   *int64 // Micro-dollars
+	MonthlyCostBudget *int64 // Micro-dollars
+	// AllowedModels replaces the plan's comma-separated model patterns
+	AllowedModels *string
+}
+
+// DBQuotaRule represents a quota bucket for the calls matching a provider,
+// model pattern and endpoint, replacing the token quotas of the plan or
+// override for those calls. Rules belong to a user or a plan, or to everyone
+// when both are nil. Empty matchers match anything and zero limits mean
+// unlimited.
+type DBQuotaRule struct {
+	gorm.Model
+	UserID        *uuid.UUID `gorm:"type:uuid;index"`
+	PlanID        *uint      `gorm:"index"`
+	Plan          *DBPlan    `gorm:"foreignKey:PlanID"`
+	Provider      string
+	ModelPattern  string // path.Match pattern, e.g. gemini-*-flash*
+	Endpoint      string
+	DailyTokens   int
+	MonthlyTokens int
+	DailyRequests int
+}
+
+// DBPlan represents a subscription plan bundling quota limits, models and features.
+// Zero limits mean unlimited.
+type DBPlan struct {
+	gorm.Model
+	Name              string `gorm:"uniqueIndex;not null"`
+	IsDefault         bool   `gorm:"default:false"`
+	DailyQuota        int
+	MonthlyQuota      int
+	DailyCostBudget   int64  // Micro-dollars
+	MonthlyCostBudget int64  // Micro-dollars
+	AllowedModels     string // Comma-separated model patterns, empty allows every model
+	Features          string // Comma-separated feature flags
+}
+
+// DBUserPlan represents the assignment of a plan to a user for a period of time
+type DBUserPlan struct {
+	gorm.Model
+	UserID   uuid.UUID  `gorm:"type:uuid;index;foreignKey:ID;references:ID;onDelete:CASCADE"`
+	User     DBUser     `gorm:"foreignKey:UserID"`
+	PlanID   uint       `gorm:"index"`
+	Plan     DBPlan     `gorm:"foreignKey:PlanID"`
+	StartsAt time.Time  `gorm:"index"`
+	EndsAt   *time.Time `gorm:"index"` // Nil means the assignment never expires
+}
+
+// DBModelPrice represents the price of a provider model from a given date onwards.
+// Prices are expressed in micro-dollars per million tokens.
+type DBModelPrice struct {
+	gorm.Model
+	Provider      string    `gorm:"index:idx_model_price,priority:1;not null"`
+	ModelName     string    `gorm:"index:idx_model_price,priority:2;not null"`
+	EffectiveFrom time.Time `gorm:"index:idx_model_price,priority:3;not null"`
+	InputPrice    int64     `gorm:"not null"`
+	OutputPrice   int64     `gorm:"not null"`
+}
+
+// DBUsageRecord represents the token usage and cost of a single upstream call
+type DBUsageRecord struct {
+	gorm.Model
+	UserID           uuid.UUID `gorm:"type:uuid;index"`
+	Provider         string    `gorm:"index"`
+	ModelName        string    `gorm:"index"` // The model quota rules match
+	ModelVersion     string    // The model the provider answered with
+	Endpoint         string
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             int64        // Micro-dollars
+	Tags             []DBUsageTag `gorm:"foreignKey:UsageRecordID"`
+}
+
+// DBUsageTag represents a cost attribution tag of a usage record, e.g.
+// feature=search
+type DBUsageTag struct {
+	ID            uint   `gorm:"primarykey"`
+	UsageRecordID uint   `gorm:"uniqueIndex:idx_usage_tag,priority:1;not null"`
+	Key           string `gorm:"uniqueIndex:idx_usage_tag,priority:2;index:idx_usage_tag_value,priority:1;not null"`
+	Value         string `gorm:"index:idx_usage_tag_value,priority:2;not null"`
+}
+
+// DBJobRun represents a scheduled run of a background job. The unique index
+// lets a single replica claim each run.
+type DBJobRun struct {
+	ID          uint      `gorm:"primarykey"`
+	JobName     string    `gorm:"uniqueIndex:idx_job_run,priority:1;not null"`
+	ScheduledAt time.Time `gorm:"uniqueIndex:idx_job_run,priority:2;not null"`
+	StartedAt   time.Time
+	FinishedAt  *time.Time
+	Error       string
+	Instance    string
+}
+
+// DBMonthlyUsage represents the usage of a user rolled up per calendar month
+// (UTC), provider and model
+type DBMonthlyUsage struct {
+	gorm.Model
+	UserID           uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_monthly_usage,priority:1"`
+	Month            time.Time `gorm:"uniqueIndex:idx_monthly_usage,priority:2"` // Start of the month in UTC
+	Provider         string    `gorm:"uniqueIndex:idx_monthly_usage,priority:3"`
+	ModelName        string    `gorm:"uniqueIndex:idx_monthly_usage,priority:4"`
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             int64 // Micro-dollars
+}
+
+// DBQuotaBoost represents extra daily tokens temporarily granted to a user
+type DBQuotaBoost struct {
+	gorm.Model
+	UserID      uuid.UUID `gorm:"type:uuid;index"`
+	DailyTokens int       `gorm:"not null"`
+	ExpiresAt   time.Time `gorm:"index;not null"`
+	Reason      string
+}
+
+// DBNotificationSettings represents where a user's quota alerts are delivered
+type DBNotificationSettings struct {
+	gorm.Model
+	UserID        uuid.UUID `gorm:"type:uuid;uniqueIndex"`
+	WebhookURL    string
+	WebhookSecret string
+	EmailEnabled  bool   `gorm:"default:false"`
+	Thresholds    string // Comma-separated percentages, empty for the default thresholds
+}
+
+// DBQuotaAlert records a quota threshold crossed by a user. The unique index
+// makes each threshold fire at most once per window, windows of quota rules
+// apart from the plan's.
+type DBQuotaAlert struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UserID      uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_quota_alert_window,priority:1"`
+	QuotaRuleID uint      `gorm:"not null;default:0;uniqueIndex:idx_quota_alert_window,priority:2"` // Zero for the plan's windows
+	Window      string    `gorm:"uniqueIndex:idx_quota_alert_window,priority:3"`
+	WindowStart time.Time `gorm:"uniqueIndex:idx_quota_alert_window,priority:4"`
+	Threshold   int       `gorm:"uniqueIndex:idx_quota_alert_window,priority:5"`
+	Used        int64
+	Limit       int64
+}
+
+// Wallet owner types
+const (
+	WalletOwnerUser         = "user"
+	WalletOwnerOrganization = "organization"
+)
+
+// DBWallet represents a prepaid credit balance owned by a user or an organization
+type DBWallet struct {
+	gorm.Model
+	OwnerType      string    `gorm:"uniqueIndex:idx_wallet_owner,priority:1;not null"`
+	OwnerID        uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_wallet_owner,priority:2;not null"`
+	Balance        int64     `gorm:"default:0"` // Micro-dollars
+	OverdraftLimit int64     `gorm:"default:0"` // Micro-dollars the balance may drop below zero
+	Held           int64     `gorm:"default:0"` // Micro-dollars set aside for calls in flight
+}
+
+// DBWalletTransaction represents an entry in a wallet's append-only transaction log
+type DBWalletTransaction struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	WalletID     uint   `gorm:"index;not null"`
+	Amount       int64  `gorm:"not null"` // Micro-dollars, negative for debits
+	BalanceAfter int64  `gorm:"not null"` // Micro-dollars
+	Reason       string `gorm:"not null"`
+	Reference    string `gorm:"index"`
+}
+
+// BeforeUpdate prevents wallet transactions from being modified
+func (t *DBWalletTransaction) BeforeUpdate(tx *gorm.DB) error {
+	return ErrImmutable
+}
+
+// BeforeDelete prevents wallet transactions from being deleted
+func (t *DBWalletTransaction) BeforeDelete(tx *gorm.DB) error {
+	return ErrImmutable
+}
+
+// DBQuotaCounter represents a quota window counter of the SQL quota store
+type DBQuotaCounter struct {
+	Name      string    `gorm:"primaryKey"`
+	Value     int64     `gorm:"not null;default:0"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+// DBResponseCacheEntry represents a completion of the SQL response cache
+type DBResponseCacheEntry struct {
+	// Name is the hash of the request the completion answers
+	Name      string    `gorm:"primaryKey"`
+	Value     []byte    `gorm:"not null"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+	// UsedAt is when the entry was last stored or read, the least recently
+	// used entries are evicted first
+	UsedAt time.Time `gorm:"index;not null"`
+}
+
+// Invoice statuses
+const (
+	InvoiceStatusOpen   = "open"
+	InvoiceStatusClosed = "closed"
+)
+
+// DBInvoice represents the usage billed to a user or an organization for a
+// calendar month (UTC). Once closed, an invoice and its lines are immutable.
+type DBInvoice struct {
+	ID          uint `gorm:"primarykey"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	OwnerType   string    `gorm:"uniqueIndex:idx_invoice_owner_month,priority:1;not null"`
+	OwnerID     uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_invoice_owner_month,priority:2;not null"`
+	Month       time.Time `gorm:"uniqueIndex:idx_invoice_owner_month,priority:3;not null"` // Start of the month in UTC
+	Status      string    `gorm:"index;not null"`
+	ClosedAt    *time.Time
+	Requests    int
+	TotalTokens int
+	Cost        int64           // Micro-dollars
+	Lines       []DBInvoiceLine `gorm:"foreignKey:InvoiceID"`
+}
+
+// DBInvoiceLine represents the usage of one user, provider and model on an invoice
+type DBInvoiceLine struct {
+	ID               uint      `gorm:"primarykey"`
+	InvoiceID        uint      `gorm:"index;not null"`
+	UserID           uuid.UUID `gorm:"type:uuid"`
+	Username         string
+	Provider         string
+	ModelName        string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             int64 // Micro-dollars
+}
+
+// BeforeUpdate prevents closed invoices from being modified
+func (i *DBInvoice) BeforeUpdate(tx *gorm.DB) error {
+	return checkInvoiceOpen(tx, i.ID)
+}
+
+// BeforeDelete prevents closed invoices from being deleted
+func (i *DBInvoice) BeforeDelete(tx *gorm.DB) error {
+	return checkInvoiceOpen(tx, i.ID)
+}
+
+// BeforeUpdate prevents the lines of closed invoices from being modified
+func (l *DBInvoiceLine) BeforeUpdate(tx *gorm.DB) error {
+	return checkInvoiceOpen(tx, l.InvoiceID)
+}
+
+// BeforeDelete prevents the lines of closed invoices from being deleted
+func (l *DBInvoiceLine) BeforeDelete(tx *gorm.DB) error {
+	return checkInvoiceOpen(tx, l.InvoiceID)
+}
+
+// checkInvoiceOpen returns ErrImmutable if the stored invoice is closed. The
+// stored status is checked, so closing an open invoice is allowed.
+func checkInvoiceOpen(tx *gorm.DB, invoiceID uint) error {
+	if invoiceID == 0 {
+		return nil
+	}
+	var closed int64
+	err := tx.Session(&gorm.Session{NewDB: true}).Model(&DBInvoice{}).
+		Where("id = ? AND status = ?", invoiceID, InvoiceStatusClosed).
+		Count(&closed).Error
+	if err != nil {
+		return err
+	}
+	if closed > 0 {
+		return ErrImmutable
+	}
+	return nil
 }
 
 // HashPassword hashes the password using bcrypt
@@ -62,7 +365,25 @@ func (u *DBUser) CheckPassword(password string) error {
 func AutoMigrate(db *gorm.DB) error {
 	return db.AutoMigrate(
 		&DBUser{},
+		&DBOrganization{},
 		&DBTokenUsage{},
 		&DBTokenQuota{},
+		&DBQuotaRule{},
+		&DBPlan{},
+		&DBUserPlan{},
+		&DBModelPrice{},
+		&DBUsageRecord{},
+		&DBUsageTag{},
+		&DBWallet{},
+		&DBWalletTransaction{},
+		&DBJobRun{},
+		&DBMonthlyUsage{},
+		&DBQuotaBoost{},
+		&DBNotificationSettings{},
+		&DBQuotaAlert{},
+		&DBInvoice{},
+		&DBInvoiceLine{},
+		&DBQuotaCounter{},
+		&DBResponseCacheEntry{},
 	)
 }
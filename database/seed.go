@@ -0,0 +1,64 @@
+package database
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// defaultModelPrices is the pricing catalog seeded into the database.
+// Prices are list prices in micro-dollars per million tokens.
+var defaultModelPrices = []DBModelPrice{
+	{Provider: "azure", ModelName: "gpt-4o", InputPrice: 2_500_000, OutputPrice: 10_000_000},
+	{Provider: "azure", ModelName: "gpt-4o-mini", InputPrice: 150_000, OutputPrice: 600_000},
+	{Provider: "azure", ModelName: "text-embedding-3-small", InputPrice: 20_000},
+	{Provider: "azure", ModelName: "text-embedding-3-large", InputPrice: 130_000},
+	{Provider: "azure", ModelName: "text-embedding-ada-002", InputPrice: 100_000},
+	{Provider: "gemini", ModelName: "gemini-2.0-flash", InputPrice: 100_000, OutputPrice: 400_000},
+}
+
+// SeedModelPrices inserts the default price of each model that has never
+// been priced, so models added to the catalog reach existing databases.
+// Models whose prices were deleted stay unpriced.
+func SeedModelPrices(db *gorm.DB) error {
+	for _, price := range defaultModelPrices {
+		var count int64
+		err := db.Unscoped().Model(&DBModelPrice{}).
+			Where("provider = ? AND model_name = ?", price.Provider, price.ModelName).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		price.EffectiveFrom = time.Unix(0, 0).UTC()
+		if err := db.Create(&price).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// defaultPlans are the subscription plans seeded into an empty database
+var defaultPlans = []DBPlan{
+	{Name: "free", IsDefault: true, DailyQuota: 100_000, Features: "chat,agent"},
+	{Name: "pro", DailyQuota: 1_000_000, MonthlyQuota: 20_000_000, Features: "chat,agent"},
+	{Name: "enterprise", Features: "chat,agent"},
+}
+
+// SeedPlans inserts the default subscription plans if no plans exist yet
+func SeedPlans(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&DBPlan{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	plans := make([]DBPlan, len(defaultPlans))
+	copy(plans, defaultPlans)
+	return db.Create(&plans).Error
+}
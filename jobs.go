@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/scheduler"
+	"github.com/vhybZApp/api/services"
+)
+
+// registerJobs registers the background maintenance jobs
+func registerJobs(s *scheduler.Scheduler) error {
+	maintenance := services.NewMaintenanceService(database.GetDB())
+	retention := time.Duration(config.AppConfig.UsageRetentionDays) * 24 * time.Hour
+
+	if err := s.Register("rollup-monthly-usage", config.AppConfig.RollupSchedule, func(ctx context.Context) error {
+		return maintenance.RollupMonthlyUsage(ctx, time.Now())
+	}); err != nil {
+		return err
+	}
+	if err := s.Register("prune-usage", config.AppConfig.PruneSchedule, func(ctx context.Context) error {
+		// Roll up first so that nothing is pruned before it is aggregated
+		if err := maintenance.RollupMonthlyUsage(ctx, time.Now()); err != nil {
+			return err
+		}
+		if err := maintenance.PruneUsage(ctx, time.Now(), retention); err != nil {
+			return err
+		}
+		if err := maintenance.PruneQuotaCounters(ctx, time.Now()); err != nil {
+			return err
+		}
+		return maintenance.PruneResponseCache(ctx, time.Now())
+	}); err != nil {
+		return err
+	}
+	return s.Register("expire-quota-boosts", config.AppConfig.BoostExpirySchedule, func(ctx context.Context) error {
+		return maintenance.ExpireQuotaBoosts(ctx, time.Now())
+	})
+}
@@ -1,17 +1,32 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
 	"github.com/vhybZApp/api/agent"
 	"github.com/vhybZApp/api/azure"
+	"github.com/vhybZApp/api/billing"
 	"github.com/vhybZApp/api/config"
 	"github.com/vhybZApp/api/database"
 	_ "github.com/vhybZApp/api/docs"
+	"github.com/vhybZApp/api/notify"
+	"github.com/vhybZApp/api/ratelimit"
+	"github.com/vhybZApp/api/redis"
+	"github.com/vhybZApp/api/scheduler"
+	"github.com/vhybZApp/api/services"
+	"github.com/vhybZApp/api/tokenizer"
+	"github.com/vhybZApp/api/upstream"
 )
 
 // @title           Vhybz API
@@ -44,8 +59,74 @@ func main() {
 		log.Fatalf("Error initializing database: %v", err)
 	}
 
+	// Initialize the quota counters store
+	switch config.AppConfig.QuotaStore {
+	case "sql":
+	case "redis":
+		services.SetQuotaStore(services.NewRedisQuotaStore(redis.NewClient(config.AppConfig.RedisAddr, config.AppConfig.RedisPassword)))
+	default:
+		log.Fatalf("QUOTA_STORE must be sql or redis, got %q", config.AppConfig.QuotaStore)
+	}
+
+	// Initialize the response cache of deterministic chat requests
+	switch config.AppConfig.ResponseCache {
+	case "":
+	case "memory":
+		azure.SetResponseCache(services.NewMemoryResponseCache(config.AppConfig.ResponseCacheMaxEntries))
+	case "sql":
+		azure.SetResponseCache(services.NewSQLResponseCache(database.GetDB(), config.AppConfig.ResponseCacheMaxEntries))
+	default:
+		log.Fatalf("RESPONSE_CACHE must be empty, memory or sql, got %q", config.AppConfig.ResponseCache)
+	}
+
+	// Load the Azure deployments clients choose from
+	if config.AppConfig.AzureOpenAIDeploymentsFile != "" {
+		registry, err := azure.LoadRegistry(config.AppConfig.AzureOpenAIDeploymentsFile)
+		if err != nil {
+			log.Fatalf("Error loading AZURE_OPENAI_DEPLOYMENTS_FILE: %v", err)
+		}
+		azure.SetRegistry(registry)
+	}
+
+	// Initialize quota alert delivery
+	notify.Init()
+
+	// Load the tokenizer vocabularies used to reserve quota
+	tokenizer.Preload()
+	tokenizer.SetModelResolver(azure.TokenizerModel)
+
+	// Initialize the Gemini client of the agent routes
+	if config.AppConfig.GeminiAPIKey != "" {
+		agent.Init()
+	} else {
+		log.Println("Warning: GEMINI_API_KEY is not set, the agent routes are disabled.")
+	}
+
+	// Start background jobs
+	if time.Duration(config.AppConfig.UsageRetentionDays)*24*time.Hour < services.MinUsageRetention {
+		log.Fatalf("USAGE_RETENTION_DAYS must be at least %d", int(services.MinUsageRetention.Hours()/24))
+	}
+	jobs := scheduler.New(database.GetDB())
+	if err := registerJobs(jobs); err != nil {
+		log.Fatalf("Error registering background jobs: %v", err)
+	}
+	jobs.Start()
+
 	// Create Gin router
 	r := gin.Default()
+	if err := r.SetTrustedProxies(config.AppConfig.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Rate limit the unauthenticated routes per client IP
+	rateLimits := &ratelimit.Registry{}
+	authLimit := func(route, spec, env string) gin.HandlerFunc {
+		limit, err := ratelimit.ParseLimit(spec)
+		if err != nil {
+			log.Fatalf("Invalid %s: %v", env, err)
+		}
+		return rateLimits.Add(ratelimit.NewLimiter(route, limit)).Middleware()
+	}
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
@@ -61,26 +142,96 @@ func main() {
 	// Auth routes
 	auth := r.Group("/auth")
 	{
-		auth.POST("/register", register)
-		auth.POST("/login", login)
-		auth.POST("/refresh", refresh)
+		auth.POST("/register", authLimit("/auth/register", config.AppConfig.RegisterRateLimit, "RATE_LIMIT_REGISTER"), register)
+		auth.POST("/login", authLimit("/auth/login", config.AppConfig.LoginRateLimit, "RATE_LIMIT_LOGIN"), login)
+		auth.POST("/refresh", authLimit("/auth/refresh", config.AppConfig.RefreshRateLimit, "RATE_LIMIT_REFRESH"), refresh)
 		auth.GET("/profile", authMiddleware(), getProfile)
+		auth.PUT("/profile", authMiddleware(), updateProfile)
+	}
+
+	// Billing routes
+	r.GET("/pricing", billing.ListPrices)
+	r.GET("/plan", authMiddleware(), billing.GetLimits)
+	r.GET("/wallet", authMiddleware(), billing.GetWallet)
+	r.GET("/wallet/transactions", authMiddleware(), billing.ListWalletTransactions)
+	r.GET("/notifications", authMiddleware(), billing.GetNotificationSettings)
+	r.PUT("/notifications", authMiddleware(), billing.UpdateNotificationSettings)
+
+	// Admin routes
+	adminGroup := r.Group("/admin", authMiddleware(), adminMiddleware())
+	{
+		adminGroup.GET("/plans", billing.ListPlans)
+		adminGroup.PUT("/plans/:name", billing.SavePlan)
+		adminGroup.PUT("/users/:id/plan", billing.AssignPlan)
+		adminGroup.PUT("/users/:id/quota", billing.SetUserQuota)
+		adminGroup.GET("/quota-rules", billing.ListQuotaRules)
+		adminGroup.POST("/quota-rules", billing.CreateQuotaRule)
+		adminGroup.PUT("/quota-rules/:id", billing.UpdateQuotaRule)
+		adminGroup.DELETE("/quota-rules/:id", billing.DeleteQuotaRule)
+		adminGroup.POST("/pricing", billing.SetPrice)
+		adminGroup.GET("/organizations", billing.ListOrganizations)
+		adminGroup.POST("/organizations", billing.CreateOrganization)
+		adminGroup.PUT("/organizations/:id/timezone", billing.SetOrganizationTimezone)
+		adminGroup.PUT("/users/:id/organization", billing.SetUserOrganization)
+		adminGroup.POST("/wallets/:owner_type/:owner_id/top-ups", billing.TopUpWallet)
+		adminGroup.PUT("/wallets/:owner_type/:owner_id/overdraft", billing.SetWalletOverdraft)
+		adminGroup.GET("/wallets/:owner_type/:owner_id/transactions", billing.ListOwnerTransactions)
+		adminGroup.POST("/users/:id/boosts", billing.GrantBoost)
+		adminGroup.GET("/jobs", scheduler.StatusHandler(jobs))
+		adminGroup.GET("/rate-limits", ratelimit.StatusHandler(rateLimits))
+		adminGroup.GET("/upstreams", upstream.StatusHandler(azure.Upstream().Health()))
+		adminGroup.GET("/reports/usage", billing.GetUsageReport)
+		adminGroup.GET("/invoices", billing.ListInvoices)
+		adminGroup.POST("/invoices", billing.GenerateInvoices)
+		adminGroup.GET("/invoices/:id", billing.GetInvoice)
+		adminGroup.POST("/invoices/:id/close", billing.CloseInvoice)
 	}
 
+	// Tokenizer routes
+	r.POST("/tokenize", authMiddleware(), tokenizer.Tokenize)
+
+	// Models routes
+	r.GET("/models", authMiddleware(), azure.ListModels)
+
 	// Azure OpenAI routes
 	azureGroup := r.Group("/azure")
 	{
-		azureGroup.POST("/chat/completions", authMiddleware(), azure.ChatCompletion)
+		azureGroup.POST("/chat/completions", authMiddleware(), featureMiddleware("chat"), azure.ChatCompletion)
+		azureGroup.POST("/embeddings", authMiddleware(), featureMiddleware("chat"), azure.Embeddings)
 	}
 
 	//  Agent routes
 	agentGroup := r.Group("/agent")
 	{
-		agentGroup.POST("/agent/make-html", authMiddleware(), agent.MakeHTML)
+		agentGroup.POST("/agent/make-html", authMiddleware(), featureMiddleware("agent"), agent.MakeHTML)
 	}
 
 	// Start server
-	if err := r.Run(":8080"); err != nil {
-		log.Fatalf("Error starting server: %v", err)
+	srv := &http.Server{
+		Addr:    ":" + config.AppConfig.Port,
+		Handler: r,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Error starting server: %v", err)
+		}
+	}()
+
+	// Wait for a termination signal, then drain requests and background jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	log.Println("Shutting down server...")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := jobs.Stop(shutdownCtx); err != nil {
+		log.Printf("Error stopping background jobs: %v", err)
+	}
+	if err := notify.Wait(shutdownCtx); err != nil {
+		log.Printf("Error delivering pending alerts: %v", err)
 	}
 }
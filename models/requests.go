@@ -14,3 +14,8 @@ type RegisterRequest struct {
 type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
+
+type UpdateProfileRequest struct {
+	// Timezone is an IANA timezone name such as "Europe/Paris", empty for the default
+	Timezone string `json:"timezone"`
+}
@@ -22,6 +22,7 @@ type TokenResponse struct {
 type ProfileResponse struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
+	Timezone string `json:"timezone"`
 }
 
 // NewErrorResponse creates a new error response
@@ -45,9 +46,10 @@ func NewTokenResponse(accessToken, refreshToken string, expiresIn int64) TokenRe
 }
 
 // NewProfileResponse creates a new profile response
-func NewProfileResponse(username, email string) ProfileResponse {
+func NewProfileResponse(username, email, timezone string) ProfileResponse {
 	return ProfileResponse{
 		Username: username,
 		Email:    email,
+		Timezone: timezone,
 	}
 }
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vhybZApp/api/config"
+)
+
+// EventQuotaThreshold is the event of alerts sent when a quota threshold is crossed
+const EventQuotaThreshold = "quota.threshold"
+
+// Alert describes a quota threshold crossed by a user
+type Alert struct {
+	Event       string    `json:"event"`
+	UserID      string    `json:"user_id"`
+	QuotaRuleID uint      `json:"quota_rule_id,omitempty"` // The rule metering the window, if any
+	Window      string    `json:"window"`
+	Threshold   int       `json:"threshold"` // Percent of the limit
+	Used        int64     `json:"used"`
+	Limit       int64     `json:"limit"`
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Recipient describes where an alert is delivered. Empty fields disable the
+// matching channel.
+type Recipient struct {
+	WebhookURL    string
+	WebhookSecret string
+	Email         string
+}
+
+var (
+	mailer   Mailer
+	webhooks = NewWebhookSender()
+	inflight sync.WaitGroup
+)
+
+// Init configures the mailer from the SMTP settings. Without an SMTP host,
+// email alerts are disabled.
+func Init() {
+	if config.AppConfig.SMTPHost == "" {
+		log.Println("SMTP_HOST is not set, email alerts are disabled")
+		return
+	}
+	mailer = &SMTPMailer{
+		Host:     config.AppConfig.SMTPHost,
+		Port:     config.AppConfig.SMTPPort,
+		Username: config.AppConfig.SMTPUsername,
+		Password: config.AppConfig.SMTPPassword,
+		From:     config.AppConfig.SMTPFrom,
+	}
+}
+
+// Dispatch delivers an alert to its recipient in the background
+func Dispatch(recipient Recipient, alert Alert) {
+	if recipient.WebhookURL != "" {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			log.Printf("Error marshaling alert: %v", err)
+			return
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			if err := webhooks.Send(context.Background(), recipient.WebhookURL, recipient.WebhookSecret, body); err != nil {
+				log.Printf("Error delivering alert webhook for user %s: %v", alert.UserID, err)
+			}
+		}()
+	}
+
+	if recipient.Email != "" && mailer != nil {
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			subject, body := alertEmail(alert)
+			if err := mailer.Send(recipient.Email, subject, body); err != nil {
+				log.Printf("Error emailing alert to user %s: %v", alert.UserID, err)
+			}
+		}()
+	}
+}
+
+// Wait waits for in-flight deliveries to finish or for ctx to expire
+func Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// windowDescriptions are the human readable names of quota windows
+var windowDescriptions = map[string]string{
+	"daily_tokens":   "daily token quota",
+	"monthly_tokens": "monthly token quota",
+	"daily_requests": "daily request quota",
+	"daily_cost":     "daily cost budget",
+	"monthly_cost":   "monthly cost budget",
+}
+
+func alertEmail(alert Alert) (string, string) {
+	window := windowDescriptions[alert.Window]
+	if window == "" {
+		window = alert.Window
+	}
+
+	used, limit := strconv.FormatInt(alert.Used, 10), strconv.FormatInt(alert.Limit, 10)
+	if strings.HasSuffix(alert.Window, "_cost") {
+		// Costs are in micro-dollars
+		used, limit = fmt.Sprintf("$%.2f", float64(alert.Used)/1e6), fmt.Sprintf("$%.2f", float64(alert.Limit)/1e6)
+	}
+
+	subject := fmt.Sprintf("You have used %d%% of your %s", alert.Threshold, window)
+	body := fmt.Sprintf("You have used %s of %s (%d%%) of your %s.\n\nIt resets at %s.\n",
+		used, limit, alert.Threshold, window, alert.WindowEnd.Format(time.RFC1123))
+	return subject, body
+}
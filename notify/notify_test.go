@@ -0,0 +1,19 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlertEmail(t *testing.T) {
+	end := time.Date(2025, time.March, 2, 0, 0, 0, 0, time.UTC)
+	subject, body := alertEmail(Alert{Window: "daily_requests", Threshold: 80, Used: 8, Limit: 10, WindowEnd: end})
+	assert.Equal(t, "You have used 80% of your daily request quota", subject)
+	assert.Contains(t, body, "You have used 8 of 10 (80%) of your daily request quota.")
+
+	// Costs are shown in dollars
+	_, body = alertEmail(Alert{Window: "monthly_cost", Threshold: 50, Used: 5_000_000, Limit: 10_000_000, WindowEnd: end})
+	assert.Contains(t, body, "You have used $5.00 of $10.00 (50%) of your monthly cost budget.")
+}
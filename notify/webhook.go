@@ -0,0 +1,167 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhook signature headers. The signature is the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed with the webhook secret, prefixed with "sha256=".
+const (
+	SignatureHeader = "X-Vhybz-Signature"
+	TimestampHeader = "X-Vhybz-Timestamp"
+)
+
+// WebhookSender delivers signed webhooks, retrying failed attempts with
+// exponential backoff
+type WebhookSender struct {
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NewWebhookSender returns a sender that only connects to public addresses,
+// checked when dialing so that a hostname can't be rebound to an internal
+// address after it was validated
+func NewWebhookSender() *WebhookSender {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: dialPublicOnly}
+	return &WebhookSender{
+		Client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: 10 * time.Second},
+		},
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Minute,
+	}
+}
+
+// ErrNonPublicAddress is returned for webhooks that would reach a loopback,
+// private, link-local or otherwise internal address
+var ErrNonPublicAddress = errors.New("webhook address is not public")
+
+// ValidateWebhookURL checks that a webhook URL is https and that its host
+// only resolves to public addresses
+func ValidateWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return errors.New("webhook URL must be an https URL")
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return fmt.Errorf("resolving webhook host: %w", err)
+	}
+	for _, addr := range addrs {
+		if !isPublic(addr) {
+			return fmt.Errorf("%w: %s", ErrNonPublicAddress, addr)
+		}
+	}
+	return nil
+}
+
+// dialPublicOnly refuses connections to addresses that aren't public
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !isPublic(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrNonPublicAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, 100.64.0.0/10
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// isPublic reports whether addr is a globally routable unicast address.
+// Cloud metadata endpoints, e.g. 169.254.169.254, are link-local.
+func isPublic(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
+
+// Sign returns the signature of a webhook body sent at the given timestamp
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Send posts body to url until it is accepted with a 2xx response, the
+// response is a non-retryable 4xx, attempts run out or ctx is done
+func (w *WebhookSender) Send(ctx context.Context, url, secret string, body []byte) error {
+	var lastErr error
+	for attempt := 0; attempt < w.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(w.backoff(attempt)):
+			}
+		}
+
+		retry, err := w.attempt(ctx, url, secret, body)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+		if !retry {
+			break
+		}
+	}
+	return fmt.Errorf("webhook delivery to %s failed: %w", url, lastErr)
+}
+
+// attempt makes a single delivery attempt and reports whether a failure is
+// worth retrying
+func (w *WebhookSender) attempt(ctx context.Context, url, secret string, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, err
+}
+
+// backoff returns the delay before a retry, doubling with each attempt with
+// full jitter
+func (w *WebhookSender) backoff(attempt int) time.Duration {
+	delay := w.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > w.MaxDelay {
+		delay = w.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(delay)) + 1)
+}
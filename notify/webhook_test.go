@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookSender_RetriesAndSigns(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+		require.NoError(t, err)
+		assert.Equal(t, Sign("secret", timestamp, body), r.Header.Get(SignatureHeader))
+
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{Client: server.Client(), MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	require.NoError(t, sender.Send(context.Background(), server.URL, "secret", []byte(`{"event":"quota.threshold"}`)))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestWebhookSender_DoesNotRetryClientErrors(t *testing.T) {
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	sender := &WebhookSender{Client: server.Client(), MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	assert.Error(t, sender.Send(context.Background(), server.URL, "secret", []byte(`{}`)))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&attempts))
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	ctx := context.Background()
+	assert.NoError(t, ValidateWebhookURL(ctx, "https://93.184.215.14/hooks"))
+	assert.NoError(t, ValidateWebhookURL(ctx, "https://[2606:4700::1111]/hooks"))
+
+	for _, rawURL := range []string{
+		"http://93.184.215.14/hooks",
+		"ftp://93.184.215.14",
+		"https:///hooks",
+	} {
+		assert.Error(t, ValidateWebhookURL(ctx, rawURL), rawURL)
+	}
+	for _, rawURL := range []string{
+		"https://127.0.0.1/hooks",
+		"https://localhost:8080",
+		"https://10.1.2.3",
+		"https://172.16.0.1",
+		"https://192.168.1.1",
+		"https://100.64.0.1",
+		"https://169.254.169.254/latest/meta-data",
+		"https://0.0.0.0",
+		"https://[::1]",
+		"https://[fd00::1]",
+		"https://[fe80::1]",
+		"https://[::ffff:127.0.0.1]",
+	} {
+		assert.ErrorIs(t, ValidateWebhookURL(ctx, rawURL), ErrNonPublicAddress, rawURL)
+	}
+}
+
+func TestWebhookSender_RefusesNonPublicAddresses(t *testing.T) {
+	// A host validated earlier may resolve to an internal address when the
+	// webhook is sent, which the dialer refuses
+	var attempts int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+	}))
+	defer server.Close()
+
+	sender := NewWebhookSender()
+	sender.MaxAttempts = 1
+	err := sender.Send(context.Background(), server.URL, "secret", []byte(`{}`))
+	assert.ErrorIs(t, err, ErrNonPublicAddress)
+	assert.Zero(t, atomic.LoadInt32(&attempts))
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vhybZApp/api/models"
+)
+
+// Middleware rejects a client with 429 Too Many Requests and a Retry-After
+// header once it has used up its bucket. Clients are keyed by gin's
+// ClientIP, which only trusts X-Forwarded-For from the engine's trusted
+// proxies.
+func (l *Limiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ok, wait := l.Allow(c.ClientIP())
+		if !ok {
+			// Round up so that clients retrying on time find a token
+			seconds := (wait + time.Second - 1) / time.Second
+			c.Header("Retry-After", strconv.FormatInt(int64(seconds), 10))
+			c.JSON(http.StatusTooManyRequests, models.NewErrorResponse("Too many requests, retry later"))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// StatusHandler godoc
+// @Summary List rate limiters
+// @Description Report the limit and counters of every IP rate limiter of this replica
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} Stats
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Router /admin/rate-limits [get]
+func StatusHandler(r *Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, r.Stats())
+	}
+}
@@ -0,0 +1,191 @@
+// Package ratelimit limits how often clients may call a route, with a token
+// bucket per client IP. Buckets live in memory, so each replica enforces its
+// limits on its own.
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows bursts of up to Requests calls, refilled at Requests per
+// Period. The zero Limit is unlimited.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit parses a limit written as requests/period, e.g. 10/1m. An
+// empty string or 0 is unlimited.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "0" {
+		return Limit{}, nil
+	}
+
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q: expected requests/period, e.g. 10/1m", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid number of requests", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q: invalid period", s)
+	}
+	return Limit{Requests: n, Period: d}, nil
+}
+
+// Unlimited reports whether the limit lets every call through
+func (l Limit) Unlimited() bool {
+	return l.Requests <= 0
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "unlimited"
+	}
+	return strconv.Itoa(l.Requests) + "/" + l.Period.String()
+}
+
+// rate returns the tokens refilled per second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter keeps a token bucket per key. It is safe for concurrent use.
+type Limiter struct {
+	name  string
+	limit Limit
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	allowed   uint64
+	rejected  uint64
+}
+
+// NewLimiter returns a limiter enforcing limit on each key. The name
+// identifies it in Stats.
+func NewLimiter(name string, limit Limit) *Limiter {
+	return &Limiter{
+		name:    name,
+		limit:   limit,
+		now:     time.Now,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the bucket of key. When the bucket is empty it
+// reports how long until the next token.
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.limit.Unlimited() {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Requests), updated: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		l.rejected++
+		wait := time.Duration((1 - b.tokens) / l.limit.rate() * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	l.allowed++
+	return true, 0
+}
+
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * l.limit.rate()
+		if b.tokens > float64(l.limit.Requests) {
+			b.tokens = float64(l.limit.Requests)
+		}
+	}
+	b.updated = now
+}
+
+// sweep forgets the buckets that have refilled, which behave like new ones,
+// at most once per period
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limit.Period {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		l.refill(b, now)
+		if b.tokens >= float64(l.limit.Requests) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Stats are the counters of a limiter since the process started
+type Stats struct {
+	Name     string `json:"name"`
+	Limit    string `json:"limit"`
+	Allowed  uint64 `json:"allowed"`
+	Rejected uint64 `json:"rejected"`
+	// Clients is the number of keys whose bucket is not full
+	Clients int `json:"clients"`
+}
+
+// Stats returns the counters of the limiter
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{
+		Name:     l.name,
+		Limit:    l.limit.String(),
+		Allowed:  l.allowed,
+		Rejected: l.rejected,
+		Clients:  len(l.buckets),
+	}
+}
+
+// Registry collects limiters to report their counters together
+type Registry struct {
+	mu       sync.Mutex
+	limiters []*Limiter
+}
+
+// Add registers a limiter and returns it
+func (r *Registry) Add(l *Limiter) *Limiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.limiters = append(r.limiters, l)
+	return l
+}
+
+// Stats returns the counters of every registered limiter
+func (r *Registry) Stats() []Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]Stats, 0, len(r.limiters))
+	for _, l := range r.limiters {
+		stats = append(stats, l.Stats())
+	}
+	return stats
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("10/1m")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 10, Period: time.Minute}, limit)
+	assert.Equal(t, "10/1m0s", limit.String())
+
+	for _, spec := range []string{"", "0"} {
+		limit, err := ParseLimit(spec)
+		require.NoError(t, err)
+		assert.True(t, limit.Unlimited())
+	}
+	for _, spec := range []string{"10", "x/1m", "-1/1m", "10/soon", "10/0s"} {
+		_, err := ParseLimit(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewLimiter("/auth/login", Limit{Requests: 3, Period: time.Minute})
+	limiter.now = func() time.Time { return now }
+
+	// A new client gets a full burst
+	for i := 0; i < 3; i++ {
+		ok, _ := limiter.Allow("1.1.1.1")
+		assert.True(t, ok)
+	}
+	ok, wait := limiter.Allow("1.1.1.1")
+	assert.False(t, ok)
+	assert.Equal(t, 20*time.Second, wait)
+
+	// Other clients have their own bucket
+	ok, _ = limiter.Allow("2.2.2.2")
+	assert.True(t, ok)
+
+	// A token comes back every period / requests
+	now = now.Add(15 * time.Second)
+	ok, wait = limiter.Allow("1.1.1.1")
+	assert.False(t, ok)
+	assert.Equal(t, 5*time.Second, wait)
+	now = now.Add(5 * time.Second)
+	ok, _ = limiter.Allow("1.1.1.1")
+	assert.True(t, ok)
+
+	stats := limiter.Stats()
+	assert.Equal(t, uint64(5), stats.Allowed)
+	assert.Equal(t, uint64(2), stats.Rejected)
+	assert.Equal(t, 2, stats.Clients)
+
+	// Refilled buckets are forgotten
+	now = now.Add(time.Hour)
+	ok, _ = limiter.Allow("3.3.3.3")
+	assert.True(t, ok)
+	assert.Equal(t, 1, limiter.Stats().Clients)
+}
+
+func TestMiddleware_TrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limiter := NewLimiter("/auth/login", Limit{Requests: 1, Period: time.Minute})
+	r := gin.New()
+	require.NoError(t, r.SetTrustedProxies([]string{"10.0.0.0/8"}))
+	r.POST("/auth/login", limiter.Middleware(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	call := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", nil)
+		req.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	// Behind a trusted proxy the client is the first untrusted hop from the
+	// right, so spoofed entries on the left are ignored
+	assert.Equal(t, http.StatusOK, call("10.0.0.1:1234", "6.6.6.6, 1.1.1.1").Code)
+	w := call("10.0.0.2:1234", "7.7.7.7, 1.1.1.1, 10.0.0.3")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	// An untrusted peer cannot pick its key with X-Forwarded-For
+	assert.Equal(t, http.StatusOK, call("5.5.5.5:1234", "8.8.8.8").Code)
+	assert.Equal(t, http.StatusTooManyRequests, call("5.5.5.5:1234", "9.9.9.9").Code)
+
+	stats := (&Registry{limiters: []*Limiter{limiter}}).Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(2), stats[0].Allowed)
+	assert.Equal(t, uint64(2), stats[0].Rejected)
+}
@@ -0,0 +1,99 @@
+package redis_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/redis"
+	"github.com/vhybZApp/api/redis/redistest"
+)
+
+func TestClient_Do(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	client := redis.NewClient(server.Addr, "")
+	defer client.Close()
+	ctx := context.Background()
+
+	reply, err := client.Do(ctx, "SET", "key", "value")
+	require.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+
+	reply, err = client.Do(ctx, "GET", "key")
+	require.NoError(t, err)
+	assert.Equal(t, "value", reply)
+
+	_, err = client.Do(ctx, "GET", "missing")
+	assert.ErrorIs(t, err, redis.ErrNil)
+
+	n, err := client.Int(ctx, "INCRBY", "counter", "5")
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+
+	// Error replies leave the connection usable
+	_, err = client.Do(ctx, "INCRBY", "key", "1")
+	var replyErr redis.Error
+	assert.True(t, errors.As(err, &replyErr))
+	n, err = client.Int(ctx, "DECRBY", "counter", "2")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+func TestClient_Auth(t *testing.T) {
+	server := redistest.NewServer()
+	server.SetPassword("secret")
+	defer server.Close()
+	ctx := context.Background()
+
+	wrong := redis.NewClient(server.Addr, "wrong")
+	defer wrong.Close()
+	_, err := wrong.Do(ctx, "PING")
+	assert.Error(t, err)
+
+	client := redis.NewClient(server.Addr, "secret")
+	defer client.Close()
+	reply, err := client.Do(ctx, "PING")
+	require.NoError(t, err)
+	assert.Equal(t, "PONG", reply)
+}
+
+func TestReadReply(t *testing.T) {
+	reply, err := redis.ReadReply(bufio.NewReader(strings.NewReader("*3\r\n:1\r\n$3\r\nfoo\r\n$-1\r\n")))
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1), "foo", nil}, reply)
+
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$1\r\na\r\n", string(redis.EncodeCommand([]string{"GET", "a"})))
+}
+
+func TestClient_Eval(t *testing.T) {
+	server := redistest.NewServer()
+	defer server.Close()
+	client := redis.NewClient(server.Addr, "")
+	defer client.Close()
+	ctx := context.Background()
+
+	const script = "return {redis.call('INCRBY', KEYS[1], ARGV[1]), ARGV[2]}"
+	server.HandleScript(script, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+		value, err := call("INCRBY", keys[0], args[0])
+		if err != nil {
+			return nil, err
+		}
+		return []interface{}{value, args[1]}, nil
+	})
+
+	reply, err := client.Do(ctx, "EVAL", script, "1", "counter", "5", "done")
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(5), "done"}, reply)
+
+	// Errors of the commands a script runs are the script's errors
+	_, err = client.Do(ctx, "SET", "key", "value")
+	require.NoError(t, err)
+	_, err = client.Do(ctx, "EVAL", script, "1", "key", "5", "done")
+	var replyErr redis.Error
+	assert.True(t, errors.As(err, &replyErr))
+}
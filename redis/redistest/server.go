@@ -0,0 +1,416 @@
+// Package redistest provides an in-process Redis protocol server for tests,
+// in the spirit of net/http/httptest. It implements the subset of commands
+// used by the redis package's callers. Lua scripts can't run, so EVAL runs
+// Go emulations of them registered with HandleScript.
+package redistest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a fake Redis server listening on a loopback address
+type Server struct {
+	Addr string
+
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+	closing bool
+
+	mu       sync.Mutex
+	password string
+	now      func() time.Time
+	values   map[string]string
+	expires  map[string]time.Time
+	scripts  map[string]Script
+}
+
+// Script emulates a Lua script run by EVAL. It runs with the server locked,
+// so as atomically as Redis runs scripts, and call runs a command the way
+// redis.call does, returning its reply: a string, an int64, nil for nil
+// replies or an error. The reply of the script is encoded the same way,
+// with []interface{} for arrays.
+type Script func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error)
+
+// NewServer starts a server. Close it when done.
+func NewServer() *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("redistest: failed to listen: %v", err))
+	}
+	s := &Server{
+		Addr:     listener.Addr().String(),
+		now:      time.Now,
+		listener: listener,
+		conns:    make(map[net.Conn]struct{}),
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		scripts:  make(map[string]Script),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// SetPassword requires clients to send AUTH with password before other
+// commands. It applies to connections opened afterwards.
+func (s *Server) SetPassword(password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.password = password
+}
+
+// HandleScript makes EVAL of the script source run script
+func (s *Server) HandleScript(source string, script Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[source] = script
+}
+
+// SetNow replaces the server clock used for key expiry
+func (s *Server) SetNow(now func() time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = now
+}
+
+// Close stops the server and waits for its connections to close
+func (s *Server) Close() {
+	s.listener.Close()
+	s.connsMu.Lock()
+	s.closing = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsMu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.connsMu.Lock()
+		if s.closing {
+			s.connsMu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.connsMu.Unlock()
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, conn)
+		s.connsMu.Unlock()
+		conn.Close()
+	}()
+
+	reader := bufio.NewReader(conn)
+	s.mu.Lock()
+	password := s.password
+	s.mu.Unlock()
+	authenticated := password == ""
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch {
+		case strings.EqualFold(args[0], "AUTH"):
+			if len(args) == 2 && args[1] == password {
+				authenticated = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.execute(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// execute runs a command and returns its encoded reply
+func (s *Server) execute(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.run(args)
+}
+
+// run executes a command with the server locked
+func (s *Server) run(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs(args[0])
+		}
+		value, ok := s.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(value)
+	case "SET":
+		return s.set(args)
+	case "INCRBY", "DECRBY":
+		if len(args) != 3 {
+			return wrongArgs(args[0])
+		}
+		delta, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if strings.EqualFold(args[0], "DECRBY") {
+			delta = -delta
+		}
+		value, _ := s.get(args[1])
+		current, err := strconv.ParseInt(orZero(value), 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		current += delta
+		s.values[args[1]] = strconv.FormatInt(current, 10)
+		return integer(current)
+	case "PEXPIREAT":
+		if len(args) != 3 {
+			return wrongArgs(args[0])
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, ok := s.get(args[1]); !ok {
+			return integer(0)
+		}
+		s.expires[args[1]] = time.UnixMilli(ms)
+		return integer(1)
+	case "PTTL":
+		if len(args) != 2 {
+			return wrongArgs(args[0])
+		}
+		if _, ok := s.get(args[1]); !ok {
+			return integer(-2)
+		}
+		expiresAt, ok := s.expires[args[1]]
+		if !ok {
+			return integer(-1)
+		}
+		return integer(expiresAt.Sub(s.now()).Milliseconds())
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(key); ok {
+				deleted++
+			}
+			delete(s.values, key)
+			delete(s.expires, key)
+		}
+		return integer(int64(deleted))
+	case "EVAL":
+		return s.eval(args)
+	case "FLUSHALL":
+		s.values = make(map[string]string)
+		s.expires = make(map[string]time.Time)
+		return "+OK\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// set implements SET key value [NX] [PX ms | PXAT unix-ms]
+func (s *Server) set(args []string) string {
+	if len(args) < 3 {
+		return wrongArgs(args[0])
+	}
+	key, value := args[1], args[2]
+	var nx bool
+	var expiresAt time.Time
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			nx = true
+		case "PX", "PXAT":
+			if i+1 >= len(args) {
+				return "-ERR syntax error\r\n"
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			if strings.EqualFold(args[i], "PX") {
+				expiresAt = s.now().Add(time.Duration(ms) * time.Millisecond)
+			} else {
+				expiresAt = time.UnixMilli(ms)
+			}
+			i++
+		default:
+			return "-ERR syntax error\r\n"
+		}
+	}
+
+	if _, exists := s.get(key); exists && nx {
+		return "$-1\r\n"
+	}
+	s.values[key] = value
+	delete(s.expires, key)
+	if !expiresAt.IsZero() {
+		s.expires[key] = expiresAt
+	}
+	return "+OK\r\n"
+}
+
+// eval implements EVAL script numkeys [key ...] [arg ...]
+func (s *Server) eval(args []string) string {
+	if len(args) < 3 {
+		return wrongArgs(args[0])
+	}
+	numKeys, err := strconv.Atoi(args[2])
+	if err != nil || numKeys < 0 || numKeys > len(args)-3 {
+		return "-ERR Number of keys can't be greater than number of args\r\n"
+	}
+	script, ok := s.scripts[args[1]]
+	if !ok {
+		return "-ERR redistest: no emulation of the script\r\n"
+	}
+	call := func(args ...string) (interface{}, error) {
+		return parseReply(s.run(args))
+	}
+	reply, err := script(call, args[3:3+numKeys], args[3+numKeys:])
+	if err != nil {
+		return "-" + err.Error() + "\r\n"
+	}
+	return encode(reply)
+}
+
+// get returns the value of a key, evicting it if it expired
+func (s *Server) get(key string) (string, bool) {
+	if expiresAt, ok := s.expires[key]; ok && !s.now().Before(expiresAt) {
+		delete(s.values, key)
+		delete(s.expires, key)
+	}
+	value, ok := s.values[key]
+	return value, ok
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("redistest: expected an array")
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n <= 0 {
+		return nil, errors.New("redistest: invalid array length")
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("redistest: expected a bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, errors.New("redistest: invalid bulk length")
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// parseReply decodes the replies of run, which are never arrays
+func parseReply(reply string) (interface{}, error) {
+	line := strings.TrimSuffix(reply, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		if line == "$-1" {
+			return nil, nil
+		}
+		_, value, _ := strings.Cut(line, "\r\n")
+		return value, nil
+	default:
+		return nil, fmt.Errorf("redistest: unexpected reply %q", reply)
+	}
+}
+
+// encode encodes the reply of a script
+func encode(reply interface{}) string {
+	switch reply := reply.(type) {
+	case nil:
+		return "$-1\r\n"
+	case string:
+		return bulk(reply)
+	case int64:
+		return integer(reply)
+	case []interface{}:
+		encoded := "*" + strconv.Itoa(len(reply)) + "\r\n"
+		for _, item := range reply {
+			encoded += encode(item)
+		}
+		return encoded
+	default:
+		return fmt.Sprintf("-ERR redistest: can't encode %T\r\n", reply)
+	}
+}
+
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func integer(n int64) string {
+	return ":" + strconv.FormatInt(n, 10) + "\r\n"
+}
+
+func orZero(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
+}
+
+func wrongArgs(command string) string {
+	return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(command))
+}
@@ -0,0 +1,23 @@
+package scheduler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatusHandler godoc
+// @Summary List background jobs
+// @Description Report the schedule, last run and next run of every background job
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} JobStatus
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Router /admin/jobs [get]
+func StatusHandler(s *Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Status())
+	}
+}
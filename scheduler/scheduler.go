@@ -0,0 +1,251 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// JobFunc is the work done by a job. The context is cancelled when the
+// scheduler stops.
+type JobFunc func(ctx context.Context) error
+
+// JobStatus reports the state of a registered job
+type JobStatus struct {
+	Name         string     `json:"name"`
+	Spec         string     `json:"spec"`
+	Running      bool       `json:"running"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	// Skipped counts runs claimed by another replica
+	Skipped int `json:"skipped"`
+}
+
+type job struct {
+	name     string
+	spec     string
+	schedule *Schedule
+	run      JobFunc
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Scheduler runs registered jobs on cron schedules. Each scheduled run is
+// claimed in the database before it starts, so a run happens at most once
+// across all replicas sharing the database, and a job never overlaps itself.
+type Scheduler struct {
+	db       *gorm.DB
+	instance string
+
+	mu      sync.Mutex
+	jobs    []*job
+	started bool
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func New(db *gorm.DB) *Scheduler {
+	hostname, _ := os.Hostname()
+	return &Scheduler{
+		db:       db,
+		instance: fmt.Sprintf("%s/%d", hostname, os.Getpid()),
+	}
+}
+
+// Register adds a job to run on the given cron spec. Jobs must be registered
+// before Start.
+func (s *Scheduler) Register(name, spec string, run JobFunc) error {
+	schedule, err := Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return fmt.Errorf("job %s registered after the scheduler started", name)
+	}
+	for _, j := range s.jobs {
+		if j.name == name {
+			return fmt.Errorf("job %s is already registered", name)
+		}
+	}
+	s.jobs = append(s.jobs, &job{
+		name:     name,
+		spec:     spec,
+		schedule: schedule,
+		run:      run,
+		status:   JobStatus{Name: name, Spec: spec},
+	})
+	return nil
+}
+
+// Start starts running the registered jobs in the background
+func (s *Scheduler) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return
+	}
+	s.started = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	for _, j := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, j)
+	}
+}
+
+// Stop stops scheduling new runs and waits for running jobs to finish or for
+// ctx to expire, whichever comes first. Running jobs see their context
+// cancelled.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	cancel := s.cancel
+	s.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Status returns the status of every registered job, sorted by name
+func (s *Scheduler) Status() []JobStatus {
+	s.mu.Lock()
+	jobs := append([]*job(nil), s.jobs...)
+	s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+	sort.Slice(statuses, func(a, b int) bool { return statuses[a].Name < statuses[b].Name })
+	return statuses
+}
+
+// loop waits for each activation of a job and runs it. The next activation
+// is computed once a run finishes, so activations that pass while a run is
+// still going are dropped rather than queued.
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	defer s.wg.Done()
+
+	for {
+		next := j.schedule.Next(time.Now().UTC())
+		if next.IsZero() {
+			log.Printf("Job %s has no future runs, stopping it", j.name)
+			return
+		}
+		j.mu.Lock()
+		j.status.NextRun = &next
+		j.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.execute(ctx, j, next)
+	}
+}
+
+// execute claims and runs a single scheduled run of a job
+func (s *Scheduler) execute(ctx context.Context, j *job, scheduledAt time.Time) {
+	claimed, run, err := s.claim(j.name, scheduledAt)
+	if err != nil {
+		log.Printf("Error claiming run of job %s: %v", j.name, err)
+		return
+	}
+	if !claimed {
+		j.mu.Lock()
+		j.status.Skipped++
+		j.mu.Unlock()
+		return
+	}
+
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+
+	started := time.Now()
+	err = safeRun(ctx, j.run)
+	finished := time.Now()
+
+	j.mu.Lock()
+	j.status.Running = false
+	j.status.LastRun = &started
+	j.status.LastDuration = finished.Sub(started).String()
+	j.status.Runs++
+	j.status.LastError = ""
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+	}
+	j.mu.Unlock()
+
+	run.FinishedAt = &finished
+	if err != nil {
+		log.Printf("Job %s failed: %v", j.name, err)
+		run.Error = err.Error()
+	}
+	if err := s.db.Model(run).Select("finished_at", "error").Updates(run).Error; err != nil {
+		log.Printf("Error recording run of job %s: %v", j.name, err)
+	}
+}
+
+// claim records a scheduled run in the database. It reports false if
+// another replica already claimed it.
+func (s *Scheduler) claim(name string, scheduledAt time.Time) (bool, *database.DBJobRun, error) {
+	run := &database.DBJobRun{
+		JobName:     name,
+		ScheduledAt: scheduledAt.UTC(),
+		StartedAt:   time.Now().UTC(),
+		Instance:    s.instance,
+	}
+	result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(run)
+	if result.Error != nil {
+		return false, nil, result.Error
+	}
+	return result.RowsAffected == 1, run, nil
+}
+
+// safeRun runs a job, turning panics into errors so that one bad run does
+// not take down the server
+func safeRun(ctx context.Context, run JobFunc) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return run(ctx)
+}
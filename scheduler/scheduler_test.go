@@ -0,0 +1,89 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func TestParse_Next(t *testing.T) {
+	from := time.Date(2026, time.October, 19, 10, 7, 30, 0, time.UTC) // Monday
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2026, time.October, 19, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2026, time.October, 19, 10, 15, 0, 0, time.UTC)},
+		{"30 3 * * *", time.Date(2026, time.October, 20, 3, 30, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2026, time.October, 19, 11, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2026, time.October, 25, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2026, time.October, 25, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 12 29 2 *", time.Date(2028, time.February, 29, 12, 0, 0, 0, time.UTC)},
+		// Restricted day of month and day of week match when either does
+		{"0 0 1 * 3", time.Date(2026, time.October, 21, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2026, time.October, 19, 10, 25, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			schedule, err := Parse(tt.spec)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, schedule.Next(from))
+		})
+	}
+
+	never, err := Parse("0 0 30 2 *")
+	require.NoError(t, err)
+	assert.True(t, never.Next(from).IsZero())
+}
+
+func TestParse_Invalid(t *testing.T) {
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestExecute_RunsOnceAcrossReplicas(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+uuid.NewString()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(db))
+
+	runs := 0
+	job := func(ctx context.Context) error {
+		runs++
+		return errors.New("boom")
+	}
+
+	first, second := New(db), New(db)
+	require.NoError(t, first.Register("cleanup", "@hourly", job))
+	require.NoError(t, second.Register("cleanup", "@hourly", job))
+
+	scheduledAt := time.Date(2026, time.October, 19, 10, 0, 0, 0, time.UTC)
+	first.execute(context.Background(), first.jobs[0], scheduledAt)
+	second.execute(context.Background(), second.jobs[0], scheduledAt)
+
+	assert.Equal(t, 1, runs)
+	status := first.Status()[0]
+	assert.Equal(t, 1, status.Runs)
+	assert.Equal(t, 1, status.Failures)
+	assert.Equal(t, "boom", status.LastError)
+	assert.Equal(t, 1, second.Status()[0].Skipped)
+
+	var run database.DBJobRun
+	require.NoError(t, db.Where("job_name = ?", "cleanup").First(&run).Error)
+	assert.Equal(t, "boom", run.Error)
+	assert.NotNil(t, run.FinishedAt)
+}
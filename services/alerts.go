@@ -0,0 +1,142 @@
+package services
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/notify"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// dispatchAlert delivers alerts, replaced in tests
+var dispatchAlert = notify.Dispatch
+
+type AlertService struct {
+	db *gorm.DB
+}
+
+func NewAlertService(db *gorm.DB) *AlertService {
+	return &AlertService{db: db}
+}
+
+// GetSettings returns the notification settings of a user, or nil if the
+// user has none
+func (s *AlertService) GetSettings(userID uuid.UUID) (*database.DBNotificationSettings, error) {
+	var settings database.DBNotificationSettings
+	if err := s.db.Where("user_id = ?", userID).First(&settings).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SaveSettings replaces the notification settings of a user
+func (s *AlertService) SaveSettings(settings *database.DBNotificationSettings) error {
+	existing, err := s.GetSettings(settings.UserID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		settings.ID = existing.ID
+		settings.CreatedAt = existing.CreatedAt
+	}
+	return s.db.Save(settings).Error
+}
+
+// Thresholds returns the alert thresholds of a user's settings in ascending
+// order, falling back to the default thresholds
+func Thresholds(settings *database.DBNotificationSettings) []int {
+	thresholds := config.AppConfig.QuotaAlertThresholds
+	if settings != nil && settings.Thresholds != "" {
+		thresholds = nil
+		for _, item := range splitList(settings.Thresholds) {
+			if threshold, err := strconv.Atoi(item); err == nil {
+				thresholds = append(thresholds, threshold)
+			}
+		}
+	}
+
+	sorted := append([]int(nil), thresholds...)
+	sort.Ints(sorted)
+	return sorted
+}
+
+// CheckThresholds records an alert for every threshold a user has crossed in
+// each of the quota windows of calls in the scope, those of the quota rule
+// matching it included, and delivers the new ones. Each threshold fires at
+// most once per window, however many calls cross it.
+func (s *AlertService) CheckThresholds(userID uuid.UUID, scope QuotaScope, now time.Time) error {
+	settings, err := s.GetSettings(userID)
+	if err != nil || settings == nil {
+		return err
+	}
+	recipient := notify.Recipient{
+		WebhookURL:    settings.WebhookURL,
+		WebhookSecret: settings.WebhookSecret,
+	}
+	if settings.EmailEnabled {
+		var user database.DBUser
+		if err := s.db.Select("email").Where("id = ?", userID).First(&user).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		recipient.Email = user.Email
+	}
+	if recipient.WebhookURL == "" && recipient.Email == "" {
+		return nil
+	}
+
+	windows, err := NewTokenQuotaService(s.db).GetScopeWindows(userID, scope, now)
+	if err != nil {
+		return err
+	}
+
+	thresholds := Thresholds(settings)
+	for _, window := range windows {
+		for _, threshold := range thresholds {
+			// Compare in integers: used/limit >= threshold/100
+			if window.Used*100 < window.Limit*int64(threshold) {
+				break
+			}
+
+			alert := database.DBQuotaAlert{
+				UserID:      userID,
+				QuotaRuleID: window.Rule,
+				Window:      window.Name,
+				WindowStart: window.Start.UTC(),
+				Threshold:   threshold,
+				Used:        window.Used,
+				Limit:       window.Limit,
+			}
+			result := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&alert)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				// Already fired in this window
+				continue
+			}
+
+			dispatchAlert(recipient, notify.Alert{
+				Event:       notify.EventQuotaThreshold,
+				UserID:      userID.String(),
+				QuotaRuleID: window.Rule,
+				Window:      window.Name,
+				Threshold:   threshold,
+				Used:        window.Used,
+				Limit:       window.Limit,
+				WindowStart: window.Start,
+				WindowEnd:   window.End,
+				CreatedAt:   alert.CreatedAt,
+			})
+		}
+	}
+	return nil
+}
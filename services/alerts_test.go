@@ -0,0 +1,95 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/notify"
+)
+
+func TestCheckThresholds_FiresOncePerWindow(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+
+	var alerts []notify.Alert
+	dispatchAlert = func(recipient notify.Recipient, alert notify.Alert) {
+		assert.Equal(t, "https://example.com/hook", recipient.WebhookURL)
+		alerts = append(alerts, alert)
+	}
+	defer func() { dispatchAlert = notify.Dispatch }()
+
+	user := database.DBUser{Username: "alice", Email: "alice@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	alertService := NewAlertService(db)
+	require.NoError(t, alertService.SaveSettings(&database.DBNotificationSettings{
+		UserID:     user.ID,
+		WebhookURL: "https://example.com/hook",
+		Thresholds: "80,50",
+	}))
+
+	quotas := NewTokenQuotaService(db)
+	now := time.Now()
+	require.NoError(t, quotas.UpdateUsage(user.ID, 40_000))
+	require.NoError(t, alertService.CheckThresholds(user.ID, QuotaScope{}, now))
+	assert.Empty(t, alerts)
+
+	require.NoError(t, quotas.UpdateUsage(user.ID, 15_000))
+	require.NoError(t, alertService.CheckThresholds(user.ID, QuotaScope{}, now))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, WindowDailyTokens, alerts[0].Window)
+	assert.Equal(t, 50, alerts[0].Threshold)
+
+	// Crossing 50% again in the same window does not fire twice
+	require.NoError(t, quotas.UpdateUsage(user.ID, 1_000))
+	require.NoError(t, alertService.CheckThresholds(user.ID, QuotaScope{}, now))
+	assert.Len(t, alerts, 1)
+
+	require.NoError(t, quotas.UpdateUsage(user.ID, 30_000))
+	require.NoError(t, alertService.CheckThresholds(user.ID, QuotaScope{}, now))
+	require.Len(t, alerts, 2)
+	assert.Equal(t, 80, alerts[1].Threshold)
+	assert.Equal(t, int64(86_000), alerts[1].Used)
+}
+
+func TestCheckThresholds_QuotaRuleWindows(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+
+	var alerts []notify.Alert
+	dispatchAlert = func(recipient notify.Recipient, alert notify.Alert) {
+		alerts = append(alerts, alert)
+	}
+	defer func() { dispatchAlert = notify.Dispatch }()
+
+	user := database.DBUser{Username: "heidi", Email: "heidi@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	alertService := NewAlertService(db)
+	require.NoError(t, alertService.SaveSettings(&database.DBNotificationSettings{
+		UserID:     user.ID,
+		WebhookURL: "https://example.com/hook",
+		Thresholds: "50",
+	}))
+	rule := database.DBQuotaRule{ModelPattern: "gpt-4o", DailyTokens: 20_000}
+	require.NoError(t, NewQuotaRuleService(db).SaveRule(&rule))
+
+	// The rule's daily window fires apart from the plan's
+	quotas := NewTokenQuotaService(db)
+	now := time.Now()
+	gpt4o := QuotaScope{Provider: "azure", Model: "gpt-4o", Endpoint: EndpointChatCompletions}
+	_, err := quotas.Reserve(user.ID, gpt4o, 12_000)
+	require.NoError(t, err)
+	require.NoError(t, alertService.CheckThresholds(user.ID, gpt4o, now))
+	require.Len(t, alerts, 1)
+	assert.Equal(t, WindowDailyTokens, alerts[0].Window)
+	assert.Equal(t, rule.ID, alerts[0].QuotaRuleID)
+	assert.Equal(t, int64(20_000), alerts[0].Limit)
+
+	require.NoError(t, quotas.UpdateUsage(user.ID, 60_000))
+	require.NoError(t, alertService.CheckThresholds(user.ID, QuotaScope{}, now))
+	require.Len(t, alerts, 2)
+	assert.Equal(t, WindowDailyTokens, alerts[1].Window)
+	assert.Zero(t, alerts[1].QuotaRuleID)
+}
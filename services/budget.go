@@ -0,0 +1,121 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/tokenizer"
+)
+
+// FinishReasonQuotaExceeded is the finish reason reported to clients when a
+// generation was cut short because the user's quota ran out
+const FinishReasonQuotaExceeded = "quota_exceeded"
+
+// ReserveCompletion reserves a call whose prompt uses promptTokens and whose
+// completion may use up to maxTokens, capping maxTokens to what is left of
+// the user's quota so that the call cannot run past it. It returns the
+// capped limit, lower than maxTokens when the quota cut it short. When not
+// a single completion token is left the call is rejected with a
+// *QuotaExceededError.
+func (s *TokenQuotaService) ReserveCompletion(userID uuid.UUID, scope QuotaScope, promptTokens, maxTokens int) (*Reservation, int, error) {
+	return s.ReserveCompletions(userID, scope, promptTokens, maxTokens, 1)
+}
+
+// ReserveCompletions is ReserveCompletion for a call generating several
+// choices of up to maxTokens each from the same prompt. The returned limit
+// is per choice, capped so that all of them fit in the quota.
+func (s *TokenQuotaService) ReserveCompletions(userID uuid.UUID, scope QuotaScope, promptTokens, maxTokens, choices int) (*Reservation, int, error) {
+	choices = max(choices, 1)
+	counters, err := s.windowCounters(userID, scope, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	budget, window, err := s.completionBudget(counters, scope, promptTokens)
+	if err != nil {
+		return nil, 0, err
+	}
+	if budget >= 0 && budget < int64(maxTokens)*int64(choices) {
+		if budget < int64(choices) {
+			return nil, 0, &QuotaExceededError{Window: window.QuotaWindow, Err: windowErrors[window.Name]}
+		}
+		maxTokens = int(budget / int64(choices))
+	}
+
+	reservation, err := s.reserve(userID, scope, counters, promptTokens, maxTokens*choices)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reservation, maxTokens, nil
+}
+
+// completionBudget returns the most completion tokens a call with the given
+// prompt fits in the limited windows, along with the window limiting it, or
+// -1 when no window limits completions. Cost budgets are converted to tokens
+// at the model's price and don't limit models without one.
+func (s *TokenQuotaService) completionBudget(counters []windowCounter, scope QuotaScope, promptTokens int) (int64, *windowCounter, error) {
+	budget := int64(-1)
+	var limiting *windowCounter
+	var price *database.DBModelPrice
+	priced := false
+	for i := range counters {
+		counter := &counters[i]
+		if counter.Limit <= 0 || counter.Name == WindowDailyRequests {
+			continue
+		}
+
+		var left int64
+		if counter.isCost() {
+			if !priced {
+				var err error
+				price, err = NewPricingService(s.db).GetPrice(scope.Provider, scope.pricedModel(), time.Now())
+				if err != nil && !errors.Is(err, ErrPriceNotFound) {
+					return 0, nil, err
+				}
+				priced = true
+			}
+			if price == nil || price.OutputPrice <= 0 {
+				continue
+			}
+			// Prices are in micro-dollars per million tokens
+			left = (counter.Remaining()*1_000_000 - int64(promptTokens)*price.InputPrice) / price.OutputPrice
+		} else {
+			left = counter.Remaining() - int64(promptTokens)
+		}
+		if left < 0 {
+			left = 0
+		}
+		if budget < 0 || left < budget {
+			budget, limiting = left, counter
+		}
+	}
+	return budget, limiting, nil
+}
+
+// OutputBudget counts the completion tokens of a generation as its output
+// arrives, so that streamed output can be cut off once the quota is used up
+type OutputBudget struct {
+	model string
+	limit int
+	used  int
+}
+
+// NewOutputBudget returns a budget of limit completion tokens of the model
+func NewOutputBudget(model string, limit int) *OutputBudget {
+	return &OutputBudget{model: model, limit: limit}
+}
+
+// Add counts a chunk of output and reports whether it still fits in the
+// budget. Once it returns false the generation should stop.
+func (b *OutputBudget) Add(text string) bool {
+	n, _ := tokenizer.Count(b.model, text)
+	b.used += n
+	return b.used <= b.limit
+}
+
+// Used returns the tokens counted so far
+func (b *OutputBudget) Used() int {
+	return b.used
+}
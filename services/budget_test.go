@@ -0,0 +1,105 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestReserveCompletion_CapsMaxTokens(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	user := database.DBUser{Username: "frank", Email: "frank@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	quotas := NewTokenQuotaService(db)
+	scope := QuotaScope{Provider: "azure", Model: "gpt-4o", Endpoint: EndpointChatCompletions}
+
+	dailyQuota := 5_000
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: user.ID, DailyQuota: &dailyQuota}))
+	require.NoError(t, quotas.UpdateUsage(user.ID, 3_800))
+
+	// Calls that fit keep their max_tokens
+	reservation, maxTokens, err := quotas.ReserveCompletion(user.ID, scope, 100, 500)
+	require.NoError(t, err)
+	assert.Equal(t, 500, maxTokens)
+	require.NoError(t, quotas.Release(reservation))
+
+	// Longer ones are capped to the remaining tokens after the prompt
+	_, maxTokens, err = quotas.ReserveCompletion(user.ID, scope, 200, 4_096)
+	require.NoError(t, err)
+	assert.Equal(t, 1_000, maxTokens)
+
+	// Nothing left, nothing to cap to
+	_, _, err = quotas.ReserveCompletion(user.ID, scope, 1, 4_096)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+}
+
+func TestReserveCompletions_CoversEveryChoice(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	user := database.DBUser{Username: "gina", Email: "gina@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	quotas := NewTokenQuotaService(db)
+	scope := QuotaScope{Provider: "azure", Model: "gpt-4o", Endpoint: EndpointChatCompletions}
+
+	dailyQuota := 5_000
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: user.ID, DailyQuota: &dailyQuota}))
+
+	// The prompt is reserved once and the limit n times
+	reservation, maxTokens, err := quotas.ReserveCompletions(user.ID, scope, 100, 500, 4)
+	require.NoError(t, err)
+	assert.Equal(t, 500, maxTokens)
+	assert.Equal(t, 2_100, reservation.Tokens)
+	require.NoError(t, quotas.Release(reservation))
+
+	// The limit of each choice is capped so that all of them fit
+	reservation, maxTokens, err = quotas.ReserveCompletions(user.ID, scope, 200, 4_096, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 480, maxTokens)
+	assert.Equal(t, 5_000, reservation.Tokens)
+	require.NoError(t, quotas.Release(reservation))
+
+	// Less than a token per choice left
+	require.NoError(t, quotas.UpdateUsage(user.ID, 4_990))
+	_, _, err = quotas.ReserveCompletions(user.ID, scope, 0, 100, 20)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+}
+
+func TestReserveCompletion_CapsToCostBudget(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	user := database.DBUser{Username: "grace", Email: "grace@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	quotas := NewTokenQuotaService(db)
+	require.NoError(t, NewPricingService(db).SetPrice(&database.DBModelPrice{
+		Provider: "azure", ModelName: "gpt-4o", EffectiveFrom: time.Now().Add(-time.Hour), InputPrice: 2_500_000, OutputPrice: 10_000_000,
+	}))
+
+	// $0.01 buys 1000 completion tokens after a 0 token prompt, 750 after a 1000 token one
+	budget := int64(10_000)
+	zero := 0
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: user.ID, DailyQuota: &zero, DailyCostBudget: &budget}))
+	_, maxTokens, err := quotas.ReserveCompletion(user.ID, QuotaScope{Provider: "azure", Model: "gpt-4o"}, 1_000, 4_096)
+	require.NoError(t, err)
+	assert.Equal(t, 750, maxTokens)
+
+	// Aliases are priced as the model they serve
+	_, maxTokens, err = quotas.ReserveCompletion(user.ID, QuotaScope{Provider: "azure", Model: "fast", PricedModel: "gpt-4o"}, 1_000, 4_096)
+	require.NoError(t, err)
+	assert.Equal(t, 750, maxTokens)
+
+	// Models without a price are not capped by cost
+	_, maxTokens, err = quotas.ReserveCompletion(user.ID, QuotaScope{Provider: "azure", Model: "unpriced"}, 1_000, 4_096)
+	require.NoError(t, err)
+	assert.Equal(t, 4_096, maxTokens)
+}
+
+func TestOutputBudget(t *testing.T) {
+	budget := NewOutputBudget("gpt-4o", 3)
+	assert.True(t, budget.Add("Hello"))
+	assert.False(t, budget.Add(" world, this sentence is longer than three tokens"))
+	assert.Greater(t, budget.Used(), 3)
+}
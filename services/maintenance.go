@@ -0,0 +1,116 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MinUsageRetention is the shortest retention the usage pruning accepts. It
+// keeps the raw rows of the current and previous month, which the monthly
+// rollup and monthly quotas are computed from.
+const MinUsageRetention = 62 * 24 * time.Hour
+
+// jobRunRetention is how long the history of background job runs is kept
+const jobRunRetention = 30 * 24 * time.Hour
+
+type MaintenanceService struct {
+	db *gorm.DB
+}
+
+func NewMaintenanceService(db *gorm.DB) *MaintenanceService {
+	return &MaintenanceService{db: db}
+}
+
+// RollupMonthlyUsage recomputes the monthly aggregates of the current and
+// previous month (UTC) from the raw usage records. It is idempotent, so it
+// can run as often as needed.
+func (s *MaintenanceService) RollupMonthlyUsage(ctx context.Context, now time.Time) error {
+	current := time.Date(now.UTC().Year(), now.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	for _, month := range []time.Time{current.AddDate(0, -1, 0), current} {
+		if err := s.rollupMonth(ctx, month); err != nil {
+			return fmt.Errorf("rolling up %s: %w", month.Format("2006-01"), err)
+		}
+	}
+	return nil
+}
+
+func (s *MaintenanceService) rollupMonth(ctx context.Context, month time.Time) error {
+	var rows []struct {
+		UserID           uuid.UUID
+		Provider         string
+		ModelName        string
+		Requests         int
+		PromptTokens     int
+		CompletionTokens int
+		TotalTokens      int
+		Cost             int64
+	}
+	err := s.db.WithContext(ctx).Model(&database.DBUsageRecord{}).
+		Select("user_id, provider, model_name, COUNT(*) AS requests, "+
+			"SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens, "+
+			"SUM(total_tokens) AS total_tokens, SUM(cost) AS cost").
+		Where("created_at >= ? AND created_at < ?", month, month.AddDate(0, 1, 0)).
+		Group("user_id, provider, model_name").
+		Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	aggregates := make([]database.DBMonthlyUsage, 0, len(rows))
+	for _, row := range rows {
+		aggregates = append(aggregates, database.DBMonthlyUsage{
+			UserID:           row.UserID,
+			Month:            month,
+			Provider:         row.Provider,
+			ModelName:        row.ModelName,
+			Requests:         row.Requests,
+			PromptTokens:     row.PromptTokens,
+			CompletionTokens: row.CompletionTokens,
+			TotalTokens:      row.TotalTokens,
+			Cost:             row.Cost,
+		})
+	}
+	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "user_id"}, {Name: "month"}, {Name: "provider"}, {Name: "model_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{
+			"requests", "prompt_tokens", "completion_tokens", "total_tokens", "cost", "updated_at",
+		}),
+	}).Create(&aggregates).Error
+}
+
+// PruneUsage permanently deletes raw usage records with their tags and daily
+// usage rows older than the retention period, along with old job run history. Monthly
+// aggregates are kept.
+func (s *MaintenanceService) PruneUsage(ctx context.Context, now time.Time, retention time.Duration) error {
+	if retention < MinUsageRetention {
+		return fmt.Errorf("usage retention %s is shorter than the minimum %s", retention, MinUsageRetention)
+	}
+
+	cutoff := now.Add(-retention).UTC()
+	db := s.db.WithContext(ctx).Unscoped().Session(&gorm.Session{})
+	pruned := db.Model(&database.DBUsageRecord{}).Select("id").Where("created_at < ?", cutoff)
+	if err := db.Where("usage_record_id IN (?)", pruned).Delete(&database.DBUsageTag{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("created_at < ?", cutoff).Delete(&database.DBUsageRecord{}).Error; err != nil {
+		return err
+	}
+	if err := db.Where("date < ?", cutoff).Delete(&database.DBTokenUsage{}).Error; err != nil {
+		return err
+	}
+	return db.Where("started_at < ?", now.Add(-jobRunRetention).UTC()).Delete(&database.DBJobRun{}).Error
+}
+
+// ExpireQuotaBoosts deletes quota boosts that have expired
+func (s *MaintenanceService) ExpireQuotaBoosts(ctx context.Context, now time.Time) error {
+	return s.db.WithContext(ctx).Unscoped().Where("expires_at <= ?", now.UTC()).Delete(&database.DBQuotaBoost{}).Error
+}
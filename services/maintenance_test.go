@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestRollupAndPruneUsage(t *testing.T) {
+	db := setupTestDB(t)
+	maintenance := NewMaintenanceService(db)
+	userID := uuid.New()
+	now := time.Date(2026, time.October, 19, 12, 0, 0, 0, time.UTC)
+
+	records := []database.DBUsageRecord{
+		{UserID: userID, Provider: "azure", ModelName: "gpt-4o", PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, Cost: 100},
+		{UserID: userID, Provider: "azure", ModelName: "gpt-4o", PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25, Cost: 200},
+		{UserID: userID, Provider: "azure", ModelName: "gpt-4o", PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2, Cost: 1,
+			Tags: []database.DBUsageTag{{Key: "feature", Value: "search"}}},
+	}
+	records[0].CreatedAt = time.Date(2026, time.October, 2, 0, 0, 0, 0, time.UTC)
+	records[1].CreatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+	records[2].CreatedAt = time.Date(2026, time.January, 5, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, db.Create(&records).Error)
+
+	// Running the rollup twice must not double count
+	require.NoError(t, maintenance.RollupMonthlyUsage(context.Background(), now))
+	require.NoError(t, maintenance.RollupMonthlyUsage(context.Background(), now))
+
+	var aggregates []database.DBMonthlyUsage
+	require.NoError(t, db.Find(&aggregates).Error)
+	require.Len(t, aggregates, 1)
+	assert.Equal(t, 2, aggregates[0].Requests)
+	assert.Equal(t, 40, aggregates[0].TotalTokens)
+	assert.Equal(t, int64(300), aggregates[0].Cost)
+
+	assert.Error(t, maintenance.PruneUsage(context.Background(), now, 30*24*time.Hour))
+	require.NoError(t, maintenance.PruneUsage(context.Background(), now, 90*24*time.Hour))
+
+	var remaining int64
+	require.NoError(t, db.Unscoped().Model(&database.DBUsageRecord{}).Count(&remaining).Error)
+	assert.Equal(t, int64(2), remaining)
+	require.NoError(t, db.Model(&database.DBUsageTag{}).Count(&remaining).Error)
+	assert.Equal(t, int64(0), remaining)
+}
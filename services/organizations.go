@@ -0,0 +1,80 @@
+package services
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrOrganizationNotFound is returned when an organization does not exist
+	ErrOrganizationNotFound = errors.New("organization not found")
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = errors.New("user not found")
+)
+
+type OrganizationService struct {
+	db *gorm.DB
+}
+
+func NewOrganizationService(db *gorm.DB) *OrganizationService {
+	return &OrganizationService{db: db}
+}
+
+// CreateOrganization creates an organization
+func (s *OrganizationService) CreateOrganization(name, timezone string) (*database.DBOrganization, error) {
+	organization := database.DBOrganization{Name: name, Timezone: timezone}
+	if err := s.db.Create(&organization).Error; err != nil {
+		return nil, err
+	}
+	return &organization, nil
+}
+
+// ListOrganizations returns every organization
+func (s *OrganizationService) ListOrganizations() ([]database.DBOrganization, error) {
+	var organizations []database.DBOrganization
+	if err := s.db.Order("name").Find(&organizations).Error; err != nil {
+		return nil, err
+	}
+	return organizations, nil
+}
+
+// SetOrganizationTimezone sets the timezone of an organization
+func (s *OrganizationService) SetOrganizationTimezone(organizationID uuid.UUID, timezone string) (*database.DBOrganization, error) {
+	var organization database.DBOrganization
+	if err := s.db.Where("id = ?", organizationID).First(&organization).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrOrganizationNotFound
+		}
+		return nil, err
+	}
+	if err := s.db.Model(&organization).Update("timezone", timezone).Error; err != nil {
+		return nil, err
+	}
+	return &organization, nil
+}
+
+// SetUserOrganization moves a user into an organization, or out of any
+// organization when organizationID is nil
+func (s *OrganizationService) SetUserOrganization(userID uuid.UUID, organizationID *uuid.UUID) error {
+	if organizationID != nil {
+		var count int64
+		if err := s.db.Model(&database.DBOrganization{}).Where("id = ?", *organizationID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrOrganizationNotFound
+		}
+	}
+
+	result := s.db.Model(&database.DBUser{}).Where("id = ?", userID).Update("organization_id", organizationID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
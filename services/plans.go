@@ -0,0 +1,183 @@
+package services
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrPlanNotFound is returned when a plan does not exist
+	ErrPlanNotFound = errors.New("plan not found")
+	// ErrModelNotAllowed is returned when a user's plan does not include a model
+	ErrModelNotAllowed = errors.New("model not allowed by plan")
+)
+
+// fallbackPlan is used when the database has no default plan
+var fallbackPlan = database.DBPlan{Name: "free", IsDefault: true, DailyQuota: 100_000, Features: "chat,agent"}
+
+// QuotaLimits are the effective limits of a user, zero means unlimited
+type QuotaLimits struct {
+	Plan              string
+	PlanID            uint // Zero for the built-in fallback plan
+	DailyQuota        int
+	MonthlyQuota      int
+	DailyCostBudget   int64 // Micro-dollars
+	MonthlyCostBudget int64 // Micro-dollars
+	AllowedModels     []string
+	Features          []string
+}
+
+// AllowsModel reports whether the limits allow the given model
+func (l *QuotaLimits) AllowsModel(model string) bool {
+	if len(l.AllowedModels) == 0 {
+		return true
+	}
+	for _, pattern := range l.AllowedModels {
+		if ok, _ := path.Match(pattern, model); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature reports whether the limits enable the given feature flag
+func (l *QuotaLimits) HasFeature(feature string) bool {
+	for _, f := range l.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+type PlanService struct {
+	db *gorm.DB
+}
+
+func NewPlanService(db *gorm.DB) *PlanService {
+	return &PlanService{db: db}
+}
+
+// ListPlans returns every plan
+func (s *PlanService) ListPlans() ([]database.DBPlan, error) {
+	var plans []database.DBPlan
+	if err := s.db.Order("name").Find(&plans).Error; err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// GetPlan returns a plan by name
+func (s *PlanService) GetPlan(name string) (*database.DBPlan, error) {
+	var plan database.DBPlan
+	if err := s.db.Where("name = ?", name).First(&plan).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrPlanNotFound
+		}
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// SavePlan creates or updates a plan by name. Making a plan the default
+// clears the flag on every other plan.
+func (s *PlanService) SavePlan(plan *database.DBPlan) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var existing database.DBPlan
+		err := tx.Where("name = ?", plan.Name).First(&existing).Error
+		switch {
+		case err == nil:
+			plan.ID = existing.ID
+			plan.CreatedAt = existing.CreatedAt
+		case !errors.Is(err, gorm.ErrRecordNotFound):
+			return err
+		}
+
+		if plan.IsDefault {
+			if err := tx.Model(&database.DBPlan{}).Where("name <> ?", plan.Name).Update("is_default", false).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(plan).Error
+	})
+}
+
+// DefaultPlan returns the plan users fall back to without an active assignment
+func (s *PlanService) DefaultPlan() (*database.DBPlan, error) {
+	var plan database.DBPlan
+	if err := s.db.Where("is_default = ?", true).First(&plan).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			fallback := fallbackPlan
+			return &fallback, nil
+		}
+		return nil, err
+	}
+	return &plan, nil
+}
+
+// ActivePlan returns the plan assigned to a user at the given time. Users
+// without an assignment, or whose assignment has expired, get the default plan.
+func (s *PlanService) ActivePlan(userID uuid.UUID, at time.Time) (*database.DBPlan, error) {
+	var assignment database.DBUserPlan
+	err := s.db.Preload("Plan").
+		Where("user_id = ? AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)", userID, at, at).
+		Order("starts_at DESC").
+		First(&assignment).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return s.DefaultPlan()
+		}
+		return nil, err
+	}
+	return &assignment.Plan, nil
+}
+
+// AssignPlan assigns a plan to a user from startsAt until endsAt, or
+// indefinitely when endsAt is nil. Assignments overlapping the new one are
+// cut short at startsAt, so upgrades and downgrades take effect immediately.
+func (s *PlanService) AssignPlan(userID uuid.UUID, planName string, startsAt time.Time, endsAt *time.Time) (*database.DBUserPlan, error) {
+	plan, err := s.GetPlan(planName)
+	if err != nil {
+		return nil, err
+	}
+
+	assignment := database.DBUserPlan{
+		UserID:   userID,
+		PlanID:   plan.ID,
+		Plan:     *plan,
+		StartsAt: startsAt,
+		EndsAt:   endsAt,
+	}
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&database.DBUserPlan{}).
+			Where("user_id = ? AND starts_at < ? AND (ends_at IS NULL OR ends_at > ?)", userID, startsAt, startsAt).
+			Update("ends_at", startsAt).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? AND starts_at >= ?", userID, startsAt).Delete(&database.DBUserPlan{}).Error; err != nil {
+			return err
+		}
+		return tx.Omit("Plan", "User").Create(&assignment).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &assignment, nil
+}
+
+// splitList splits a comma-separated list, dropping empty entries
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestGetLimits_PlanOverrideAndExpiry(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	plans := NewPlanService(db)
+	quotas := NewTokenQuotaService(db)
+	userID := uuid.New()
+
+	limits, err := quotas.GetLimits(userID)
+	require.NoError(t, err)
+	assert.Equal(t, "free", limits.Plan)
+	assert.Equal(t, 100_000, limits.DailyQuota)
+
+	// An expired assignment reverts to the default plan
+	now := time.Now()
+	ended := now.Add(-time.Hour)
+	_, err = plans.AssignPlan(userID, "pro", now.Add(-48*time.Hour), &ended)
+	require.NoError(t, err)
+	limits, err = quotas.GetLimits(userID)
+	require.NoError(t, err)
+	assert.Equal(t, "free", limits.Plan)
+
+	_, err = plans.AssignPlan(userID, "pro", now.Add(-time.Minute), nil)
+	require.NoError(t, err)
+	limits, err = quotas.GetLimits(userID)
+	require.NoError(t, err)
+	assert.Equal(t, "pro", limits.Plan)
+	assert.Equal(t, 1_000_000, limits.DailyQuota)
+	assert.Equal(t, 20_000_000, limits.MonthlyQuota)
+
+	// The user-level override wins over the plan for the limits it sets
+	daily := 5_000
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: userID, DailyQuota: &daily}))
+	limits, err = quotas.GetLimits(userID)
+	require.NoError(t, err)
+	assert.Equal(t, 5_000, limits.DailyQuota)
+	assert.Equal(t, 20_000_000, limits.MonthlyQuota)
+
+	allowed := "gpt-4o-mini"
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: userID, DailyQuota: &daily, AllowedModels: &allowed}))
+	limits, err = quotas.GetLimits(userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gpt-4o-mini"}, limits.AllowedModels)
+
+	// A downgrade cuts the current assignment short
+	_, err = plans.AssignPlan(userID, "free", now, nil)
+	require.NoError(t, err)
+	plan, err := plans.ActivePlan(userID, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, "free", plan.Name)
+}
+
+func TestQuotaLimits_AllowsModel(t *testing.T) {
+	limits := QuotaLimits{AllowedModels: []string{"gpt-4o-mini*", "gemini-*"}}
+	assert.True(t, limits.AllowsModel("gpt-4o-mini"))
+	assert.True(t, limits.AllowsModel("gemini-2.0-flash"))
+	assert.False(t, limits.AllowsModel("gpt-4o"))
+	assert.True(t, (&QuotaLimits{}).AllowsModel("gpt-4o"))
+}
+
+func TestRunMigrations_DeletesDefaultQuotaRows(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	plans := NewPlanService(db)
+	quotas := NewTokenQuotaService(db)
+	legacy, overridden := uuid.New(), uuid.New()
+	_, err := plans.AssignPlan(legacy, "pro", time.Now().Add(-time.Minute), nil)
+	require.NoError(t, err)
+
+	// Rows created for every user on first use before plans existed
+	daily, monthly := 100_000, 500_000
+	require.NoError(t, db.Create(&database.DBTokenQuota{UserID: legacy, DailyQuota: &daily}).Error)
+	require.NoError(t, db.Create(&database.DBTokenQuota{UserID: overridden, DailyQuota: &daily, MonthlyQuota: &monthly}).Error)
+
+	require.NoError(t, database.RunMigrations(db))
+	limits, err := quotas.GetLimits(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, 1_000_000, limits.DailyQuota)
+	limits, err = quotas.GetLimits(overridden)
+	require.NoError(t, err)
+	assert.Equal(t, 500_000, limits.MonthlyQuota)
+
+	// Migrations run once, rows created afterwards are the admin's
+	require.NoError(t, db.Create(&database.DBTokenQuota{UserID: legacy, DailyQuota: &daily}).Error)
+	require.NoError(t, database.RunMigrations(db))
+	limits, err = quotas.GetLimits(legacy)
+	require.NoError(t, err)
+	assert.Equal(t, 100_000, limits.DailyQuota)
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+// ErrPriceNotFound is returned when no price is configured for a model
+var ErrPriceNotFound = errors.New("no price configured for model")
+
+type PricingService struct {
+	db *gorm.DB
+}
+
+func NewPricingService(db *gorm.DB) *PricingService {
+	return &PricingService{db: db}
+}
+
+// GetPrice returns the price in effect for a provider model at the given time.
+// Versioned model names such as "gpt-4o-2024-08-06" fall back to the longest
+// catalog entry that prefixes them.
+func (s *PricingService) GetPrice(provider, model string, at time.Time) (*database.DBModelPrice, error) {
+	var prices []database.DBModelPrice
+	if err := s.db.Where("provider = ? AND effective_from <= ?", provider, at).
+		Order("effective_from DESC").
+		Find(&prices).Error; err != nil {
+		return nil, err
+	}
+
+	var best *database.DBModelPrice
+	for i := range prices {
+		price := &prices[i]
+		if price.ModelName != model && !strings.HasPrefix(model, price.ModelName+"-") {
+			continue
+		}
+		// Prices are ordered newest first, so only a longer name can win
+		if best == nil || len(price.ModelName) > len(best.ModelName) {
+			best = price
+		}
+	}
+	if best == nil {
+		return nil, ErrPriceNotFound
+	}
+	return best, nil
+}
+
+// ListPrices returns the prices in effect at the given time
+func (s *PricingService) ListPrices(at time.Time) ([]database.DBModelPrice, error) {
+	var prices []database.DBModelPrice
+	if err := s.db.Where("effective_from <= ?", at).
+		Order("provider, model_name, effective_from DESC").
+		Find(&prices).Error; err != nil {
+		return nil, err
+	}
+
+	current := prices[:0]
+	for _, price := range prices {
+		if n := len(current); n > 0 && current[n-1].Provider == price.Provider && current[n-1].ModelName == price.ModelName {
+			continue
+		}
+		current = append(current, price)
+	}
+	return current, nil
+}
+
+// SetPrice adds a price for a provider model effective from the given time
+func (s *PricingService) SetPrice(price *database.DBModelPrice) error {
+	return s.db.Create(price).Error
+}
+
+// Cost returns the cost in micro-dollars of a call priced with the given price
+func Cost(price *database.DBModelPrice, promptTokens, completionTokens int) int64 {
+	total := int64(promptTokens)*price.InputPrice + int64(completionTokens)*price.OutputPrice
+	// Round up so that fractions of a micro-dollar are never given away
+	return (total + 999_999) / 1_000_000
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func setupTestDB(t *testing.T) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open("file:"+uuid.NewString()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger:  logger.Default.LogMode(logger.Silent),
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	require.NoError(t, err)
+	require.NoError(t, database.AutoMigrate(db))
+
+	// SQLite allows a single writer, serialize connections to avoid lock errors
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+	sqlDB.SetMaxOpenConns(1)
+	return db
+}
+
+func TestGetPrice_PrefixAndEffectiveDate(t *testing.T) {
+	db := setupTestDB(t)
+	pricing := NewPricingService(db)
+
+	jan := time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC)
+	jun := time.Date(2025, time.June, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, pricing.SetPrice(&database.DBModelPrice{Provider: "azure", ModelName: "gpt-4o", EffectiveFrom: jan, InputPrice: 5_000_000, OutputPrice: 15_000_000}))
+	require.NoError(t, pricing.SetPrice(&database.DBModelPrice{Provider: "azure", ModelName: "gpt-4o", EffectiveFrom: jun, InputPrice: 2_500_000, OutputPrice: 10_000_000}))
+	require.NoError(t, pricing.SetPrice(&database.DBModelPrice{Provider: "azure", ModelName: "gpt-4o-mini", EffectiveFrom: jan, InputPrice: 150_000, OutputPrice: 600_000}))
+
+	price, err := pricing.GetPrice("azure", "gpt-4o-2024-08-06", jun.AddDate(0, 0, -1))
+	require.NoError(t, err)
+	assert.Equal(t, int64(5_000_000), price.InputPrice)
+
+	price, err = pricing.GetPrice("azure", "gpt-4o-2024-08-06", jun)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2_500_000), price.InputPrice)
+
+	price, err = pricing.GetPrice("azure", "gpt-4o-mini-2024-07-18", jun)
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4o-mini", price.ModelName)
+
+	_, err = pricing.GetPrice("gemini", "gpt-4o", jun)
+	assert.ErrorIs(t, err, ErrPriceNotFound)
+}
+
+func TestSeedModelPrices_AddsMissingModels(t *testing.T) {
+	db := setupTestDB(t)
+	pricing := NewPricingService(db)
+
+	// A catalog seeded before embedding models were priced
+	require.NoError(t, db.Create(&database.DBModelPrice{Provider: "azure", ModelName: "gpt-4o", InputPrice: 5_000_000, OutputPrice: 15_000_000}).Error)
+	deleted := database.DBModelPrice{Provider: "azure", ModelName: "gpt-4o-mini", InputPrice: 1, OutputPrice: 1}
+	require.NoError(t, db.Create(&deleted).Error)
+	require.NoError(t, db.Delete(&deleted).Error)
+
+	require.NoError(t, database.SeedModelPrices(db))
+	require.NoError(t, database.SeedModelPrices(db))
+	price, err := pricing.GetPrice("azure", "text-embedding-3-small", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(20_000), price.InputPrice)
+
+	// Prices already set, or deleted, are left alone
+	price, err = pricing.GetPrice("azure", "gpt-4o", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(5_000_000), price.InputPrice)
+	price, err = pricing.GetPrice("azure", "gpt-4o-mini", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, "gpt-4o", price.ModelName)
+	var count int64
+	require.NoError(t, db.Model(&database.DBModelPrice{}).Where("model_name = ?", "text-embedding-3-small").Count(&count).Error)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestCost_RoundsUp(t *testing.T) {
+	price := &database.DBModelPrice{InputPrice: 2_500_000, OutputPrice: 10_000_000}
+	assert.Equal(t, int64(3), Cost(price, 1, 0))
+	assert.Equal(t, int64(2_500+10_000), Cost(price, 1_000, 1_000))
+}
+
+func TestRecordUsage_AddsCost(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedModelPrices(db))
+	quotas := NewTokenQuotaService(db)
+	userID := uuid.New()
+
+	record, err := quotas.RecordUsage(userID, CallUsage{Provider: "azure", Model: "gpt-4o-2024-08-06", PromptTokens: 1000, CompletionTokens: 500})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2_500+5_000), record.Cost)
+
+	usage, err := quotas.GetDailyUsage(userID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 1500, usage.Tokens)
+	assert.Equal(t, int64(7_500), usage.Cost)
+}
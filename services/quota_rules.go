@@ -0,0 +1,220 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+// Endpoints metered by the token quota, as matched by quota rules
+const (
+	EndpointChatCompletions = "chat-completions"
+	EndpointEmbeddings      = "embeddings"
+	EndpointMakeHTML        = "make-html"
+)
+
+var (
+	// ErrQuotaRuleNotFound is returned when a quota rule does not exist
+	ErrQuotaRuleNotFound = errors.New("quota rule not found")
+	// ErrInvalidQuotaRule is returned when a quota rule cannot be saved
+	ErrInvalidQuotaRule = errors.New("invalid quota rule")
+)
+
+// QuotaScope identifies what a call is metered as: the provider and model it
+// calls and the endpoint it was made through
+type QuotaScope struct {
+	Provider string
+	Model    string
+	Endpoint string
+	// PricedModel is the model the call is priced as before it completes,
+	// e.g. the model a deployment alias serves; Model when empty. Rules
+	// don't match it.
+	PricedModel string
+}
+
+// pricedModel returns the model the scope's calls are priced as
+func (scope QuotaScope) pricedModel() string {
+	if scope.PricedModel != "" {
+		return scope.PricedModel
+	}
+	return scope.Model
+}
+
+// matches reports whether a rule applies to calls in the scope
+func (scope QuotaScope) matches(rule *database.DBQuotaRule) bool {
+	if rule.Provider != "" && rule.Provider != scope.Provider {
+		return false
+	}
+	if rule.Endpoint != "" && rule.Endpoint != scope.Endpoint {
+		return false
+	}
+	if rule.ModelPattern != "" {
+		if ok, _ := path.Match(rule.ModelPattern, scope.Model); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether rule a is more specific than rule b. User
+// rules beat plan rules, which beat rules for everyone. Then a rule with an
+// endpoint beats one without, an exact model beats a pattern, a longer
+// pattern beats a shorter one, and a rule with a provider beats one without.
+// The oldest rule wins remaining ties.
+func moreSpecific(a, b *database.DBQuotaRule) bool {
+	if a, b := ownerRank(a), ownerRank(b); a != b {
+		return a > b
+	}
+	if a, b := a.Endpoint != "", b.Endpoint != ""; a != b {
+		return a
+	}
+	if a, b := modelRank(a.ModelPattern), modelRank(b.ModelPattern); a != b {
+		return a > b
+	}
+	if a, b := a.Provider != "", b.Provider != ""; a != b {
+		return a
+	}
+	return a.ID < b.ID
+}
+
+func ownerRank(rule *database.DBQuotaRule) int {
+	switch {
+	case rule.UserID != nil:
+		return 2
+	case rule.PlanID != nil:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// modelRank ranks model patterns by specificity: exact models first, then
+// patterns by length
+func modelRank(pattern string) int {
+	if pattern == "" {
+		return 0
+	}
+	if !strings.ContainsAny(pattern, `*?[\`) {
+		return 1 << 30
+	}
+	return len(pattern)
+}
+
+// matchRule returns the most specific of the rules applying to the scope, or
+// nil if none does
+func matchRule(rules []database.DBQuotaRule, scope QuotaScope) *database.DBQuotaRule {
+	var match *database.DBQuotaRule
+	for i := range rules {
+		rule := &rules[i]
+		if scope.matches(rule) && (match == nil || moreSpecific(rule, match)) {
+			match = rule
+		}
+	}
+	return match
+}
+
+type QuotaRuleService struct {
+	db *gorm.DB
+}
+
+func NewQuotaRuleService(db *gorm.DB) *QuotaRuleService {
+	return &QuotaRuleService{db: db}
+}
+
+// ListRules returns every quota rule
+func (s *QuotaRuleService) ListRules() ([]database.DBQuotaRule, error) {
+	var rules []database.DBQuotaRule
+	if err := s.db.Preload("Plan").Order("id").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetRule returns a quota rule by ID
+func (s *QuotaRuleService) GetRule(id uint) (*database.DBQuotaRule, error) {
+	var rule database.DBQuotaRule
+	if err := s.db.Preload("Plan").First(&rule, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrQuotaRuleNotFound
+		}
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// SaveRule creates a quota rule, or updates it when its ID is set
+func (s *QuotaRuleService) SaveRule(rule *database.DBQuotaRule) error {
+	switch {
+	case rule.UserID != nil && rule.PlanID != nil:
+		return fmt.Errorf("%w: a rule belongs to a user or a plan, not both", ErrInvalidQuotaRule)
+	case rule.Provider == "" && rule.ModelPattern == "" && rule.Endpoint == "":
+		return fmt.Errorf("%w: a rule must match a provider, model or endpoint", ErrInvalidQuotaRule)
+	}
+	if _, err := path.Match(rule.ModelPattern, ""); err != nil {
+		return fmt.Errorf("%w: malformed model pattern", ErrInvalidQuotaRule)
+	}
+
+	// Rules of a missing user or plan would never apply
+	var plan *database.DBPlan
+	if rule.PlanID != nil {
+		plan = &database.DBPlan{}
+		err := s.db.First(plan, *rule.PlanID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: plan %d does not exist", ErrInvalidQuotaRule, *rule.PlanID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rule.UserID != nil {
+		var count int64
+		if err := s.db.Model(&database.DBUser{}).Where("id = ?", *rule.UserID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: user %s does not exist", ErrInvalidQuotaRule, *rule.UserID)
+		}
+	}
+
+	if rule.ID != 0 {
+		existing, err := s.GetRule(rule.ID)
+		if err != nil {
+			return err
+		}
+		rule.CreatedAt = existing.CreatedAt
+	}
+	if err := s.db.Omit("Plan").Save(rule).Error; err != nil {
+		return err
+	}
+	rule.Plan = plan
+	return nil
+}
+
+// DeleteRule deletes a quota rule. Calls it metered fall back to the next
+// most specific rule, or to the plan's token quotas.
+func (s *QuotaRuleService) DeleteRule(id uint) error {
+	result := s.db.Delete(&database.DBQuotaRule{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrQuotaRuleNotFound
+	}
+	return nil
+}
+
+// RulesFor returns the quota rules that may apply to a user on a plan
+func (s *QuotaRuleService) RulesFor(userID uuid.UUID, planID uint) ([]database.DBQuotaRule, error) {
+	var rules []database.DBQuotaRule
+	err := s.db.Where("user_id = ? OR plan_id = ? OR (user_id IS NULL AND plan_id IS NULL)", userID, planID).
+		Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
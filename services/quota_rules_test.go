@@ -0,0 +1,143 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestMatchRule_MostSpecificWins(t *testing.T) {
+	userID := uuid.New()
+	planID := uint(1)
+	rules := []database.DBQuotaRule{
+		{Provider: "azure"},
+		{ModelPattern: "gpt-4o*"},
+		{ModelPattern: "gpt-4o"},
+		{ModelPattern: "gpt-*"},
+		{Endpoint: EndpointMakeHTML},
+		{PlanID: &planID, Provider: "gemini"},
+		{UserID: &userID, ModelPattern: "gemini-*"},
+	}
+	for i := range rules {
+		rules[i].ID = uint(i + 1)
+	}
+
+	tests := []struct {
+		scope QuotaScope
+		want  uint
+	}{
+		{QuotaScope{Provider: "azure", Model: "gpt-4o"}, 3},
+		{QuotaScope{Provider: "azure", Model: "gpt-4o-mini"}, 2},
+		{QuotaScope{Provider: "azure", Model: "gpt-35-turbo"}, 4},
+		{QuotaScope{Provider: "azure", Model: "o1"}, 1},
+		{QuotaScope{Provider: "azure", Model: "gpt-4o", Endpoint: EndpointMakeHTML}, 5},
+		{QuotaScope{Provider: "gemini", Model: "claude", Endpoint: EndpointMakeHTML}, 6},
+		{QuotaScope{Provider: "gemini", Model: "gemini-2.0-flash", Endpoint: EndpointMakeHTML}, 7},
+		{QuotaScope{Provider: "other", Model: "other"}, 0},
+	}
+	for _, tt := range tests {
+		var got uint
+		if rule := matchRule(rules, tt.scope); rule != nil {
+			got = rule.ID
+		}
+		assert.Equal(t, tt.want, got, "%+v", tt.scope)
+	}
+}
+
+func TestReserve_QuotaRules(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	require.NoError(t, database.SeedModelPrices(db))
+	user := database.DBUser{Username: "erin", Email: "erin@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	quotas := NewTokenQuotaService(db)
+	rules := NewQuotaRuleService(db)
+
+	limited := 1_000
+	require.NoError(t, quotas.SetUserQuota(&database.DBTokenQuota{UserID: user.ID, DailyQuota: &limited}))
+	for _, rule := range []database.DBQuotaRule{
+		{Provider: "gemini", ModelPattern: "gemini-*-flash*"},
+		{ModelPattern: "gpt-4o", DailyTokens: 20_000},
+		{Endpoint: EndpointMakeHTML, DailyRequests: 2},
+	} {
+		require.NoError(t, rules.SaveRule(&rule))
+	}
+
+	// Flash calls outside make-html are unlimited and leave the daily quota alone
+	flash := QuotaScope{Provider: "gemini", Model: "gemini-2.0-flash", Endpoint: EndpointChatCompletions}
+	_, err := quotas.Reserve(user.ID, flash, 1_000_000)
+	require.NoError(t, err)
+	windows, err := quotas.GetScopeWindows(user.ID, flash, time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, windows)
+
+	// gpt-4o has its own 20k daily bucket, above the plan's quota
+	gpt4o := QuotaScope{Provider: "azure", Model: "gpt-4o", Endpoint: EndpointChatCompletions}
+	reservation, err := quotas.Reserve(user.ID, gpt4o, 15_000)
+	require.NoError(t, err)
+	_, err = quotas.Reserve(user.ID, gpt4o, 6_000)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+	// The call is accounted to the model it was made for, not the snapshot
+	// that answered it
+	_, err = quotas.Settle(reservation, CallUsage{Provider: "azure", Model: "gpt-4o", ModelVersion: "gpt-4o-2024-08-06", Endpoint: EndpointChatCompletions, PromptTokens: 4_000, CompletionTokens: 1_000})
+	require.NoError(t, err)
+
+	// Other models still use the plan's quota
+	require.NoError(t, quotas.UpdateUsage(user.ID, 1_000))
+	assert.ErrorIs(t, quotas.UpdateUsage(user.ID, 1), ErrDailyTokenQuotaExceeded)
+
+	// make-html is capped at two calls a day whatever the model
+	makeHTML := QuotaScope{Provider: "gemini", Model: "gemini-2.0-flash", Endpoint: EndpointMakeHTML}
+	for i := 0; i < 2; i++ {
+		reservation, err := quotas.Reserve(user.ID, makeHTML, 100)
+		require.NoError(t, err)
+		_, err = quotas.Settle(reservation, CallUsage{Provider: "gemini", Model: "gemini-2.0-flash", Endpoint: EndpointMakeHTML, PromptTokens: 60, CompletionTokens: 40})
+		require.NoError(t, err)
+	}
+	_, err = quotas.Reserve(user.ID, makeHTML, 100)
+	assert.ErrorIs(t, err, ErrDailyRequestQuotaExceeded)
+	var quotaErr *QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, WindowDailyRequests, quotaErr.Window.Name)
+
+	// Counters rebuilt from the ledger land in the same buckets
+	require.NoError(t, db.Where("1 = 1").Delete(&database.DBQuotaCounter{}).Error)
+	windows, err = quotas.GetScopeWindows(user.ID, gpt4o, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, WindowDailyTokens, windows[0].Name)
+	assert.Equal(t, int64(5_000), windows[0].Used)
+	windows, err = quotas.GetScopeWindows(user.ID, makeHTML, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, WindowDailyRequests, windows[0].Name)
+	assert.Equal(t, int64(2), windows[0].Used)
+	windows, err = quotas.GetWindows(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), windows[0].Used)
+}
+
+func TestSaveRule_Validation(t *testing.T) {
+	rules := NewQuotaRuleService(setupTestDB(t))
+	userID := uuid.New()
+	planID := uint(1)
+
+	assert.ErrorIs(t, rules.SaveRule(&database.DBQuotaRule{DailyTokens: 10}), ErrInvalidQuotaRule)
+	assert.ErrorIs(t, rules.SaveRule(&database.DBQuotaRule{UserID: &userID, PlanID: &planID, Provider: "azure"}), ErrInvalidQuotaRule)
+	assert.ErrorIs(t, rules.SaveRule(&database.DBQuotaRule{ModelPattern: "gpt-["}), ErrInvalidQuotaRule)
+	assert.ErrorIs(t, rules.SaveRule(&database.DBQuotaRule{UserID: &userID, Provider: "azure"}), ErrInvalidQuotaRule)
+	assert.ErrorIs(t, rules.SaveRule(&database.DBQuotaRule{PlanID: &planID, Provider: "azure"}), ErrInvalidQuotaRule)
+
+	rule := database.DBQuotaRule{ModelPattern: "gpt-4o", DailyTokens: 10}
+	require.NoError(t, rules.SaveRule(&rule))
+	rule.DailyTokens = 20
+	require.NoError(t, rules.SaveRule(&rule))
+	saved, err := rules.GetRule(rule.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 20, saved.DailyTokens)
+
+	require.NoError(t, rules.DeleteRule(rule.ID))
+	assert.ErrorIs(t, rules.DeleteRule(rule.ID), ErrQuotaRuleNotFound)
+}
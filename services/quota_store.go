@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// QuotaStore holds the counters of quota windows. All replicas of the API
+// must share a store for their limits to be consistent. Counters expire at
+// the time given when they are created; an expired counter reads as missing
+// and restarts from zero.
+type QuotaStore interface {
+	// Get returns the value of a counter and whether it exists
+	Get(ctx context.Context, key string) (int64, bool, error)
+	// Init creates a counter with a value unless it already exists
+	Init(ctx context.Context, key string, value int64, expiresAt time.Time) error
+	// IncrementWithLimit atomically adds delta to a counter, creating it at
+	// zero if it is missing, unless the result would exceed limit. A limit
+	// of zero or less, or a negative delta, never rejects. It returns the
+	// value of the counter and whether delta was added.
+	IncrementWithLimit(ctx context.Context, key string, delta, limit int64, expiresAt time.Time) (int64, bool, error)
+}
+
+// quotaStore is the store shared by every TokenQuotaService, nil to use a
+// SQL store on each service's database
+var quotaStore QuotaStore
+
+// SetQuotaStore sets the quota store shared by every TokenQuotaService. Pass
+// nil to keep the counters in the service's database.
+func SetQuotaStore(store QuotaStore) {
+	quotaStore = store
+}
+
+// SQLQuotaStore keeps quota counters in the database. Increments are
+// conditional updates, so limits hold across replicas sharing the database.
+type SQLQuotaStore struct {
+	db *gorm.DB
+}
+
+func NewSQLQuotaStore(db *gorm.DB) *SQLQuotaStore {
+	return &SQLQuotaStore{db: db}
+}
+
+func (s *SQLQuotaStore) Get(ctx context.Context, key string) (int64, bool, error) {
+	var counter database.DBQuotaCounter
+	err := s.db.WithContext(ctx).Where("name = ? AND expires_at > ?", key, time.Now().UTC()).First(&counter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return counter.Value, true, nil
+}
+
+func (s *SQLQuotaStore) Init(ctx context.Context, key string, value int64, expiresAt time.Time) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return initCounter(tx, key, value, expiresAt)
+	})
+}
+
+func (s *SQLQuotaStore) IncrementWithLimit(ctx context.Context, key string, delta, limit int64, expiresAt time.Time) (int64, bool, error) {
+	var value int64
+	var applied bool
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := initCounter(tx, key, 0, expiresAt); err != nil {
+			return err
+		}
+
+		update := tx.Model(&database.DBQuotaCounter{}).Where("name = ?", key)
+		if limit > 0 && delta > 0 {
+			update = update.Where("value + ? <= ?", delta, limit)
+		}
+		result := update.Update("value", gorm.Expr("value + ?", delta))
+		if result.Error != nil {
+			return result.Error
+		}
+		applied = result.RowsAffected == 1
+
+		return tx.Model(&database.DBQuotaCounter{}).Select("value").Where("name = ?", key).Scan(&value).Error
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return value, applied, nil
+}
+
+// initCounter creates a counter unless a live one exists, replacing it if it
+// expired
+func initCounter(tx *gorm.DB, key string, value int64, expiresAt time.Time) error {
+	err := tx.Model(&database.DBQuotaCounter{}).
+		Where("name = ? AND expires_at <= ?", key, time.Now().UTC()).
+		Updates(map[string]interface{}{"value": value, "expires_at": expiresAt.UTC()}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&database.DBQuotaCounter{Name: key, Value: value, ExpiresAt: expiresAt.UTC()}).Error
+}
+
+// PruneQuotaCounters deletes the expired counters of the SQL quota store
+func (s *MaintenanceService) PruneQuotaCounters(ctx context.Context, now time.Time) error {
+	return s.db.WithContext(ctx).Where("expires_at <= ?", now.UTC()).Delete(&database.DBQuotaCounter{}).Error
+}
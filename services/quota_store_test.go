@@ -0,0 +1,161 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+	"github.com/vhybZApp/api/redis"
+	"github.com/vhybZApp/api/redis/redistest"
+)
+
+func TestQuotaStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) QuotaStore{
+		"sql": func(t *testing.T) QuotaStore {
+			return NewSQLQuotaStore(setupTestDB(t))
+		},
+		"redis": func(t *testing.T) QuotaStore {
+			server := newRedisServer(t)
+			server.SetPassword("secret")
+			client := redis.NewClient(server.Addr, "secret")
+			t.Cleanup(func() { client.Close() })
+			return NewRedisQuotaStore(client)
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			expiresAt := time.Now().Add(time.Hour)
+
+			_, ok, err := store.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			// Init never overwrites a live counter
+			require.NoError(t, store.Init(ctx, "a", 40, expiresAt))
+			require.NoError(t, store.Init(ctx, "a", 99, expiresAt))
+			value, ok, err := store.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, int64(40), value)
+
+			value, ok, err = store.IncrementWithLimit(ctx, "a", 60, 100, expiresAt)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, int64(100), value)
+
+			value, ok, err = store.IncrementWithLimit(ctx, "a", 1, 100, expiresAt)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			assert.Equal(t, int64(100), value)
+
+			// Giving tokens back is never limited
+			value, ok, err = store.IncrementWithLimit(ctx, "a", -30, 50, expiresAt)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, int64(70), value)
+
+			// Expired counters restart from zero
+			require.NoError(t, store.Init(ctx, "b", 5, time.Now().Add(-time.Second)))
+			_, ok, err = store.Get(ctx, "b")
+			require.NoError(t, err)
+			assert.False(t, ok)
+			value, _, err = store.IncrementWithLimit(ctx, "b", 3, 0, expiresAt)
+			require.NoError(t, err)
+			assert.Equal(t, int64(3), value)
+
+			// Concurrent increments never exceed the limit
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			applied := 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, ok, err := store.IncrementWithLimit(ctx, "c", 10, 95, expiresAt)
+					assert.NoError(t, err)
+					if ok {
+						mu.Lock()
+						applied++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			value, _, err = store.Get(ctx, "c")
+			require.NoError(t, err)
+			assert.LessOrEqual(t, value, int64(95))
+			assert.Equal(t, int64(applied*10), value)
+		})
+	}
+}
+
+func TestTokenQuotaService_SharedRedisStore(t *testing.T) {
+	server := newRedisServer(t)
+	SetQuotaStore(NewRedisQuotaStore(redis.NewClient(server.Addr, "")))
+	defer SetQuotaStore(nil)
+
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	user := database.DBUser{Username: "dave", Email: "dave@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+
+	// Two replicas share the counters through the store
+	first, second := NewTokenQuotaService(db), NewTokenQuotaService(db)
+	_, err := first.Reserve(user.ID, QuotaScope{}, 60_000)
+	require.NoError(t, err)
+	_, err = second.Reserve(user.ID, QuotaScope{}, 60_000)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+
+	windows, err := second.GetWindows(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(60_000), windows[0].Used)
+
+	// A flushed store is rebuilt from the usage ledger
+	_, err = first.RecordUsage(user.ID, CallUsage{Provider: "azure", Model: "gpt-4o", PromptTokens: 700, CompletionTokens: 300})
+	require.NoError(t, err)
+	client := redis.NewClient(server.Addr, "")
+	_, err = client.Do(context.Background(), "FLUSHALL")
+	require.NoError(t, err)
+	windows, err = second.GetWindows(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_000), windows[0].Used)
+}
+
+// newRedisServer starts a fake Redis server running the quota store's
+// script
+func newRedisServer(t *testing.T) *redistest.Server {
+	server := redistest.NewServer()
+	t.Cleanup(server.Close)
+	server.HandleScript(incrementScript, func(call func(args ...string) (interface{}, error), keys, args []string) (interface{}, error) {
+		reply, err := call("GET", keys[0])
+		if err != nil {
+			return nil, err
+		}
+		var current int64
+		if reply != nil {
+			current, _ = strconv.ParseInt(reply.(string), 10, 64)
+		}
+		delta, _ := strconv.ParseInt(args[0], 10, 64)
+		limit, _ := strconv.ParseInt(args[1], 10, 64)
+		if limit > 0 && delta > 0 && current+delta > limit {
+			return []interface{}{current, int64(0)}, nil
+		}
+		value, err := call("INCRBY", keys[0], args[0])
+		if err != nil {
+			return nil, err
+		}
+		if _, err := call("PEXPIREAT", keys[0], args[2]); err != nil {
+			return nil, err
+		}
+		return []interface{}{value, int64(1)}, nil
+	})
+	return server
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Rate limit response headers. The unsuffixed headers describe the most
+// constrained window, and each window also gets its own set suffixed with
+// its name, e.g. X-RateLimit-Remaining-Daily-Tokens. Reset is the number of
+// seconds until the window resets.
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+	HeaderRetryAfter         = "Retry-After"
+)
+
+// SetRateLimitHeaders writes the rate limit headers of the given quota
+// windows. Nothing is written when there are no limited windows.
+func SetRateLimitHeaders(h http.Header, windows []QuotaWindow, now time.Time) {
+	if len(windows) == 0 {
+		return
+	}
+
+	tightest := windows[0]
+	for _, window := range windows {
+		suffix := "-" + headerSuffix(window.Name)
+		h.Set(HeaderRateLimitLimit+suffix, strconv.FormatInt(window.Limit, 10))
+		h.Set(HeaderRateLimitRemaining+suffix, strconv.FormatInt(window.Remaining(), 10))
+		h.Set(HeaderRateLimitReset+suffix, resetSeconds(window, now))
+		if tighter(window, tightest) {
+			tightest = window
+		}
+	}
+	h.Set(HeaderRateLimitLimit, strconv.FormatInt(tightest.Limit, 10))
+	h.Set(HeaderRateLimitRemaining, strconv.FormatInt(tightest.Remaining(), 10))
+	h.Set(HeaderRateLimitReset, resetSeconds(tightest, now))
+}
+
+// SetRetryAfter writes a Retry-After header if err is a quota rejection. It
+// reports whether the header was written.
+func SetRetryAfter(h http.Header, err error, now time.Time) bool {
+	var quotaErr *QuotaExceededError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	h.Set(HeaderRetryAfter, strconv.FormatInt(int64(quotaErr.RetryAfter(now)/time.Second), 10))
+	return true
+}
+
+// ReserveErrorStatus returns the HTTP status of an error from Reserve: 402
+// when the prepaid wallet is empty, 429 when a quota window is exceeded and
+// 500 otherwise
+func ReserveErrorStatus(err error) int {
+	var quotaErr *QuotaExceededError
+	switch {
+	case errors.Is(err, ErrInsufficientCredit):
+		return http.StatusPaymentRequired
+	case errors.As(err, &quotaErr):
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteRateLimitHeaders writes the rate limit headers of the quota windows
+// currently applying to a user's calls in the scope
+func (s *TokenQuotaService) WriteRateLimitHeaders(h http.Header, userID uuid.UUID, scope QuotaScope) error {
+	now := time.Now()
+	windows, err := s.GetScopeWindows(userID, scope, now)
+	if err != nil {
+		return err
+	}
+	SetRateLimitHeaders(h, windows, now)
+	return nil
+}
+
+// tighter reports whether window a has a smaller share of its limit left
+// than b, preferring the window that resets first on ties
+func tighter(a, b QuotaWindow) bool {
+	// Compare remaining/limit fractions without dividing
+	left, right := float64(a.Remaining())*float64(b.Limit), float64(b.Remaining())*float64(a.Limit)
+	if left != right {
+		return left < right
+	}
+	return a.End.Before(b.End)
+}
+
+// headerSuffix turns a window name such as daily_tokens into Daily-Tokens
+func headerSuffix(name string) string {
+	parts := strings.Split(name, "_")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func resetSeconds(window QuotaWindow, now time.Time) string {
+	return strconv.FormatInt(int64(ceilSeconds(window.End.Sub(now))/time.Second), 10)
+}
+
+// ceilSeconds rounds a duration up to the second, never below zero
+func ceilSeconds(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return (d + time.Second - 1).Truncate(time.Second)
+}
@@ -0,0 +1,60 @@
+package services
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestSetRateLimitHeaders_TightestWindow(t *testing.T) {
+	now := time.Date(2026, time.March, 10, 12, 0, 0, 0, time.UTC)
+	windows := []QuotaWindow{
+		{Name: WindowDailyTokens, Limit: 1_000, Used: 400, Start: now.Add(-12 * time.Hour), End: now.Add(12 * time.Hour)},
+		{Name: WindowMonthlyCost, Limit: 1_000_000, Used: 900_000, Start: now.AddDate(0, 0, -9), End: now.AddDate(0, 0, 21)},
+	}
+
+	h := http.Header{}
+	SetRateLimitHeaders(h, windows, now)
+	assert.Equal(t, "1000", h.Get("X-RateLimit-Limit-Daily-Tokens"))
+	assert.Equal(t, "600", h.Get("X-RateLimit-Remaining-Daily-Tokens"))
+	assert.Equal(t, "43200", h.Get("X-RateLimit-Reset-Daily-Tokens"))
+	assert.Equal(t, "100000", h.Get("X-RateLimit-Remaining-Monthly-Cost"))
+
+	// The monthly budget has 10% left, less than the daily tokens' 60%
+	assert.Equal(t, "1000000", h.Get(HeaderRateLimitLimit))
+	assert.Equal(t, "100000", h.Get(HeaderRateLimitRemaining))
+	assert.Equal(t, "1814400", h.Get(HeaderRateLimitReset))
+
+	h = http.Header{}
+	SetRateLimitHeaders(h, nil, now)
+	assert.Empty(t, h)
+}
+
+func TestUpdateUsage_QuotaExceededRetryAfter(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	user := database.DBUser{Username: "bob", Email: "bob@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+
+	quotas := NewTokenQuotaService(db)
+	require.NoError(t, quotas.UpdateUsage(user.ID, 99_500))
+	err := quotas.UpdateUsage(user.ID, 1_000)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+
+	var quotaErr *QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, WindowDailyTokens, quotaErr.Window.Name)
+	assert.Equal(t, int64(500), quotaErr.Window.Remaining())
+
+	now := time.Now()
+	h := http.Header{}
+	require.True(t, SetRetryAfter(h, err, now))
+	_, end := DayWindow(now.UTC())
+	assert.Equal(t, ceilSeconds(end.Sub(now)), quotaErr.RetryAfter(now))
+	assert.NotEmpty(t, h.Get(HeaderRetryAfter))
+	assert.False(t, SetRetryAfter(http.Header{}, ErrInsufficientCredit, now))
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/vhybZApp/api/redis"
+)
+
+// RedisQuotaStore keeps quota counters in Redis, or any server speaking its
+// protocol, shared by every replica. It needs Redis 6.2 or later.
+type RedisQuotaStore struct {
+	client *redis.Client
+	// prefix namespaces the keys of the store
+	prefix string
+}
+
+func NewRedisQuotaStore(client *redis.Client) *RedisQuotaStore {
+	return &RedisQuotaStore{client: client, prefix: "vhybz:"}
+}
+
+func (s *RedisQuotaStore) Get(ctx context.Context, key string) (int64, bool, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if errors.Is(err, redis.ErrNil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	value, err := strconv.ParseInt(reply.(string), 10, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+func (s *RedisQuotaStore) Init(ctx context.Context, key string, value int64, expiresAt time.Time) error {
+	_, err := s.client.Do(ctx, "SET", s.prefix+key, strconv.FormatInt(value, 10), "NX", "PXAT", unixMilli(expiresAt))
+	if errors.Is(err, redis.ErrNil) {
+		// The counter already exists
+		return nil
+	}
+	return err
+}
+
+// incrementScript adds ARGV[1] to the counter KEYS[1] unless the result
+// would exceed the limit ARGV[2], and sets its expiry to ARGV[3] in unix
+// milliseconds. It replies with the value of the counter and 1 if the delta
+// was added, 0 if not. Deltas are passed to INCRBY as sent, since Lua
+// numbers lose precision when formatted back into arguments.
+const incrementScript = `
+local current = tonumber(redis.call('GET', KEYS[1]) or '0')
+local delta = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+if limit > 0 and delta > 0 and current + delta > limit then
+	return {current, 0}
+end
+local value = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+return {value, 1}
+`
+
+// IncrementWithLimit runs incrementScript, which Redis runs atomically, so
+// concurrent callers never see each other's rejected increments
+func (s *RedisQuotaStore) IncrementWithLimit(ctx context.Context, key string, delta, limit int64, expiresAt time.Time) (int64, bool, error) {
+	reply, err := s.client.Do(ctx, "EVAL", incrementScript, "1", s.prefix+key,
+		strconv.FormatInt(delta, 10), strconv.FormatInt(limit, 10), unixMilli(expiresAt))
+	if err != nil {
+		return 0, false, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("redis: unexpected reply %v to the increment script", reply)
+	}
+	value, ok := values[0].(int64)
+	if !ok {
+		return 0, false, fmt.Errorf("redis: unexpected counter value %v", values[0])
+	}
+	return value, values[1] == int64(1), nil
+}
+
+func unixMilli(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
@@ -0,0 +1,348 @@
+package services
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvoiceNotFound is returned when an invoice does not exist
+	ErrInvoiceNotFound = errors.New("invoice not found")
+	// ErrInvoiceClosed is returned when changing an invoice that is closed
+	ErrInvoiceClosed = errors.New("invoice is closed")
+	// ErrInvoiceMonthNotOver is returned when closing an invoice before its month ends
+	ErrInvoiceMonthNotOver = errors.New("invoice month has not ended")
+)
+
+// StatementLine is the usage of one owner, provider and model in a usage
+// statement. Owners are users or organizations.
+type StatementLine struct {
+	OwnerType        string    `json:"owner_type"`
+	OwnerID          uuid.UUID `json:"owner_id"`
+	OwnerName        string    `json:"owner_name"`
+	Provider         string    `json:"provider"`
+	Model            string    `json:"model"`
+	Requests         int       `json:"requests"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	TotalTokens      int       `json:"total_tokens"`
+	Cost             int64     `json:"cost"` // Micro-dollars
+}
+
+// userUsage is the usage of one user, provider and model, along with the
+// organization the user belongs to
+type userUsage struct {
+	UserID           uuid.UUID
+	Username         string
+	OrganizationID   *uuid.UUID
+	OrganizationName string
+	Provider         string
+	ModelName        string
+	Requests         int
+	PromptTokens     int
+	CompletionTokens int
+	TotalTokens      int
+	Cost             int64
+}
+
+// owner returns who a user's usage is billed to: their organization when
+// grouping by organization and they belong to one, themselves otherwise
+func (u userUsage) owner(groupBy string) (string, uuid.UUID, string) {
+	if groupBy == database.WalletOwnerOrganization && u.OrganizationID != nil {
+		return database.WalletOwnerOrganization, *u.OrganizationID, u.OrganizationName
+	}
+	return database.WalletOwnerUser, u.UserID, u.Username
+}
+
+type ReportService struct {
+	db *gorm.DB
+}
+
+func NewReportService(db *gorm.DB) *ReportService {
+	return &ReportService{db: db}
+}
+
+// UsageStatement returns the usage recorded in [from, to) grouped by owner,
+// provider and model. groupBy is user or organization; when grouping by
+// organization, the usage of members is billed to their current organization
+// and users without one are listed on their own. When tags are given, only
+// calls carrying all of them are counted. Statements are built from the raw
+// usage records, so they only cover the usage retention period.
+func (s *ReportService) UsageStatement(from, to time.Time, groupBy string, tags map[string]string) ([]StatementLine, error) {
+	if groupBy != database.WalletOwnerUser && groupBy != database.WalletOwnerOrganization {
+		return nil, fmt.Errorf("unknown report grouping %q", groupBy)
+	}
+
+	usage, err := s.usageByUser(from, to, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct {
+		ownerType string
+		ownerID   uuid.UUID
+		provider  string
+		model     string
+	}
+	lines := make(map[key]*StatementLine)
+	for _, u := range usage {
+		ownerType, ownerID, ownerName := u.owner(groupBy)
+		k := key{ownerType, ownerID, u.Provider, u.ModelName}
+		line, ok := lines[k]
+		if !ok {
+			line = &StatementLine{OwnerType: ownerType, OwnerID: ownerID, OwnerName: ownerName, Provider: u.Provider, Model: u.ModelName}
+			lines[k] = line
+		}
+		line.Requests += u.Requests
+		line.PromptTokens += u.PromptTokens
+		line.CompletionTokens += u.CompletionTokens
+		line.TotalTokens += u.TotalTokens
+		line.Cost += u.Cost
+	}
+
+	statement := make([]StatementLine, 0, len(lines))
+	for _, line := range lines {
+		statement = append(statement, *line)
+	}
+	sort.Slice(statement, func(a, b int) bool {
+		x, y := statement[a], statement[b]
+		if x.OwnerType != y.OwnerType {
+			return x.OwnerType < y.OwnerType
+		}
+		if x.OwnerName != y.OwnerName {
+			return x.OwnerName < y.OwnerName
+		}
+		if x.OwnerID != y.OwnerID {
+			return x.OwnerID.String() < y.OwnerID.String()
+		}
+		if x.Provider != y.Provider {
+			return x.Provider < y.Provider
+		}
+		return x.Model < y.Model
+	})
+	return statement, nil
+}
+
+// usageByUser sums the usage records in [from, to) carrying all the given
+// tags per user, provider and model
+func (s *ReportService) usageByUser(from, to time.Time, tags map[string]string) ([]userUsage, error) {
+	query := s.db.Model(&database.DBUsageRecord{})
+	for key, value := range tags {
+		query = query.Where("EXISTS (SELECT 1 FROM db_usage_tags WHERE db_usage_tags.usage_record_id = db_usage_records.id "+
+			"AND db_usage_tags.key = ? AND db_usage_tags.value = ?)", key, value)
+	}
+
+	var usage []userUsage
+	err := query.
+		Select("db_usage_records.user_id, db_users.username, db_users.organization_id, "+
+			"db_organizations.name AS organization_name, db_usage_records.provider, db_usage_records.model_name, "+
+			"COUNT(*) AS requests, SUM(db_usage_records.prompt_tokens) AS prompt_tokens, "+
+			"SUM(db_usage_records.completion_tokens) AS completion_tokens, "+
+			"SUM(db_usage_records.total_tokens) AS total_tokens, SUM(db_usage_records.cost) AS cost").
+		Joins("LEFT JOIN db_users ON db_users.id = db_usage_records.user_id").
+		Joins("LEFT JOIN db_organizations ON db_organizations.id = db_users.organization_id").
+		Where("db_usage_records.created_at >= ? AND db_usage_records.created_at < ?", from.UTC(), to.UTC()).
+		Group("db_usage_records.user_id, db_users.username, db_users.organization_id, db_organizations.name, " +
+			"db_usage_records.provider, db_usage_records.model_name").
+		Order("db_usage_records.user_id, db_usage_records.provider, db_usage_records.model_name").
+		Scan(&usage).Error
+	return usage, err
+}
+
+// WriteStatementCSV writes a usage statement as CSV with a header row. Costs
+// are written both in micro-dollars and in dollars.
+func WriteStatementCSV(w io.Writer, statement []StatementLine) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{
+		"owner_type", "owner_id", "owner_name", "provider", "model", "requests",
+		"prompt_tokens", "completion_tokens", "total_tokens", "cost_micros", "cost_usd",
+	}); err != nil {
+		return err
+	}
+	for _, line := range statement {
+		if err := writer.Write([]string{
+			line.OwnerType,
+			line.OwnerID.String(),
+			line.OwnerName,
+			line.Provider,
+			line.Model,
+			strconv.Itoa(line.Requests),
+			strconv.Itoa(line.PromptTokens),
+			strconv.Itoa(line.CompletionTokens),
+			strconv.Itoa(line.TotalTokens),
+			strconv.FormatInt(line.Cost, 10),
+			FormatDollars(line.Cost),
+		}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// FormatDollars formats micro-dollars as dollars without rounding
+func FormatDollars(micros int64) string {
+	sign := ""
+	if micros < 0 {
+		sign, micros = "-", -micros
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, micros/1_000_000, micros%1_000_000)
+}
+
+// MonthStart returns the start of the UTC calendar month containing t
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// GenerateInvoices snapshots the usage of a UTC calendar month into one
+// invoice per billing owner: the user's organization if they belong to one,
+// the user otherwise. Open invoices are recomputed, closed ones are left
+// untouched.
+func (s *ReportService) GenerateInvoices(month time.Time) ([]database.DBInvoice, error) {
+	month = MonthStart(month)
+	usage, err := s.usageByUser(month, month.AddDate(0, 1, 0), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	type owner struct {
+		ownerType string
+		ownerID   uuid.UUID
+	}
+	var owners []owner
+	linesByOwner := make(map[owner][]database.DBInvoiceLine)
+	for _, u := range usage {
+		ownerType, ownerID, _ := u.owner(database.WalletOwnerOrganization)
+		o := owner{ownerType, ownerID}
+		if _, ok := linesByOwner[o]; !ok {
+			owners = append(owners, o)
+		}
+		linesByOwner[o] = append(linesByOwner[o], database.DBInvoiceLine{
+			UserID:           u.UserID,
+			Username:         u.Username,
+			Provider:         u.Provider,
+			ModelName:        u.ModelName,
+			Requests:         u.Requests,
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			TotalTokens:      u.TotalTokens,
+			Cost:             u.Cost,
+		})
+	}
+
+	sort.Slice(owners, func(a, b int) bool {
+		if owners[a].ownerType != owners[b].ownerType {
+			return owners[a].ownerType < owners[b].ownerType
+		}
+		return owners[a].ownerID.String() < owners[b].ownerID.String()
+	})
+
+	invoices := make([]database.DBInvoice, 0, len(owners))
+	for _, o := range owners {
+		invoice, err := s.saveInvoice(o.ownerType, o.ownerID, month, linesByOwner[o])
+		if errors.Is(err, ErrInvoiceClosed) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		invoices = append(invoices, *invoice)
+	}
+	return invoices, nil
+}
+
+// saveInvoice creates or replaces the open invoice of an owner for a month
+func (s *ReportService) saveInvoice(ownerType string, ownerID uuid.UUID, month time.Time, lines []database.DBInvoiceLine) (*database.DBInvoice, error) {
+	var invoice database.DBInvoice
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("owner_type = ? AND owner_id = ? AND month = ?", ownerType, ownerID, month).First(&invoice).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			invoice = database.DBInvoice{OwnerType: ownerType, OwnerID: ownerID, Month: month, Status: database.InvoiceStatusOpen}
+			if err := tx.Create(&invoice).Error; err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case invoice.Status == database.InvoiceStatusClosed:
+			return ErrInvoiceClosed
+		default:
+			if err := tx.Where("invoice_id = ?", invoice.ID).Delete(&database.DBInvoiceLine{InvoiceID: invoice.ID}).Error; err != nil {
+				return err
+			}
+		}
+
+		invoice.Requests, invoice.TotalTokens, invoice.Cost = 0, 0, 0
+		for i := range lines {
+			lines[i].InvoiceID = invoice.ID
+			invoice.Requests += lines[i].Requests
+			invoice.TotalTokens += lines[i].TotalTokens
+			invoice.Cost += lines[i].Cost
+		}
+		if len(lines) > 0 {
+			if err := tx.Create(&lines).Error; err != nil {
+				return err
+			}
+		}
+		invoice.Lines = lines
+		return tx.Omit("Lines").Save(&invoice).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// ListInvoices returns the invoices of a UTC calendar month, without lines
+func (s *ReportService) ListInvoices(month time.Time) ([]database.DBInvoice, error) {
+	var invoices []database.DBInvoice
+	err := s.db.Where("month = ?", MonthStart(month)).Order("owner_type, owner_id").Find(&invoices).Error
+	return invoices, err
+}
+
+// GetInvoice returns an invoice with its lines
+func (s *ReportService) GetInvoice(id uint) (*database.DBInvoice, error) {
+	var invoice database.DBInvoice
+	if err := s.db.Preload("Lines", func(db *gorm.DB) *gorm.DB {
+		return db.Order("username, provider, model_name")
+	}).First(&invoice, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvoiceNotFound
+		}
+		return nil, err
+	}
+	return &invoice, nil
+}
+
+// CloseInvoice closes an invoice once its month is over, after which it can
+// no longer change
+func (s *ReportService) CloseInvoice(id uint, now time.Time) (*database.DBInvoice, error) {
+	invoice, err := s.GetInvoice(id)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.Status == database.InvoiceStatusClosed {
+		return nil, ErrInvoiceClosed
+	}
+	if now.Before(invoice.Month.AddDate(0, 1, 0)) {
+		return nil, ErrInvoiceMonthNotOver
+	}
+
+	closedAt := now.UTC()
+	invoice.Status = database.InvoiceStatusClosed
+	invoice.ClosedAt = &closedAt
+	if err := s.db.Model(invoice).Select("status", "closed_at").Updates(invoice).Error; err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
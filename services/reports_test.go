@@ -0,0 +1,101 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestUsageStatementAndInvoices(t *testing.T) {
+	db := setupTestDB(t)
+	organization, err := NewOrganizationService(db).CreateOrganization("acme", "")
+	require.NoError(t, err)
+	alice := database.DBUser{Username: "alice", Email: "alice@example.com", Password: "x", OrganizationID: &organization.ID}
+	bob := database.DBUser{Username: "bob", Email: "bob@example.com", Password: "x", OrganizationID: &organization.ID}
+	carol := database.DBUser{Username: "carol", Email: "carol@example.com", Password: "x"}
+	require.NoError(t, db.Create(&[]*database.DBUser{&alice, &bob, &carol}).Error)
+
+	october := time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	records := []database.DBUsageRecord{
+		{UserID: alice.ID, Provider: "azure", ModelName: "gpt-4o", PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150, Cost: 1_500_000,
+			Tags: usageTags(map[string]string{"feature": "search", "environment": "prod"})},
+		{UserID: bob.ID, Provider: "azure", ModelName: "gpt-4o", PromptTokens: 10, CompletionTokens: 5, TotalTokens: 15, Cost: 150,
+			Tags: usageTags(map[string]string{"feature": "search", "environment": "staging"})},
+		{UserID: carol.ID, Provider: "gemini", ModelName: "gemini-2.0-flash", PromptTokens: 1, CompletionTokens: 1, TotalTokens: 2, Cost: 1},
+		{UserID: carol.ID, Provider: "gemini", ModelName: "gemini-2.0-flash", PromptTokens: 7, CompletionTokens: 0, TotalTokens: 7, Cost: 3},
+	}
+	for i := range records {
+		records[i].CreatedAt = october.AddDate(0, 0, i)
+	}
+	records[3].CreatedAt = october.AddDate(0, 1, 0) // November
+	require.NoError(t, db.Create(&records).Error)
+
+	reports := NewReportService(db)
+	statement, err := reports.UsageStatement(october, october.AddDate(0, 1, 0), database.WalletOwnerOrganization, nil)
+	require.NoError(t, err)
+	require.Len(t, statement, 2)
+	assert.Equal(t, "acme", statement[0].OwnerName)
+	assert.Equal(t, 2, statement[0].Requests)
+	assert.Equal(t, int64(1_500_150), statement[0].Cost)
+	assert.Equal(t, "carol", statement[1].OwnerName)
+	assert.Equal(t, 2, statement[1].TotalTokens)
+
+	statement, err = reports.UsageStatement(october, october.AddDate(0, 2, 0), database.WalletOwnerUser, nil)
+	require.NoError(t, err)
+	require.Len(t, statement, 3)
+	assert.Equal(t, 9, statement[2].TotalTokens)
+
+	// Tag filters only count the calls carrying every tag
+	statement, err = reports.UsageStatement(october, october.AddDate(0, 2, 0), database.WalletOwnerUser, map[string]string{"feature": "search"})
+	require.NoError(t, err)
+	require.Len(t, statement, 2)
+	statement, err = reports.UsageStatement(october, october.AddDate(0, 2, 0), database.WalletOwnerUser, map[string]string{"feature": "search", "environment": "prod"})
+	require.NoError(t, err)
+	require.Len(t, statement, 1)
+	assert.Equal(t, "alice", statement[0].OwnerName)
+
+	var csv bytes.Buffer
+	require.NoError(t, WriteStatementCSV(&csv, statement[:1]))
+	rows := strings.Split(strings.TrimSpace(csv.String()), "\n")
+	require.Len(t, rows, 2)
+	assert.True(t, strings.HasSuffix(rows[1], ",150,1500000,1.500000"), rows[1])
+
+	// Invoices are billed per organization, with a line per member
+	invoices, err := reports.GenerateInvoices(october.AddDate(0, 0, 12))
+	require.NoError(t, err)
+	require.Len(t, invoices, 2)
+	acme, err := reports.GetInvoice(invoices[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, database.WalletOwnerOrganization, acme.OwnerType)
+	assert.Len(t, acme.Lines, 2)
+	assert.Equal(t, int64(1_500_150), acme.Cost)
+
+	_, err = reports.CloseInvoice(acme.ID, october.AddDate(0, 0, 20))
+	assert.ErrorIs(t, err, ErrInvoiceMonthNotOver)
+	_, err = reports.CloseInvoice(acme.ID, october.AddDate(0, 1, 1))
+	require.NoError(t, err)
+
+	// Late usage only changes the invoices that are still open
+	late := database.DBUsageRecord{UserID: alice.ID, Provider: "azure", ModelName: "gpt-4o", TotalTokens: 1, Cost: 10}
+	late.CreatedAt = october.AddDate(0, 0, 30)
+	require.NoError(t, db.Create(&late).Error)
+	invoices, err = reports.GenerateInvoices(october)
+	require.NoError(t, err)
+	require.Len(t, invoices, 1)
+	assert.Equal(t, database.WalletOwnerUser, invoices[0].OwnerType)
+
+	acme, err = reports.GetInvoice(acme.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_500_150), acme.Cost)
+
+	// Closed invoices cannot be changed behind the service's back either
+	acme.Cost = 0
+	assert.ErrorIs(t, db.Save(acme).Error, database.ErrImmutable)
+	assert.ErrorIs(t, db.Delete(&acme.Lines[0]).Error, database.ErrImmutable)
+	assert.ErrorIs(t, db.Delete(acme).Error, database.ErrImmutable)
+}
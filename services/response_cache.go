@@ -0,0 +1,145 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ResponseCache holds provider responses by request key. Entries expire at
+// the time given when they are stored, and the least recently used ones are
+// evicted once the cache is full.
+type ResponseCache interface {
+	// Get returns the response stored under key and whether there is one
+	Get(ctx context.Context, key string) ([]byte, bool, error)
+	// Set stores a response under key, replacing any previous one
+	Set(ctx context.Context, key string, value []byte, expiresAt time.Time) error
+}
+
+// MemoryResponseCache keeps responses in the memory of the replica. It is
+// safe for concurrent use.
+type MemoryResponseCache struct {
+	maxEntries int
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order holds the entries, most recently used first
+	order *list.List
+}
+
+type memoryCacheEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewMemoryResponseCache returns a cache of at most maxEntries responses
+func NewMemoryResponseCache(maxEntries int) *MemoryResponseCache {
+	return &MemoryResponseCache{
+		maxEntries: max(maxEntries, 1),
+		now:        time.Now,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (c *MemoryResponseCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, nil
+	}
+	entry := element.Value.(*memoryCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return nil, false, nil
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true, nil
+}
+
+func (c *MemoryResponseCache) Set(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*memoryCacheEntry)
+		entry.value, entry.expiresAt = value, expiresAt
+		c.order.MoveToFront(element)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&memoryCacheEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+// SQLResponseCache keeps responses in the database, shared by the replicas
+// using it. Expired entries are deleted by the prune job.
+type SQLResponseCache struct {
+	db         *gorm.DB
+	maxEntries int
+}
+
+// NewSQLResponseCache returns a cache of at most maxEntries responses in db
+func NewSQLResponseCache(db *gorm.DB, maxEntries int) *SQLResponseCache {
+	return &SQLResponseCache{db: db, maxEntries: max(maxEntries, 1)}
+}
+
+func (c *SQLResponseCache) Get(ctx context.Context, key string) ([]byte, bool, error) {
+	now := time.Now().UTC()
+	var entry database.DBResponseCacheEntry
+	err := c.db.WithContext(ctx).Where("name = ? AND expires_at > ?", key, now).First(&entry).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	err = c.db.WithContext(ctx).Model(&database.DBResponseCacheEntry{}).Where("name = ?", key).Update("used_at", now).Error
+	if err != nil {
+		return nil, false, err
+	}
+	return entry.Value, true, nil
+}
+
+func (c *SQLResponseCache) Set(ctx context.Context, key string, value []byte, expiresAt time.Time) error {
+	now := time.Now().UTC()
+	return c.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "name"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "expires_at", "used_at"}),
+		}).Create(&database.DBResponseCacheEntry{Name: key, Value: value, ExpiresAt: expiresAt.UTC(), UsedAt: now}).Error
+		if err != nil {
+			return err
+		}
+
+		// Evict the least recently used entries past the limit
+		var count int64
+		if err := tx.Model(&database.DBResponseCacheEntry{}).Count(&count).Error; err != nil {
+			return err
+		}
+		if count <= int64(c.maxEntries) {
+			return nil
+		}
+		oldest := tx.Model(&database.DBResponseCacheEntry{}).Select("name").Order("used_at").Limit(int(count) - c.maxEntries)
+		return tx.Where("name IN (?)", oldest).Delete(&database.DBResponseCacheEntry{}).Error
+	})
+}
+
+// PruneResponseCache deletes the expired entries of the SQL response cache
+func (s *MaintenanceService) PruneResponseCache(ctx context.Context, now time.Time) error {
+	return s.db.WithContext(ctx).Where("expires_at <= ?", now.UTC()).Delete(&database.DBResponseCacheEntry{}).Error
+}
@@ -0,0 +1,76 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestResponseCaches(t *testing.T) {
+	caches := map[string]func(t *testing.T) ResponseCache{
+		"memory": func(t *testing.T) ResponseCache {
+			return NewMemoryResponseCache(2)
+		},
+		"sql": func(t *testing.T) ResponseCache {
+			return NewSQLResponseCache(setupTestDB(t), 2)
+		},
+	}
+
+	for name, newCache := range caches {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			cache := newCache(t)
+			expiresAt := time.Now().Add(time.Hour)
+
+			_, ok, err := cache.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.False(t, ok)
+
+			require.NoError(t, cache.Set(ctx, "a", []byte("1"), expiresAt))
+			require.NoError(t, cache.Set(ctx, "a", []byte("2"), expiresAt))
+			value, ok, err := cache.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, "2", string(value))
+
+			// Reading a keeps it over b, evicted by c
+			require.NoError(t, cache.Set(ctx, "b", []byte("3"), expiresAt))
+			time.Sleep(10 * time.Millisecond)
+			_, ok, err = cache.Get(ctx, "a")
+			require.NoError(t, err)
+			assert.True(t, ok)
+			require.NoError(t, cache.Set(ctx, "c", []byte("4"), expiresAt))
+			for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+				_, ok, err := cache.Get(ctx, key)
+				require.NoError(t, err)
+				assert.Equal(t, want, ok, key)
+			}
+
+			// Expired entries read as missing
+			require.NoError(t, cache.Set(ctx, "d", []byte("5"), time.Now().Add(-time.Second)))
+			_, ok, err = cache.Get(ctx, "d")
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestPruneResponseCache(t *testing.T) {
+	db := setupTestDB(t)
+	ctx := context.Background()
+	cache := NewSQLResponseCache(db, 10)
+	now := time.Now()
+	for i, expiresAt := range []time.Time{now.Add(-time.Minute), now.Add(time.Minute)} {
+		require.NoError(t, cache.Set(ctx, fmt.Sprint(i), []byte("{}"), expiresAt))
+	}
+
+	require.NoError(t, NewMaintenanceService(db).PruneResponseCache(ctx, now))
+	var names []string
+	require.NoError(t, db.Model(&database.DBResponseCacheEntry{}).Pluck("name", &names).Error)
+	assert.Equal(t, []string{"1"}, names)
+}
@@ -1,7 +1,9 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"log"
 	"time"
 
 	"github.com/google/uuid"
@@ -9,39 +11,160 @@ import (
 	"gorm.io/gorm"
 )
 
+var (
+	// ErrDailyTokenQuotaExceeded is returned when a user has used up their daily tokens
+	ErrDailyTokenQuotaExceeded = errors.New("daily token quota exceeded")
+	// ErrDailyCostBudgetExceeded is returned when a user has spent their daily budget
+	ErrDailyCostBudgetExceeded = errors.New("daily cost budget exceeded")
+	// ErrMonthlyTokenQuotaExceeded is returned when a user has used up their monthly tokens
+	ErrMonthlyTokenQuotaExceeded = errors.New("monthly token quota exceeded")
+	// ErrMonthlyCostBudgetExceeded is returned when a user has spent their monthly budget
+	ErrMonthlyCostBudgetExceeded = errors.New("monthly cost budget exceeded")
+	// ErrDailyRequestQuotaExceeded is returned when a user has made all the calls a quota rule allows in a day
+	ErrDailyRequestQuotaExceeded = errors.New("daily request quota exceeded")
+)
+
+// CallUsage describes the tokens consumed by a single upstream call
+type CallUsage struct {
+	Provider string
+	// Model is the model the call was made for, the one quota rules match
+	Model string
+	// ModelVersion is the model the provider reports answering with, e.g. a
+	// dated snapshot of Model. It is priced in place of Model when set.
+	ModelVersion     string
+	Endpoint         string
+	PromptTokens     int
+	CompletionTokens int
+	// Tags attribute the cost of the call, e.g. to a feature or customer
+	Tags map[string]string
+}
+
+// Scope returns the quota scope of the call
+func (c CallUsage) Scope() QuotaScope {
+	return QuotaScope{Provider: c.Provider, Model: c.Model, Endpoint: c.Endpoint}
+}
+
 type TokenQuotaService struct {
-	db *gorm.DB
+	db    *gorm.DB
+	store QuotaStore
 }
 
+// NewTokenQuotaService returns a service enforcing quotas with the shared
+// quota store, or with counters in db when none is set
 func NewTokenQuotaService(db *gorm.DB) *TokenQuotaService {
-	return &TokenQuotaService{db: db}
+	store := quotaStore
+	if store == nil {
+		store = NewSQLQuotaStore(db)
+	}
+	return &TokenQuotaService{db: db, store: store}
 }
 
-// GetUserQuota returns the daily token quota for a user
+// GetUserQuota returns the quota override of a user, or nil if the user has none
 func (s *TokenQuotaService) GetUserQuota(userID uuid.UUID) (*database.DBTokenQuota, error) {
 	var quota database.DBTokenQuota
 	result := s.db.Where("user_id = ?", userID).First(&quota)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-			// Create default quota if not exists
-			quota = database.DBTokenQuota{
-				UserID:     userID,
-				DailyQuota: 100000, // Default 100k tokens per day
-			}
-			if err := s.db.Create(&quota).Error; err != nil {
-				return nil, err
-			}
-		} else {
-			return nil, result.Error
+			return nil, nil
 		}
+		return nil, result.Error
 	}
 	return &quota, nil
 }
 
-// GetDailyUsage returns the token usage for a user on a specific date
+// SetUserQuota replaces the quota override of a user
+func (s *TokenQuotaService) SetUserQuota(quota *database.DBTokenQuota) error {
+	existing, err := s.GetUserQuota(quota.UserID)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		quota.ID = existing.ID
+		quota.CreatedAt = existing.CreatedAt
+	}
+	return s.db.Omit("User").Save(quota).Error
+}
+
+// GetLimits returns the effective limits of a user: the user's quota override
+// where set, and their active plan otherwise
+func (s *TokenQuotaService) GetLimits(userID uuid.UUID) (*QuotaLimits, error) {
+	plan, err := NewPlanService(s.db).ActivePlan(userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	limits := &QuotaLimits{
+		Plan:              plan.Name,
+		PlanID:            plan.ID,
+		DailyQuota:        plan.DailyQuota,
+		MonthlyQuota:      plan.MonthlyQuota,
+		DailyCostBudget:   plan.DailyCostBudget,
+		MonthlyCostBudget: plan.MonthlyCostBudget,
+		AllowedModels:     splitList(plan.AllowedModels),
+		Features:          splitList(plan.Features),
+	}
+
+	override, err := s.GetUserQuota(userID)
+	if err != nil {
+		return nil, err
+	}
+	if override != nil {
+		if override.DailyQuota != nil {
+			limits.DailyQuota = *override.DailyQuota
+		}
+		if override.MonthlyQuota != nil {
+			limits.MonthlyQuota = *override.MonthlyQuota
+		}
+		if override.DailyCostBudget != nil {
+			limits.DailyCostBudget = *override.DailyCostBudget
+		}
+		if override.MonthlyCostBudget != nil {
+			limits.MonthlyCostBudget = *override.MonthlyCostBudget
+		}
+		if override.AllowedModels != nil {
+			limits.AllowedModels = splitList(*override.AllowedModels)
+		}
+	}
+
+	// Temporary boosts add to a limited daily quota until they expire
+	if limits.DailyQuota > 0 {
+		var boost int
+		if err := s.db.Model(&database.DBQuotaBoost{}).
+			Select("COALESCE(SUM(daily_tokens), 0)").
+			Where("user_id = ? AND expires_at > ?", userID, time.Now().UTC()).
+			Scan(&boost).Error; err != nil {
+			return nil, err
+		}
+		limits.DailyQuota += boost
+	}
+	return limits, nil
+}
+
+// GrantBoost temporarily grants a user extra daily tokens
+func (s *TokenQuotaService) GrantBoost(userID uuid.UUID, dailyTokens int, expiresAt time.Time, reason string) (*database.DBQuotaBoost, error) {
+	boost := database.DBQuotaBoost{
+		UserID:      userID,
+		DailyTokens: dailyTokens,
+		ExpiresAt:   expiresAt.UTC(),
+		Reason:      reason,
+	}
+	if err := s.db.Create(&boost).Error; err != nil {
+		return nil, err
+	}
+	return &boost, nil
+}
+
+// GetDailyUsage returns the token usage for a user on the day containing date
+// in the user's timezone
 func (s *TokenQuotaService) GetDailyUsage(userID uuid.UUID, date time.Time) (*database.DBTokenUsage, error) {
+	loc, err := UserLocation(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+
 	var usage database.DBTokenUsage
-	startOfDay := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
+	startOfDay, _ := DayWindow(date.In(loc))
+	startOfDay = startOfDay.UTC()
 	result := s.db.Where("user_id = ? AND date = ?", userID, startOfDay).First(&usage)
 	if result.Error != nil {
 		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
@@ -61,37 +184,260 @@ func (s *TokenQuotaService) GetDailyUsage(userID uuid.UUID, date time.Time) (*da
 	return &usage, nil
 }
 
-// UpdateUsage updates the token usage for a user
+// GetMonthlyUsage returns the tokens and cost a user has used in the month
+// containing date in the user's timezone
+func (s *TokenQuotaService) GetMonthlyUsage(userID uuid.UUID, date time.Time) (int, int64, error) {
+	loc, err := UserLocation(s.db, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	startOfMonth, endOfMonth := MonthWindow(date.In(loc))
+
+	var total struct {
+		Tokens int
+		Cost   int64
+	}
+	err = s.db.Model(&database.DBTokenUsage{}).
+		Select("COALESCE(SUM(tokens), 0) AS tokens, COALESCE(SUM(cost), 0) AS cost").
+		Where("user_id = ? AND date >= ? AND date < ?", userID, startOfMonth.UTC(), endOfMonth.UTC()).
+		Scan(&total).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	return total.Tokens, total.Cost, nil
+}
+
+// Reservation holds quota for an in-flight call until it is settled or
+// released
+type Reservation struct {
+	UserID uuid.UUID
+	Tokens int
+	// counters are the windows the call is accounted to, those current when
+	// it was reserved
+	counters []windowCounter
+	// wallet is the wallet holding the call's worst case cost, hold, or zero
+	// when the user has none
+	wallet uint
+	hold   int64
+	// done is set once the reservation is settled or released
+	done bool
+}
+
+// UpdateUsage updates the token usage for a user. When the tokens would
+// exceed one of the user's quota windows it returns a *QuotaExceededError
+// wrapping the error of that window.
 func (s *TokenQuotaService) UpdateUsage(userID uuid.UUID, tokens int) error {
-	now := time.Now()
+	_, err := s.Reserve(userID, QuotaScope{}, tokens)
+	return err
+}
 
-	// Get or create daily usage
-	usage, err := s.GetDailyUsage(userID, now)
+// Reserve checks that a call in the scope using up to the given tokens fits
+// in the user's quota and holds the tokens, and the call itself in request
+// windows, in the quota store until the call is settled or released. The
+// tokens are priced as input to hold their cost on the user's wallet. Quota
+// rejections are *QuotaExceededError.
+func (s *TokenQuotaService) Reserve(userID uuid.UUID, scope QuotaScope, tokens int) (*Reservation, error) {
+	counters, err := s.windowCounters(userID, scope, time.Now())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return s.reserve(userID, scope, counters, tokens, 0)
+}
+
+// reserve holds a call using up to the given prompt and completion tokens in
+// the counters of its windows, and its worst case cost on the user's wallet
+func (s *TokenQuotaService) reserve(userID uuid.UUID, scope QuotaScope, counters []windowCounter, promptTokens, completionTokens int) (*Reservation, error) {
+	tokens := promptTokens + completionTokens
+	// The cost of a call is only known once it completes, so cost windows
+	// reject calls once the budget is spent
+	for _, counter := range counters {
+		if counter.isCost() && counter.Limit > 0 && counter.Used >= counter.Limit {
+			return nil, &QuotaExceededError{Window: counter.QuotaWindow, Err: windowErrors[counter.Name]}
+		}
 	}
 
-	// Get user quota
-	quota, err := s.GetUserQuota(userID)
+	// Hold the worst case cost of the call on the prepaid wallet, if any
+	var cost int64
+	price, err := NewPricingService(s.db).GetPrice(scope.Provider, scope.pricedModel(), time.Now())
+	switch {
+	case err == nil:
+		cost = Cost(price, promptTokens, completionTokens)
+	case !errors.Is(err, ErrPriceNotFound):
+		return nil, err
+	}
+	wallet, err := NewWalletService(s.db).Hold(userID, cost)
 	if err != nil {
+		return nil, err
+	}
+	reservation := &Reservation{UserID: userID, Tokens: tokens, counters: counters}
+	if wallet != nil {
+		reservation.wallet, reservation.hold = wallet.ID, cost
+	}
+
+	// Hold the call in every token and request window, giving it back if
+	// one is full
+	ctx := context.Background()
+	for i, counter := range counters {
+		delta := counter.delta(int64(tokens), 1, 0)
+		if delta == 0 {
+			continue
+		}
+		used, ok, err := s.store.IncrementWithLimit(ctx, counter.key, delta, counter.Limit, counter.expiresAt())
+		if err == nil && !ok {
+			counter.Used = used
+			err = &QuotaExceededError{Window: counter.QuotaWindow, Err: windowErrors[counter.Name]}
+		}
+		if err != nil {
+			partial := &Reservation{UserID: userID, Tokens: tokens, counters: counters[:i], wallet: reservation.wallet, hold: reservation.hold}
+			if releaseErr := s.Release(partial); releaseErr != nil {
+				log.Printf("Error releasing token reservation for user %s: %v", userID, releaseErr)
+			}
+			return nil, err
+		}
+	}
+	return reservation, nil
+}
+
+// Release gives back the tokens of a reservation whose call failed. Releasing
+// a reservation that is already settled or released does nothing.
+func (s *TokenQuotaService) Release(reservation *Reservation) error {
+	if reservation.done {
+		return nil
+	}
+	if err := releaseHold(s.db, reservation.wallet, reservation.hold); err != nil {
 		return err
 	}
+	reservation.hold = 0
+	if err := s.adjustCounters(reservation.counters, -int64(reservation.Tokens), -1, 0); err != nil {
+		return err
+	}
+	reservation.done = true
+	return nil
+}
+
+// Settle records the actual usage of a reserved call, see RecordUsage, and
+// gives back the reservation
+func (s *TokenQuotaService) Settle(reservation *Reservation, call CallUsage) (*database.DBUsageRecord, error) {
+	if reservation.done {
+		return nil, errors.New("reservation is already settled or released")
+	}
+	record, err := s.recordUsage(reservation.UserID, call, reservation.counters, reservation.Tokens, 1, reservation.wallet, reservation.hold)
+	if err != nil {
+		return nil, err
+	}
+	reservation.done = true
+	return record, nil
+}
 
-	// Check if usage exceeds quota
-	if usage.Tokens+tokens > quota.DailyQuota {
-		return errors.New("daily token quota exceeded")
+// adjustCounters adds tokens, requests and cost to the counters of their
+// windows, without limits
+func (s *TokenQuotaService) adjustCounters(counters []windowCounter, tokens, requests, cost int64) error {
+	ctx := context.Background()
+	for _, counter := range counters {
+		delta := counter.delta(tokens, requests, cost)
+		if delta == 0 {
+			continue
+		}
+		if _, _, err := s.store.IncrementWithLimit(ctx, counter.key, delta, 0, counter.expiresAt()); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Update usage
-	usage.Tokens += tokens
-	return s.db.Save(usage).Error
+// RecordUsage prices a completed upstream call, adds its tokens and cost to
+// the user's daily usage and debits the user's wallet. The call has already
+// been served, so it is recorded even when it takes the user over their
+// quota.
+func (s *TokenQuotaService) RecordUsage(userID uuid.UUID, call CallUsage) (*database.DBUsageRecord, error) {
+	// Read the counters before the usage reaches the ledger, which
+	// initializes missing counters
+	counters, err := s.windowCounters(userID, call.Scope(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return s.recordUsage(userID, call, counters, 0, 0, 0, 0)
 }
 
-// ResetDailyUsage resets the token usage for all users at the start of a new day
-func (s *TokenQuotaService) ResetDailyUsage() error {
+// recordUsage records a call in the usage ledger and adds it to the window
+// counters, replacing the tokens and requests reserved for it, and the cost
+// held for it on heldWallet
+func (s *TokenQuotaService) recordUsage(userID uuid.UUID, call CallUsage, counters []windowCounter, reservedTokens, reservedRequests int, heldWallet uint, held int64) (*database.DBUsageRecord, error) {
 	now := time.Now()
-	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
 
-	// Delete all usage records from previous days
-	return s.db.Where("date < ?", startOfDay).Delete(&database.DBTokenUsage{}).Error
+	priced := call.Model
+	if call.ModelVersion != "" {
+		priced = call.ModelVersion
+	}
+	var cost int64
+	price, err := NewPricingService(s.db).GetPrice(call.Provider, priced, now)
+	switch {
+	case err == nil:
+		cost = Cost(price, call.PromptTokens, call.CompletionTokens)
+	case errors.Is(err, ErrPriceNotFound):
+		log.Printf("No price configured for %s/%s, recording usage at zero cost", call.Provider, priced)
+	default:
+		return nil, err
+	}
+
+	record := database.DBUsageRecord{
+		UserID:           userID,
+		Provider:         call.Provider,
+		ModelName:        call.Model,
+		ModelVersion:     call.ModelVersion,
+		Endpoint:         call.Endpoint,
+		PromptTokens:     call.PromptTokens,
+		CompletionTokens: call.CompletionTokens,
+		TotalTokens:      call.PromptTokens + call.CompletionTokens,
+		Cost:             cost,
+		Tags:             usageTags(call.Tags),
+	}
+
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		usage, err := NewTokenQuotaService(tx).GetDailyUsage(userID, now)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(usage).Updates(map[string]interface{}{
+			"tokens": gorm.Expr("tokens + ?", record.TotalTokens),
+			"cost":   gorm.Expr("cost + ?", record.Cost),
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&record).Error; err != nil {
+			return err
+		}
+
+		if err := releaseHold(tx, heldWallet, held); err != nil {
+			return err
+		}
+
+		// Debit the prepaid wallet, if any. The call has been served, so the
+		// debit may take the balance past its overdraft limit when it cost
+		// more than was held for it.
+		if record.Cost == 0 {
+			return nil
+		}
+		wallet, err := NewWalletService(tx).WalletForUser(userID)
+		if err != nil || wallet == nil {
+			return err
+		}
+		_, err = applyTransaction(tx, wallet.ID, -record.Cost, WalletReasonUsage, usageReference(&record))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The call is in the ledger, so a failure to count it only skews the
+	// counters until their windows end
+	if err := s.adjustCounters(counters, int64(record.TotalTokens-reservedTokens), int64(1-reservedRequests), record.Cost); err != nil {
+		log.Printf("Error updating quota counters for user %s: %v", userID, err)
+	}
+
+	// Alerting must not fail a call that has already been served
+	if err := NewAlertService(s.db).CheckThresholds(userID, call.Scope(), now); err != nil {
+		log.Printf("Error checking quota alert thresholds for user %s: %v", userID, err)
+	}
+	return &record, nil
 }
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestReserve_SettleAndRelease(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	require.NoError(t, database.SeedModelPrices(db))
+	user := database.DBUser{Username: "carol", Email: "carol@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	quotas := NewTokenQuotaService(db)
+
+	dailyTokens := func() int64 {
+		windows, err := quotas.GetWindows(user.ID, time.Now())
+		require.NoError(t, err)
+		require.Equal(t, WindowDailyTokens, windows[0].Name)
+		return windows[0].Used
+	}
+
+	// A reservation holds its worst case until it is settled at the actual usage
+	reservation, err := quotas.Reserve(user.ID, QuotaScope{}, 5_000)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5_000), dailyTokens())
+	_, err = quotas.Settle(reservation, CallUsage{Provider: "azure", Model: "gpt-4o", PromptTokens: 300, CompletionTokens: 200})
+	require.NoError(t, err)
+	assert.Equal(t, int64(500), dailyTokens())
+
+	// The ledger only holds the actual usage
+	usage, err := quotas.GetDailyUsage(user.ID, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, 500, usage.Tokens)
+
+	// Releasing after settling gives nothing back twice
+	require.NoError(t, quotas.Release(reservation))
+	assert.Equal(t, int64(500), dailyTokens())
+
+	// A failed call gives its reservation back
+	reservation, err = quotas.Reserve(user.ID, QuotaScope{}, 90_000)
+	require.NoError(t, err)
+	_, err = quotas.Reserve(user.ID, QuotaScope{}, 10_000)
+	assert.ErrorIs(t, err, ErrDailyTokenQuotaExceeded)
+	require.NoError(t, quotas.Release(reservation))
+	require.NoError(t, quotas.Release(reservation))
+	assert.Equal(t, int64(500), dailyTokens())
+
+	_, err = quotas.Reserve(user.ID, QuotaScope{}, 10_000)
+	assert.NoError(t, err)
+}
+
+func TestReserve_ConcurrentCallsNeverOverspendWallet(t *testing.T) {
+	db := setupTestDB(t)
+	require.NoError(t, database.SeedPlans(db))
+	require.NoError(t, db.Create(&database.DBModelPrice{Provider: "azure", ModelName: "metered", InputPrice: 1_000_000, OutputPrice: 2_000_000, EffectiveFrom: time.Unix(0, 0)}).Error)
+	user := database.DBUser{Username: "erin", Email: "erin@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+	wallets := NewWalletService(db)
+	_, err := wallets.TopUp(database.WalletOwnerUser, user.ID, 1_000, WalletReasonTopUp, "")
+	require.NoError(t, err)
+	_, err = wallets.SetOverdraftLimit(database.WalletOwnerUser, user.ID, 200)
+	require.NoError(t, err)
+	quotas := NewTokenQuotaService(db)
+	scope := QuotaScope{Provider: "azure", Model: "metered", Endpoint: EndpointChatCompletions}
+
+	// Each call may cost 50 + 25*2 = 100 micro-dollars, so the wallet and
+	// its overdraft cover 12 calls in flight
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reservations []*Reservation
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reservation, _, err := quotas.ReserveCompletion(user.ID, scope, 50, 25)
+			if err != nil {
+				assert.ErrorIs(t, err, ErrInsufficientCredit)
+				return
+			}
+			mu.Lock()
+			reservations = append(reservations, reservation)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	require.Len(t, reservations, 12)
+	wallet, err := wallets.GetWallet(database.WalletOwnerUser, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_200), wallet.Held)
+
+	// Settled calls are debited what they cost, released ones nothing
+	for i, reservation := range reservations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				_, err := quotas.Settle(reservation, CallUsage{Provider: "azure", Model: "metered", Endpoint: EndpointChatCompletions, PromptTokens: 50})
+				assert.NoError(t, err)
+				return
+			}
+			assert.NoError(t, quotas.Release(reservation))
+		}()
+	}
+	wg.Wait()
+	wallet, err = wallets.GetWallet(database.WalletOwnerUser, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), wallet.Held)
+	assert.Equal(t, int64(1_000-6*50), wallet.Balance)
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/vhybZApp/api/database"
+)
+
+// HeaderUsageTags carries the cost attribution tags of a call as
+// comma-separated key=value pairs, e.g. feature=search,environment=prod
+const HeaderUsageTags = "X-Usage-Tags"
+
+// Size limits of the cost attribution tags of a call
+const (
+	MaxUsageTags        = 10
+	MaxUsageTagKeyLen   = 64
+	MaxUsageTagValueLen = 256
+)
+
+// ErrInvalidUsageTags is returned when cost attribution tags are malformed
+// or too large
+var ErrInvalidUsageTags = errors.New("invalid usage tags")
+
+// UsageTags merges the tags of the X-Usage-Tags header with the tags of the
+// request body, which win on conflicts, and validates the result
+func UsageTags(header string, body map[string]string) (map[string]string, error) {
+	tags, err := ParseUsageTags(strings.Split(header, ","))
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range body {
+		tags[key] = value
+	}
+	if err := ValidateUsageTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// ParseUsageTags parses key=value pairs, skipping blank ones
+func ParseUsageTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range pairs {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q is not a key=value pair", ErrInvalidUsageTags, pair)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := ValidateUsageTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// ValidateUsageTags checks the number and size of tags. Keys are letters,
+// digits, '.', '-' and '_', values are printable.
+func ValidateUsageTags(tags map[string]string) error {
+	if len(tags) > MaxUsageTags {
+		return fmt.Errorf("%w: at most %d tags are allowed", ErrInvalidUsageTags, MaxUsageTags)
+	}
+	for key, value := range tags {
+		if key == "" || len(key) > MaxUsageTagKeyLen || strings.IndexFunc(key, invalidTagKeyRune) >= 0 {
+			return fmt.Errorf("%w: key %q must be 1 to %d letters, digits, '.', '-' or '_'", ErrInvalidUsageTags, key, MaxUsageTagKeyLen)
+		}
+		if len(value) > MaxUsageTagValueLen || strings.IndexFunc(value, invalidTagValueRune) >= 0 {
+			return fmt.Errorf("%w: value of %q must be at most %d printable characters", ErrInvalidUsageTags, key, MaxUsageTagValueLen)
+		}
+	}
+	return nil
+}
+
+func invalidTagKeyRune(r rune) bool {
+	return !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '.' || r == '-' || r == '_')
+}
+
+func invalidTagValueRune(r rune) bool {
+	return !unicode.IsPrint(r)
+}
+
+// usageTags returns the tags of a usage record, sorted by key
+func usageTags(tags map[string]string) []database.DBUsageTag {
+	if len(tags) == 0 {
+		return nil
+	}
+	records := make([]database.DBUsageTag, 0, len(tags))
+	for key, value := range tags {
+		records = append(records, database.DBUsageTag{Key: key, Value: value})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageTags(t *testing.T) {
+	tags, err := UsageTags(" feature=search , environment=prod,", map[string]string{"environment": "staging", "customer": "ACME Corp"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"feature": "search", "environment": "staging", "customer": "ACME Corp"}, tags)
+
+	tags, err = UsageTags("", nil)
+	require.NoError(t, err)
+	assert.Empty(t, tags)
+
+	invalid := []struct {
+		header string
+		body   map[string]string
+	}{
+		{header: "feature"},
+		{header: "=search"},
+		{header: "feature name=search"},
+		{body: map[string]string{"feature": "line\nbreak"}},
+		{body: map[string]string{strings.Repeat("k", MaxUsageTagKeyLen+1): "v"}},
+		{body: map[string]string{"feature": strings.Repeat("v", MaxUsageTagValueLen+1)}},
+	}
+	for _, tt := range invalid {
+		_, err := UsageTags(tt.header, tt.body)
+		assert.ErrorIs(t, err, ErrInvalidUsageTags, "%+v", tt)
+	}
+
+	body := make(map[string]string)
+	for i := 0; i <= MaxUsageTags; i++ {
+		body[fmt.Sprintf("tag%d", i)] = "v"
+	}
+	_, err = UsageTags("", body)
+	assert.ErrorIs(t, err, ErrInvalidUsageTags)
+}
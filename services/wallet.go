@@ -0,0 +1,188 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+// Wallet transaction reasons
+const (
+	WalletReasonTopUp      = "top_up"
+	WalletReasonUsage      = "usage"
+	WalletReasonAdjustment = "adjustment"
+)
+
+var (
+	// ErrInsufficientCredit is returned when a wallet cannot cover a call
+	ErrInsufficientCredit = errors.New("insufficient credit balance")
+	// ErrWalletNotFound is returned when an owner has no wallet
+	ErrWalletNotFound = errors.New("wallet not found")
+)
+
+type WalletService struct {
+	db *gorm.DB
+}
+
+func NewWalletService(db *gorm.DB) *WalletService {
+	return &WalletService{db: db}
+}
+
+// GetWallet returns the wallet of an owner
+func (s *WalletService) GetWallet(ownerType string, ownerID uuid.UUID) (*database.DBWallet, error) {
+	var wallet database.DBWallet
+	if err := s.db.Where("owner_type = ? AND owner_id = ?", ownerType, ownerID).First(&wallet).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrWalletNotFound
+		}
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// WalletForUser returns the wallet that pays for a user's calls: their
+// organization's wallet if they belong to one, and their own otherwise.
+// It returns nil if that owner has no wallet, in which case calls are only
+// limited by quota.
+func (s *WalletService) WalletForUser(userID uuid.UUID) (*database.DBWallet, error) {
+	var user database.DBUser
+	if err := s.db.Select("id", "organization_id").Where("id = ?", userID).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	ownerType, ownerID := database.WalletOwnerUser, userID
+	if user.OrganizationID != nil {
+		ownerType, ownerID = database.WalletOwnerOrganization, *user.OrganizationID
+	}
+
+	wallet, err := s.GetWallet(ownerType, ownerID)
+	if errors.Is(err, ErrWalletNotFound) {
+		return nil, nil
+	}
+	return wallet, err
+}
+
+// Hold sets aside the worst case cost of a call in flight on the wallet
+// paying for the user's calls, so that concurrent calls can never spend more
+// than its credit. It fails with ErrInsufficientCredit when what is left of
+// the balance and overdraft after the other holds can't cover amount; calls
+// of unknown cost are rejected once nothing is left. It returns the wallet
+// held, or nil when the user has none.
+func (s *WalletService) Hold(userID uuid.UUID, amount int64) (*database.DBWallet, error) {
+	wallet, err := s.WalletForUser(userID)
+	if err != nil || wallet == nil {
+		return nil, err
+	}
+	result := s.db.Model(&database.DBWallet{}).
+		Where("id = ? AND balance - held + overdraft_limit >= ?", wallet.ID, max(amount, 1)).
+		Update("held", gorm.Expr("held + ?", amount))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrInsufficientCredit
+	}
+	return wallet, nil
+}
+
+// releaseHold gives back the amount held on a wallet for a call
+func releaseHold(tx *gorm.DB, walletID uint, amount int64) error {
+	if walletID == 0 || amount == 0 {
+		return nil
+	}
+	return tx.Model(&database.DBWallet{}).Where("id = ?", walletID).Update("held", gorm.Expr("held - ?", amount)).Error
+}
+
+// TopUp credits an owner's wallet, creating it if needed
+func (s *WalletService) TopUp(ownerType string, ownerID uuid.UUID, amount int64, reason, reference string) (*database.DBWalletTransaction, error) {
+	if amount <= 0 {
+		return nil, errors.New("top-up amount must be positive")
+	}
+
+	var entry *database.DBWalletTransaction
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		wallet := database.DBWallet{OwnerType: ownerType, OwnerID: ownerID}
+		if err := tx.Where(&wallet).FirstOrCreate(&wallet).Error; err != nil {
+			return err
+		}
+
+		var err error
+		entry, err = applyTransaction(tx, wallet.ID, amount, reason, reference)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// SetOverdraftLimit sets how far below zero an owner's wallet may go,
+// creating the wallet if needed
+func (s *WalletService) SetOverdraftLimit(ownerType string, ownerID uuid.UUID, limit int64) (*database.DBWallet, error) {
+	if limit < 0 {
+		return nil, errors.New("overdraft limit must not be negative")
+	}
+
+	wallet := database.DBWallet{OwnerType: ownerType, OwnerID: ownerID}
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where(&wallet).FirstOrCreate(&wallet).Error; err != nil {
+			return err
+		}
+		wallet.OverdraftLimit = limit
+		return tx.Model(&wallet).Update("overdraft_limit", limit).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &wallet, nil
+}
+
+// ListTransactions returns the most recent transactions of a wallet, newest first
+func (s *WalletService) ListTransactions(walletID uint, limit int) ([]database.DBWalletTransaction, error) {
+	var entries []database.DBWalletTransaction
+	if err := s.db.Where("wallet_id = ?", walletID).Order("id DESC").Limit(limit).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// applyTransaction atomically adds amount to a wallet's balance and appends
+// the matching log entry. It doesn't check the overdraft limit: calls are
+// held against it by Hold before they run, and are debited what they cost
+// once done.
+func applyTransaction(tx *gorm.DB, walletID uint, amount int64, reason, reference string) (*database.DBWalletTransaction, error) {
+	result := tx.Model(&database.DBWallet{}).Where("id = ?", walletID).Update("balance", gorm.Expr("balance + ?", amount))
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrWalletNotFound
+	}
+
+	var wallet database.DBWallet
+	if err := tx.Select("balance").Where("id = ?", walletID).First(&wallet).Error; err != nil {
+		return nil, err
+	}
+
+	entry := database.DBWalletTransaction{
+		WalletID:     walletID,
+		Amount:       amount,
+		BalanceAfter: wallet.Balance,
+		Reason:       reason,
+		Reference:    reference,
+	}
+	if err := tx.Create(&entry).Error; err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// usageReference returns the wallet transaction reference of a usage record
+func usageReference(record *database.DBUsageRecord) string {
+	return fmt.Sprintf("usage:%d", record.ID)
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func TestWalletHold_ConcurrentHoldsNeverOverspend(t *testing.T) {
+	db := setupTestDB(t)
+	wallets := NewWalletService(db)
+	user := database.DBUser{Username: "ivan", Email: "ivan@example.com", Password: "x"}
+	require.NoError(t, db.Create(&user).Error)
+
+	// Users without a wallet are only limited by quota
+	wallet, err := wallets.Hold(user.ID, 100)
+	require.NoError(t, err)
+	assert.Nil(t, wallet)
+
+	_, err = wallets.TopUp(database.WalletOwnerUser, user.ID, 1_000, WalletReasonTopUp, "")
+	require.NoError(t, err)
+	_, err = wallets.SetOverdraftLimit(database.WalletOwnerUser, user.ID, 200)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	held := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := wallets.Hold(user.ID, 100); err == nil {
+				mu.Lock()
+				held++
+				mu.Unlock()
+			} else {
+				assert.ErrorIs(t, err, ErrInsufficientCredit)
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 12, held)
+	wallet, err = wallets.GetWallet(database.WalletOwnerUser, user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1_000), wallet.Balance)
+	assert.Equal(t, int64(1_200), wallet.Held)
+
+	// Calls of unknown cost are rejected once nothing is left
+	_, err = wallets.Hold(user.ID, 0)
+	assert.ErrorIs(t, err, ErrInsufficientCredit)
+	require.NoError(t, releaseHold(db, wallet.ID, 100))
+	_, err = wallets.Hold(user.ID, 0)
+	assert.NoError(t, err)
+}
+
+func TestWalletTransaction_Immutable(t *testing.T) {
+	db := setupTestDB(t)
+	entry, err := NewWalletService(db).TopUp(database.WalletOwnerUser, uuid.New(), 500, WalletReasonTopUp, "invoice-1")
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, db.Model(entry).Update("amount", 1).Error, database.ErrImmutable)
+	assert.ErrorIs(t, db.Delete(entry).Error, database.ErrImmutable)
+}
@@ -0,0 +1,341 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vhybZApp/api/config"
+	"github.com/vhybZApp/api/database"
+	"gorm.io/gorm"
+)
+
+// DayWindow returns the start and end of the calendar day containing t in
+// t's location. Days are 23 or 25 hours long across DST transitions, and on
+// days where the clocks spring forward at midnight the day starts at the
+// first instant after the gap.
+func DayWindow(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.Date()
+	start := startOfDay(y, m, d, t.Location())
+	end := startOfDay(y, m, d+1, t.Location())
+	return start, end
+}
+
+// MonthWindow returns the start and end of the calendar month containing t
+// in t's location
+func MonthWindow(t time.Time) (time.Time, time.Time) {
+	y, m, _ := t.Date()
+	start := startOfDay(y, m, 1, t.Location())
+	end := startOfDay(y, m+1, 1, t.Location())
+	return start, end
+}
+
+// startOfDay returns the first instant of a calendar day in loc
+func startOfDay(year int, month time.Month, day int, loc *time.Location) time.Time {
+	start := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	// Midnight falls in a DST gap and was normalized into the previous day,
+	// so the day starts where the gap ends
+	if start.Day() != time.Date(year, month, day, 12, 0, 0, 0, loc).Day() {
+		_, start = start.ZoneBounds()
+	}
+	return start
+}
+
+// LoadTimezone parses an IANA timezone name, an empty name is the default
+// quota timezone
+func LoadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		name = config.AppConfig.DefaultTimezone
+	}
+	if name == "" {
+		return time.UTC, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// UserLocation returns the timezone whose calendar drives a user's quota
+// windows: the user's own timezone, else their organization's, else the
+// default quota timezone
+func UserLocation(db *gorm.DB, userID uuid.UUID) (*time.Location, error) {
+	var user database.DBUser
+	if err := db.Select("id", "timezone", "organization_id").Where("id = ?", userID).First(&user).Error; err != nil {
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+	}
+
+	name := user.Timezone
+	if name == "" && user.OrganizationID != nil {
+		var organization database.DBOrganization
+		if err := db.Select("timezone").Where("id = ?", *user.OrganizationID).First(&organization).Error; err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, err
+			}
+		}
+		name = organization.Timezone
+	}
+
+	loc, err := LoadTimezone(name)
+	if err != nil {
+		// Timezones are validated when saved, so this only happens if tzdata changed
+		log.Printf("Invalid timezone %q for user %s, using UTC: %v", name, userID, err)
+		return time.UTC, nil
+	}
+	return loc, nil
+}
+
+// Quota window names
+const (
+	WindowDailyTokens   = "daily_tokens"
+	WindowMonthlyTokens = "monthly_tokens"
+	WindowDailyRequests = "daily_requests"
+	WindowDailyCost     = "daily_cost"
+	WindowMonthlyCost   = "monthly_cost"
+)
+
+// QuotaWindow is the state of one limited quota window of a user. Cost
+// windows are in micro-dollars and request windows count calls.
+type QuotaWindow struct {
+	Name  string
+	Limit int64
+	Used  int64
+	Start time.Time
+	End   time.Time
+	// Rule is the ID of the quota rule whose bucket the window belongs to,
+	// zero for the plan's token quotas and the cost budgets
+	Rule uint
+}
+
+// Remaining returns what is left in the window, never less than zero
+func (w QuotaWindow) Remaining() int64 {
+	if w.Used >= w.Limit {
+		return 0
+	}
+	return w.Limit - w.Used
+}
+
+// windowErrors maps each window to the error returned when it is exceeded
+var windowErrors = map[string]error{
+	WindowDailyTokens:   ErrDailyTokenQuotaExceeded,
+	WindowMonthlyTokens: ErrMonthlyTokenQuotaExceeded,
+	WindowDailyRequests: ErrDailyRequestQuotaExceeded,
+	WindowDailyCost:     ErrDailyCostBudgetExceeded,
+	WindowMonthlyCost:   ErrMonthlyCostBudgetExceeded,
+}
+
+// isCost reports whether the window limits micro-dollars rather than tokens
+func (w QuotaWindow) isCost() bool {
+	return w.Name == WindowDailyCost || w.Name == WindowMonthlyCost
+}
+
+// delta picks the amount a call adds to the window among its tokens, its
+// number of requests and its cost
+func (w QuotaWindow) delta(tokens, requests, cost int64) int64 {
+	switch {
+	case w.isCost():
+		return cost
+	case w.Name == WindowDailyRequests:
+		return requests
+	default:
+		return tokens
+	}
+}
+
+// QuotaExceededError is returned when a call is rejected by a quota window.
+// It wraps the window's sentinel error, e.g. ErrDailyTokenQuotaExceeded.
+type QuotaExceededError struct {
+	Window QuotaWindow
+	Err    error
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return e.Err
+}
+
+// RetryAfter returns how long until the window resets, rounded up to the
+// second
+func (e *QuotaExceededError) RetryAfter(now time.Time) time.Duration {
+	return ceilSeconds(e.Window.End.Sub(now))
+}
+
+// counterExpiryGrace keeps the counter of a window around after the window
+// ends, so that calls settled after the end still find it
+const counterExpiryGrace = 24 * time.Hour
+
+// windowCounter is a quota window along with the key of its counter in the
+// quota store
+type windowCounter struct {
+	QuotaWindow
+	key string
+}
+
+func (w windowCounter) expiresAt() time.Time {
+	return w.End.Add(counterExpiryGrace)
+}
+
+// GetWindows returns the state of every limited quota window of a user at
+// the given time, for calls matching no quota rule. Unlimited windows are
+// left out.
+func (s *TokenQuotaService) GetWindows(userID uuid.UUID, now time.Time) ([]QuotaWindow, error) {
+	return s.GetScopeWindows(userID, QuotaScope{}, now)
+}
+
+// GetScopeWindows returns the state of every limited quota window applying
+// to calls in the scope at the given time. Unlimited windows are left out.
+func (s *TokenQuotaService) GetScopeWindows(userID uuid.UUID, scope QuotaScope, now time.Time) ([]QuotaWindow, error) {
+	counters, err := s.windowCounters(userID, scope, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var windows []QuotaWindow
+	for _, counter := range counters {
+		if counter.Limit > 0 {
+			windows = append(windows, counter.QuotaWindow)
+		}
+	}
+	return windows, nil
+}
+
+// windowCounters returns every quota window applying to calls in the scope
+// at the given time, limited or not, with its usage read from the quota
+// store. The token windows are those of the most specific matching quota
+// rule, or the plan's when no rule matches, and the cost budgets always
+// apply. Counters missing from the store, e.g. at the start of a window or
+// after the store was flushed, are initialized from the usage ledger.
+func (s *TokenQuotaService) windowCounters(userID uuid.UUID, scope QuotaScope, now time.Time) ([]windowCounter, error) {
+	limits, err := s.GetLimits(userID)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := UserLocation(s.db, userID)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := NewQuotaRuleService(s.db).RulesFor(userID, limits.PlanID)
+	if err != nil {
+		return nil, err
+	}
+
+	dayStart, dayEnd := DayWindow(now.In(loc))
+	monthStart, monthEnd := MonthWindow(now.In(loc))
+	var counters []windowCounter
+	if rule := matchRule(rules, scope); rule != nil {
+		counters = []windowCounter{
+			{QuotaWindow: QuotaWindow{Name: WindowDailyTokens, Limit: int64(rule.DailyTokens), Start: dayStart, End: dayEnd, Rule: rule.ID}},
+			{QuotaWindow: QuotaWindow{Name: WindowDailyRequests, Limit: int64(rule.DailyRequests), Start: dayStart, End: dayEnd, Rule: rule.ID}},
+			{QuotaWindow: QuotaWindow{Name: WindowMonthlyTokens, Limit: int64(rule.MonthlyTokens), Start: monthStart, End: monthEnd, Rule: rule.ID}},
+		}
+	} else {
+		counters = []windowCounter{
+			{QuotaWindow: QuotaWindow{Name: WindowDailyTokens, Limit: int64(limits.DailyQuota), Start: dayStart, End: dayEnd}},
+			{QuotaWindow: QuotaWindow{Name: WindowMonthlyTokens, Limit: int64(limits.MonthlyQuota), Start: monthStart, End: monthEnd}},
+		}
+	}
+	counters = append(counters,
+		windowCounter{QuotaWindow: QuotaWindow{Name: WindowDailyCost, Limit: limits.DailyCostBudget, Start: dayStart, End: dayEnd}},
+		windowCounter{QuotaWindow: QuotaWindow{Name: WindowMonthlyCost, Limit: limits.MonthlyCostBudget, Start: monthStart, End: monthEnd}},
+	)
+
+	for i := range counters {
+		counter := &counters[i]
+		if counter.Rule != 0 {
+			counter.key = fmt.Sprintf("quota:%s:rule%d:%s:%d", userID, counter.Rule, counter.Name, counter.Start.Unix())
+		} else {
+			counter.key = fmt.Sprintf("quota:%s:%s:%d", userID, counter.Name, counter.Start.Unix())
+		}
+	}
+
+	ctx := context.Background()
+	var ledger map[string]int64
+	for i := range counters {
+		counter := &counters[i]
+		used, ok, err := s.store.Get(ctx, counter.key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if ledger == nil {
+				if ledger, err = s.ledgerUsage(userID, rules, counters); err != nil {
+					return nil, err
+				}
+			}
+			if err := s.store.Init(ctx, counter.key, ledger[counter.key], counter.expiresAt()); err != nil {
+				return nil, err
+			}
+			// Another replica may have initialized the counter first
+			if used, _, err = s.store.Get(ctx, counter.key); err != nil {
+				return nil, err
+			}
+		}
+		counter.Used = used
+	}
+	return counters, nil
+}
+
+// ledgerUsage returns the usage of each counter recorded in the usage
+// ledger, keyed by counter key. Past calls count towards the bucket of the
+// rule matching their scope now, so editing rules moves usage between
+// buckets.
+func (s *TokenQuotaService) ledgerUsage(userID uuid.UUID, rules []database.DBQuotaRule, counters []windowCounter) (map[string]int64, error) {
+	var dayStart, dayEnd, monthStart, monthEnd time.Time
+	for _, counter := range counters {
+		if counter.Name == WindowDailyCost {
+			dayStart, dayEnd = counter.Start.UTC(), counter.End.UTC()
+		}
+		if counter.Name == WindowMonthlyCost {
+			monthStart, monthEnd = counter.Start.UTC(), counter.End.UTC()
+		}
+	}
+
+	var groups []struct {
+		Provider      string
+		ModelName     string
+		Endpoint      string
+		DailyRequests int64
+		DailyTokens   int64
+		DailyCost     int64
+		MonthlyTokens int64
+		MonthlyCost   int64
+	}
+	daily := "CASE WHEN created_at >= ? AND created_at < ? THEN %s ELSE 0 END"
+	err := s.db.Model(&database.DBUsageRecord{}).
+		Select("provider, model_name, endpoint, "+
+			"SUM("+fmt.Sprintf(daily, "1")+") AS daily_requests, "+
+			"SUM("+fmt.Sprintf(daily, "total_tokens")+") AS daily_tokens, "+
+			"SUM("+fmt.Sprintf(daily, "cost")+") AS daily_cost, "+
+			"SUM(total_tokens) AS monthly_tokens, SUM(cost) AS monthly_cost",
+			dayStart, dayEnd, dayStart, dayEnd, dayStart, dayEnd).
+		Where("user_id = ? AND created_at >= ? AND created_at < ?", userID, monthStart, monthEnd).
+		Group("provider, model_name, endpoint").
+		Scan(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make(map[string]int64, len(counters))
+	for _, group := range groups {
+		var bucket uint
+		if rule := matchRule(rules, QuotaScope{Provider: group.Provider, Model: group.ModelName, Endpoint: group.Endpoint}); rule != nil {
+			bucket = rule.ID
+		}
+		for _, counter := range counters {
+			if !counter.isCost() && counter.Rule != bucket {
+				continue
+			}
+			if counter.Name == WindowMonthlyTokens || counter.Name == WindowMonthlyCost {
+				usage[counter.key] += counter.delta(group.MonthlyTokens, 0, group.MonthlyCost)
+			} else {
+				usage[counter.key] += counter.delta(group.DailyTokens, group.DailyRequests, group.DailyCost)
+			}
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,110 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/database"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	require.NoError(t, err)
+	return loc
+}
+
+func TestDayWindow_DSTTransitions(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	santiago := mustLoadLocation(t, "America/Santiago")
+	beirut := mustLoadLocation(t, "Asia/Beirut")
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		wantStart time.Time
+		wantHours float64
+	}{
+		{
+			name:      "regular day",
+			at:        time.Date(2026, time.March, 7, 15, 0, 0, 0, newYork),
+			wantStart: time.Date(2026, time.March, 7, 0, 0, 0, 0, newYork),
+			wantHours: 24,
+		},
+		{
+			name:      "spring forward at 2am",
+			at:        time.Date(2026, time.March, 8, 23, 30, 0, 0, newYork),
+			wantStart: time.Date(2026, time.March, 8, 5, 0, 0, 0, time.UTC),
+			wantHours: 23,
+		},
+		{
+			name:      "fall back at 2am",
+			at:        time.Date(2026, time.November, 1, 1, 30, 0, 0, newYork),
+			wantStart: time.Date(2026, time.November, 1, 4, 0, 0, 0, time.UTC),
+			wantHours: 25,
+		},
+		{
+			name: "spring forward at midnight",
+			// Clocks jump from 00:00 to 01:00, so the day starts at 01:00 -03
+			at:        time.Date(2026, time.September, 6, 12, 0, 0, 0, santiago),
+			wantStart: time.Date(2026, time.September, 6, 4, 0, 0, 0, time.UTC),
+			wantHours: 23,
+		},
+		{
+			name:      "day before spring forward at midnight",
+			at:        time.Date(2026, time.September, 5, 22, 0, 0, 0, santiago),
+			wantStart: time.Date(2026, time.September, 5, 4, 0, 0, 0, time.UTC),
+			wantHours: 24,
+		},
+		{
+			name:      "spring forward at midnight east of UTC",
+			at:        time.Date(2026, time.March, 29, 9, 0, 0, 0, beirut),
+			wantStart: time.Date(2026, time.March, 28, 22, 0, 0, 0, time.UTC),
+			wantHours: 23,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := DayWindow(tt.at)
+			assert.True(t, start.Equal(tt.wantStart), "start %s, want %s", start.UTC(), tt.wantStart.UTC())
+			assert.Equal(t, tt.wantHours, end.Sub(start).Hours())
+			assert.False(t, tt.at.Before(start))
+			assert.True(t, tt.at.Before(end))
+		})
+	}
+}
+
+func TestMonthWindow_DSTTransition(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	start, end := MonthWindow(time.Date(2026, time.March, 20, 0, 0, 0, 0, newYork))
+	assert.True(t, start.Equal(time.Date(2026, time.March, 1, 5, 0, 0, 0, time.UTC)))
+	assert.True(t, end.Equal(time.Date(2026, time.April, 1, 4, 0, 0, 0, time.UTC)))
+}
+
+func TestGetDailyUsage_UsesUserTimezone(t *testing.T) {
+	db := setupTestDB(t)
+	quotas := NewTokenQuotaService(db)
+
+	user := database.DBUser{Username: "tokyo", Email: "tokyo@example.com", Password: "x", Timezone: "Asia/Tokyo"}
+	require.NoError(t, db.Create(&user).Error)
+
+	// 14:30 UTC and 15:30 UTC straddle midnight in Tokyo (UTC+9)
+	before := time.Date(2026, time.October, 19, 14, 30, 0, 0, time.UTC)
+	after := before.Add(time.Hour)
+
+	first, err := quotas.GetDailyUsage(user.ID, before)
+	require.NoError(t, err)
+	second, err := quotas.GetDailyUsage(user.ID, after)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.ID, second.ID)
+	assert.True(t, second.Date.Equal(time.Date(2026, time.October, 19, 15, 0, 0, 0, time.UTC)))
+
+	// Users without a timezone fall back to the default quota timezone
+	other := uuid.New()
+	usage, err := quotas.GetDailyUsage(other, after)
+	require.NoError(t, err)
+	assert.True(t, usage.Date.Equal(time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)))
+}
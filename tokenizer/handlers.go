@@ -0,0 +1,87 @@
+package tokenizer
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/vhybZApp/api/models"
+)
+
+// ModelResolver maps the model a client names, "" for the default one, to
+// the name it is served under and the model whose tokenizer counts it
+type ModelResolver func(name string) (served, tokenizerModel string, err error)
+
+// resolveModel resolves the models of /tokenize, nil to count with the name
+// as sent
+var resolveModel ModelResolver
+
+// SetModelResolver sets how /tokenize resolves model names, so that counts
+// match those quotas are reserved with
+func SetModelResolver(resolver ModelResolver) {
+	resolveModel = resolver
+}
+
+// TokenizeRequest represents the request body for counting tokens. Either
+// text or messages must be set.
+type TokenizeRequest struct {
+	// Model is a model alias, the default model when empty
+	Model    string    `json:"model"`
+	Text     string    `json:"text"`
+	Messages []Message `json:"messages"`
+}
+
+// TokenizeResponse represents a token count
+// @Description Token count, exact is false when it is a heuristic estimate
+type TokenizeResponse struct {
+	Model    string `json:"model"`
+	Encoding string `json:"encoding,omitempty"`
+	Tokens   int    `json:"tokens"`
+	Exact    bool   `json:"exact"`
+}
+
+// Tokenize godoc
+// @Summary Count tokens
+// @Description Count the tokens of a text or of the prompt of a chat conversation for a model, the way quotas are reserved
+// @Tags tokenizer
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body TokenizeRequest true "Text or messages to count"
+// @Success 200 {object} TokenizeResponse
+// @Failure 400 {object} models.ErrorResponse
+// @Failure 401 {object} models.ErrorResponse
+// @Router /tokenize [post]
+func Tokenize(c *gin.Context) {
+	var req TokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+		return
+	}
+	if req.Text == "" && len(req.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Either text or messages is required"))
+		return
+	}
+	if req.Text != "" && len(req.Messages) > 0 {
+		c.JSON(http.StatusBadRequest, models.NewErrorResponse("Only one of text and messages may be set"))
+		return
+	}
+	model := req.Model
+	if resolveModel != nil {
+		var err error
+		if req.Model, model, err = resolveModel(req.Model); err != nil {
+			c.JSON(http.StatusBadRequest, models.NewErrorResponse(err.Error()))
+			return
+		}
+	}
+
+	resp := TokenizeResponse{Model: req.Model}
+	if len(req.Messages) > 0 {
+		resp.Tokens, resp.Exact = CountMessages(model, req.Messages)
+	} else {
+		resp.Tokens, resp.Exact = Count(model, req.Text)
+	}
+	if resp.Exact {
+		resp.Encoding = EncodingForModel(model)
+	}
+	c.JSON(http.StatusOK, resp)
+}
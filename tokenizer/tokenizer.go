@@ -0,0 +1,232 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+	"github.com/vhybZApp/api/config"
+)
+
+// BPE encodings of the OpenAI model families
+const (
+	EncodingO200K  = "o200k_base"
+	EncodingCL100K = "cl100k_base"
+)
+
+// modelEncodings maps model name prefixes to their encoding. Azure deployment
+// names usually follow the model name, e.g. gpt-35-turbo. More specific
+// prefixes come first.
+var modelEncodings = []struct {
+	prefix   string
+	encoding string
+}{
+	{"gpt-4o", EncodingO200K},
+	{"chatgpt-4o", EncodingO200K},
+	{"gpt-4.1", EncodingO200K},
+	{"gpt-4.5", EncodingO200K},
+	{"gpt-5", EncodingO200K},
+	{"o1", EncodingO200K},
+	{"o3", EncodingO200K},
+	{"o4", EncodingO200K},
+	{"gpt-4", EncodingCL100K},
+	{"gpt-35", EncodingCL100K},
+	{"gpt-3.5", EncodingCL100K},
+	{"text-embedding-", EncodingCL100K},
+}
+
+// Chat formatting overhead of the OpenAI chat models: every message is
+// wrapped in special tokens, a name costs one more token, and every reply is
+// primed with the assistant role.
+const (
+	tokensPerMessage = 3
+	tokensPerName    = 1
+	tokensPerReply   = 3
+)
+
+// Message is a chat message whose tokens are counted
+type Message struct {
+	Role    string `json:"role"`
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+}
+
+var (
+	mu sync.Mutex
+	// encoders caches loaded encoders, nil for encodings whose vocabulary
+	// could not be loaded
+	encoders = map[string]*tiktoken.Tiktoken{}
+)
+
+func init() {
+	// Never download vocabularies at runtime, they are read from TokenizerDir
+	tiktoken.SetBpeLoader(dirLoader{})
+}
+
+// EncodingForModel returns the BPE encoding of a model, or "" if the model
+// family is unknown
+func EncodingForModel(model string) string {
+	model = strings.ToLower(model)
+	for _, m := range modelEncodings {
+		if strings.HasPrefix(model, m.prefix) {
+			return m.encoding
+		}
+	}
+	return ""
+}
+
+// Preload loads the vocabularies of all known encodings so that the first
+// request doesn't pay for it, and logs the ones that are missing
+func Preload() {
+	for _, encoding := range []string{EncodingO200K, EncodingCL100K} {
+		encoder(encoding)
+	}
+}
+
+// Count returns the number of tokens of text for a model. exact is false when
+// the model's vocabulary is unavailable and the count is a heuristic estimate.
+func Count(model, text string) (tokens int, exact bool) {
+	enc := encoder(EncodingForModel(model))
+	if enc == nil {
+		return estimate(text), false
+	}
+	return len(enc.EncodeOrdinary(text)), true
+}
+
+// CountMessages returns the number of prompt tokens of a chat conversation
+// for a model, including the chat formatting overhead
+func CountMessages(model string, messages []Message) (tokens int, exact bool) {
+	exact = true
+	for _, message := range messages {
+		tokens += tokensPerMessage
+		for _, text := range []string{message.Role, message.Content} {
+			n, ok := Count(model, text)
+			tokens += n
+			exact = exact && ok
+		}
+		if message.Name != "" {
+			n, ok := Count(model, message.Name)
+			tokens += n + tokensPerName
+			exact = exact && ok
+		}
+	}
+	return tokens + tokensPerReply, exact
+}
+
+// Image costs of the OpenAI vision models: low detail images cost a flat
+// base, others are scaled to fit 2048x2048, then to 768px on their shortest
+// side, and cost the base plus a fee per 512px tile.
+const (
+	imageBaseTokens = 85
+	imageTileTokens = 170
+	imageTileSize   = 512
+	imageMaxSide    = 2048
+	imageShortSide  = 768
+)
+
+// CountImage returns the prompt tokens of an image input of the given size
+// and detail (low, high or auto). Images of unknown size, width or height 0,
+// are counted at the most a high detail image can cost.
+func CountImage(width, height int, detail string) int {
+	if detail == "low" {
+		return imageBaseTokens
+	}
+	if width <= 0 || height <= 0 {
+		width, height = imageShortSide, imageMaxSide
+	}
+
+	w, h := float64(width), float64(height)
+	if longest := math.Max(w, h); longest > imageMaxSide {
+		w, h = w*imageMaxSide/longest, h*imageMaxSide/longest
+	}
+	if shortest := math.Min(w, h); shortest > imageShortSide {
+		w, h = w*imageShortSide/shortest, h*imageShortSide/shortest
+	}
+	tiles := int(math.Ceil(w/imageTileSize)) * int(math.Ceil(h/imageTileSize))
+	return imageBaseTokens + tiles*imageTileTokens
+}
+
+// estimate approximates the token count of text without a vocabulary. English
+// averages about four characters per token; other characters, e.g. CJK, are
+// counted a token each so that the estimate errs on the high side.
+func estimate(text string) int {
+	ascii, other := 0, 0
+	for _, r := range text {
+		if r < utf8.RuneSelf {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// encoder returns the encoder of an encoding, or nil if it is unknown or its
+// vocabulary is unavailable
+func encoder(encoding string) *tiktoken.Tiktoken {
+	if encoding == "" {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if enc, ok := encoders[encoding]; ok {
+		return enc
+	}
+	enc, err := tiktoken.GetEncoding(encoding)
+	if err != nil {
+		log.Printf("Tokenizer %s unavailable, estimating token counts: %v", encoding, err)
+		enc = nil
+	}
+	encoders[encoding] = enc
+	return enc
+}
+
+// dirLoader loads BPE vocabularies from TokenizerDir. tiktoken asks for the
+// download URL of a vocabulary, the file is looked up by its base name, e.g.
+// o200k_base.tiktoken.
+type dirLoader struct{}
+
+func (dirLoader) LoadTiktokenBpe(file string) (map[string]int, error) {
+	return loadVocabulary(filepath.Join(config.AppConfig.TokenizerDir, path.Base(file)))
+}
+
+// loadVocabulary parses a .tiktoken file: one base64 token and its rank per line
+func loadVocabulary(name string) (map[string]int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ranks := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		encoded, rank, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: missing rank", name, line)
+		}
+		token, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		ranks[string(token)], err = strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+	}
+	return ranks, scanner.Err()
+}
@@ -0,0 +1,117 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vhybZApp/api/config"
+)
+
+// writeVocabulary writes a .tiktoken file with every single byte and the
+// given merges, ranked in order
+func writeVocabulary(t *testing.T, dir, name string, merges ...string) {
+	var b strings.Builder
+	rank := 0
+	for i := 0; i < 256; i++ {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(i)}), rank)
+		rank++
+	}
+	for _, merge := range merges {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(merge)), rank)
+		rank++
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(b.String()), 0o644))
+}
+
+func TestCount_OfflineVocabulary(t *testing.T) {
+	dir := t.TempDir()
+	writeVocabulary(t, dir, EncodingCL100K+".tiktoken", "he", "ll", "hell", "hello", " w", " wo", "rl", " worl", " world")
+	config.AppConfig.TokenizerDir = dir
+
+	tokens, exact := Count("gpt-35-turbo", "hello world")
+	assert.True(t, exact)
+	assert.Equal(t, 2, tokens)
+
+	tokens, exact = Count("gpt-4-32k", "help")
+	assert.True(t, exact)
+	assert.Equal(t, 3, tokens) // he, l, p
+
+	tokens, exact = CountMessages("gpt-4", []Message{{Role: "user", Content: "hello world"}})
+	assert.True(t, exact)
+	assert.Equal(t, tokensPerMessage+4+2+tokensPerReply, tokens) // "user" has no merges
+}
+
+func TestCount_HeuristicFallback(t *testing.T) {
+	// No vocabulary for unknown model families
+	tokens, exact := Count("my-custom-deployment", "hello world!")
+	assert.False(t, exact)
+	assert.Equal(t, 3, tokens)
+
+	tokens, _ = Count("my-custom-deployment", "こんにちは")
+	assert.Equal(t, 5, tokens)
+
+	assert.Equal(t, EncodingO200K, EncodingForModel("gpt-4o-mini"))
+	assert.Equal(t, EncodingO200K, EncodingForModel("o3-mini"))
+	assert.Equal(t, EncodingCL100K, EncodingForModel("GPT-4"))
+	assert.Empty(t, EncodingForModel("gemini-2.0-flash"))
+}
+
+func TestLoadVocabulary_Malformed(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "bad.tiktoken")
+	require.NoError(t, os.WriteFile(name, []byte("aGk=\n"), 0o644))
+	_, err := loadVocabulary(name)
+	assert.ErrorContains(t, err, "missing rank")
+}
+
+func TestCountImage(t *testing.T) {
+	assert.Equal(t, 85, CountImage(4096, 4096, "low"))
+	assert.Equal(t, 765, CountImage(1024, 1024, "high"))  // 768x768, 4 tiles
+	assert.Equal(t, 1105, CountImage(2048, 4096, "auto")) // 768x1536, 6 tiles
+	assert.Equal(t, 255, CountImage(300, 200, ""))        // 1 tile
+	assert.Equal(t, 1445, CountImage(0, 0, "high"))       // the most 8 tiles
+}
+
+func TestTokenize_ResolvesModelAliases(t *testing.T) {
+	dir := t.TempDir()
+	writeVocabulary(t, dir, EncodingCL100K+".tiktoken", "he", "ll", "hell", "hello", " w", " wo", "rl", " worl", " world")
+	config.AppConfig.TokenizerDir = dir
+	SetModelResolver(func(name string) (string, string, error) {
+		switch name {
+		case "", "fast":
+			return "fast", "gpt-35-turbo", nil
+		}
+		return "", "", errors.New("model not found")
+	})
+	defer SetModelResolver(nil)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/tokenize", Tokenize)
+	tokenize := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/tokenize", strings.NewReader(body)))
+		return w
+	}
+
+	// Aliases are counted with the tokenizer of the model they serve
+	for _, body := range []string{`{"model":"fast","text":"hello world"}`, `{"text":"hello world"}`} {
+		w := tokenize(body)
+		require.Equal(t, http.StatusOK, w.Code)
+		var resp TokenizeResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		assert.Equal(t, TokenizeResponse{Model: "fast", Encoding: EncodingCL100K, Tokens: 2, Exact: true}, resp)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, tokenize(`{"model":"gpt-35-turbo","text":"hello world"}`).Code)
+}
@@ -0,0 +1,23 @@
+package upstream
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatusHandler godoc
+// @Summary List upstream endpoints
+// @Description Report the circuit breaker state, health and counters of every upstream endpoint called by this replica
+// @Tags admin
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {array} TargetStats
+// @Failure 401 {object} models.ErrorResponse
+// @Failure 403 {object} models.ErrorResponse
+// @Router /admin/upstreams [get]
+func StatusHandler(h *Health) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, h.Stats())
+	}
+}
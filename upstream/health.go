@@ -0,0 +1,243 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// States of the circuit breaker of a target
+const (
+	// StateClosed lets calls through
+	StateClosed = "closed"
+	// StateOpen fails calls fast after too many consecutive failures
+	StateOpen = "open"
+	// StateHalfOpen lets a few probe calls through once the circuit has
+	// been open for a while; they close the circuit or open it again
+	StateHalfOpen = "half-open"
+)
+
+// ErrCircuitOpen is returned when the circuits of all the targets of a call
+// are open
+var ErrCircuitOpen = errors.New("upstream unavailable")
+
+// CircuitOpenError is returned when a call could not be sent because the
+// circuits of all its targets are open
+type CircuitOpenError struct {
+	// RetryAfter is how long until a circuit lets a probe through
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%v, retry in %v", ErrCircuitOpen, e.RetryAfter.Round(time.Second))
+}
+
+func (e *CircuitOpenError) Is(target error) bool {
+	return target == ErrCircuitOpen
+}
+
+// Health tracks the targets of a client. A failed target is unavailable
+// until its backoff or Retry-After has passed, during which calls prefer
+// the other targets of their pool. A target failing too many times in a row
+// has its circuit opened and gets no calls until it is probed again. It is
+// safe for concurrent use.
+type Health struct {
+	policy Policy
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	targets map[string]*targetHealth
+	names   []string
+}
+
+type targetHealth struct {
+	successes           uint64
+	failures            uint64
+	consecutiveFailures int
+	lastError           string
+	availableAt         time.Time
+
+	state    string
+	openedAt time.Time
+	// probes is the number of calls in flight through a half-open circuit
+	probes int
+}
+
+// NewHealth returns the health of targets that have not been called yet,
+// whose circuits follow the breaker settings of policy
+func NewHealth(policy Policy) *Health {
+	return &Health{policy: policy, now: time.Now, targets: make(map[string]*targetHealth)}
+}
+
+// target returns the health of a target, creating it on first use. The
+// caller must hold h.mu.
+func (h *Health) target(name string) *targetHealth {
+	t, ok := h.targets[name]
+	if !ok {
+		t = &targetHealth{state: StateClosed}
+		h.targets[name] = t
+		h.names = append(h.names, name)
+	}
+	return t
+}
+
+// allows reports whether the circuit of a target lets a call through,
+// moving open circuits to half-open once OpenTimeout has passed. The caller
+// must hold h.mu.
+func (h *Health) allows(t *targetHealth, now time.Time) bool {
+	if t.state == StateOpen && !now.Before(t.openedAt.Add(h.policy.OpenTimeout)) {
+		t.state = StateHalfOpen
+		t.probes = 0
+	}
+	switch t.state {
+	case StateOpen:
+		return false
+	case StateHalfOpen:
+		return t.probes < max(h.policy.HalfOpenProbes, 1)
+	}
+	return true
+}
+
+// next returns the first available target of a pool whose circuit lets the
+// call through, or the one available soonest along with how long until
+// then. probe is set when the call probes a half-open circuit. When every
+// circuit is open it returns a *CircuitOpenError.
+func (h *Health) next(targets []Target) (target Target, wait time.Duration, probe bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+
+	best := -1
+	var retryAfter time.Duration
+	for i, candidate := range targets {
+		t := h.target(candidate.Name)
+		if !h.allows(t, now) {
+			reopen := t.openedAt.Add(h.policy.OpenTimeout).Sub(now)
+			if retryAfter == 0 || reopen < retryAfter {
+				retryAfter = reopen
+			}
+			continue
+		}
+		if best < 0 || t.availableAt.Before(h.target(targets[best].Name).availableAt) {
+			best = i
+		}
+		if !t.availableAt.After(now) {
+			break
+		}
+	}
+	if best < 0 {
+		return Target{}, 0, false, &CircuitOpenError{RetryAfter: max(retryAfter, 0)}
+	}
+
+	t := h.target(targets[best].Name)
+	if t.state == StateHalfOpen {
+		t.probes++
+		probe = true
+	}
+	return targets[best], max(t.availableAt.Sub(now), 0), probe, nil
+}
+
+func (h *Health) succeed(name string, probe bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t := h.target(name)
+	t.successes++
+	t.consecutiveFailures = 0
+	t.availableAt = time.Time{}
+	if probe || t.state == StateHalfOpen {
+		t.state = StateClosed
+		t.probes = 0
+	}
+}
+
+// fail records a failed attempt, making the target unavailable for the
+// delay the provider asked for, if any, or its backoff. Failures that say
+// the target is down, rather than busy, count towards opening its circuit.
+func (h *Health) fail(name string, err error, retryAfter time.Duration, hasRetryAfter, down, probe bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	t := h.target(name)
+	t.failures++
+	t.consecutiveFailures++
+	t.lastError = err.Error()
+	delay := retryAfter
+	if !hasRetryAfter {
+		delay = backoff(h.policy, t.consecutiveFailures)
+	}
+	t.availableAt = now.Add(delay)
+
+	if probe {
+		t.probes--
+	}
+	if !down {
+		return
+	}
+	if t.state == StateHalfOpen || (h.policy.FailureThreshold > 0 && t.consecutiveFailures >= h.policy.FailureThreshold) {
+		t.state = StateOpen
+		t.openedAt = now
+		t.probes = 0
+	}
+}
+
+// release gives back the probe of a call that ended without a verdict,
+// e.g. because its caller went away
+func (h *Health) release(name string, probe bool) {
+	if !probe {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if t := h.target(name); t.state == StateHalfOpen && t.probes > 0 {
+		t.probes--
+	}
+}
+
+// TargetStats are the counters of a target since the process started
+type TargetStats struct {
+	Name string `json:"name"`
+	// State is the state of the circuit: closed, open or half-open
+	State               string `json:"state"`
+	Available           bool   `json:"available"`
+	Successes           uint64 `json:"successes"`
+	Failures            uint64 `json:"failures"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastError           string `json:"last_error,omitempty"`
+	// AvailableAt is when an unavailable target is tried again
+	AvailableAt *time.Time `json:"available_at,omitempty"`
+	// OpenedAt is when an open circuit opened
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// Stats returns the counters of every target called, in order of first call
+func (h *Health) Stats() []TargetStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	stats := make([]TargetStats, 0, len(h.names))
+	for _, name := range h.names {
+		t := h.targets[name]
+		h.allows(t, now)
+		s := TargetStats{
+			Name:                name,
+			State:               t.state,
+			Available:           t.state != StateOpen && !t.availableAt.After(now),
+			Successes:           t.successes,
+			Failures:            t.failures,
+			ConsecutiveFailures: t.consecutiveFailures,
+			LastError:           t.lastError,
+		}
+		if t.availableAt.After(now) {
+			availableAt := t.availableAt
+			s.AvailableAt = &availableAt
+		}
+		if t.state == StateOpen {
+			openedAt := t.openedAt
+			s.OpenedAt = &openedAt
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
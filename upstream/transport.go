@@ -0,0 +1,48 @@
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportConfig tunes the connection pool shared by upstream calls
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the number of idle connections kept to each
+	// endpoint, so that bursts of calls find warm connections
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// ProxyURL is the HTTP proxy of upstream calls, the HTTPS_PROXY and
+	// NO_PROXY environment variables are used when empty
+	ProxyURL string
+}
+
+// NewTransport returns a transport pooling connections to upstream
+// endpoints, to be shared by every call
+func NewTransport(cfg TransportConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if cfg.ProxyURL != "" {
+		u, err := url.Parse(cfg.ProxyURL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", cfg.ProxyURL)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxy
+	transport.DialContext = (&net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.MaxIdleConns = 0
+	transport.MaxIdleConnsPerHost = cfg.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = cfg.IdleConnTimeout
+	transport.TLSHandshakeTimeout = cfg.TLSHandshakeTimeout
+	transport.ForceAttemptHTTP2 = true
+	return transport, nil
+}
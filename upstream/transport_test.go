@@ -0,0 +1,116 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTransport_Proxy(t *testing.T) {
+	transport, err := NewTransport(TransportConfig{ProxyURL: "http://proxy.internal:3128"})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "https://us.openai.azure.com/openai", nil)
+	proxy, err := transport.Proxy(req)
+	require.NoError(t, err)
+	assert.Equal(t, &url.URL{Scheme: "http", Host: "proxy.internal:3128"}, proxy)
+
+	_, err = NewTransport(TransportConfig{ProxyURL: "proxy.internal"})
+	assert.Error(t, err)
+}
+
+func TestClient_RouteTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// Stream until the caller gives up
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := NewClient(http.DefaultClient, Policy{MaxAttempts: 1, Timeouts: map[string]time.Duration{RouteStream: 50 * time.Millisecond}})
+	resp, err := client.Do(context.Background(), RouteStream, []Target{{Name: "us", URL: server.URL}}, nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	// The timeout covers reading the body, not only the headers
+	start := time.Now()
+	_, err = io.ReadAll(resp.Body)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+// benchmarkUpstream calls a local TLS upstream from 16 goroutines per CPU,
+// as concurrent chat completions do
+func benchmarkUpstream(b *testing.B, newClient func(tls *http.Transport) *http.Client) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		// Hold calls long enough for them to overlap
+		time.Sleep(time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"choices":[{"message":{"role":"assistant","content":"Hi"}}]}`)
+	}))
+	defer server.Close()
+	tls := server.Client().Transport.(*http.Transport)
+	targets := []Target{{Name: "fake", URL: server.URL}}
+
+	b.ReportAllocs()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			client := NewClient(newClient(tls), Policy{MaxAttempts: 1})
+			resp, err := client.Do(context.Background(), RouteChat, targets, body)
+			if err != nil {
+				b.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	})
+}
+
+// BenchmarkUpstream_TransportPerCall pays a TCP and TLS handshake per call,
+// as a client without a shared transport does
+func BenchmarkUpstream_TransportPerCall(b *testing.B) {
+	benchmarkUpstream(b, func(tls *http.Transport) *http.Client {
+		transport := tls.Clone()
+		b.Cleanup(transport.CloseIdleConnections)
+		return &http.Client{Transport: transport}
+	})
+}
+
+// BenchmarkUpstream_DefaultPool shares a pool keeping Go's default of 2
+// idle connections per host
+func BenchmarkUpstream_DefaultPool(b *testing.B) {
+	var shared *http.Transport
+	benchmarkUpstream(b, func(tls *http.Transport) *http.Client {
+		if shared == nil {
+			shared = tls.Clone()
+			shared.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+		}
+		return &http.Client{Transport: shared}
+	})
+}
+
+// BenchmarkUpstream_SharedPool shares a NewTransport pool
+func BenchmarkUpstream_SharedPool(b *testing.B) {
+	var shared *http.Transport
+	benchmarkUpstream(b, func(tls *http.Transport) *http.Client {
+		if shared == nil {
+			var err error
+			shared, err = NewTransport(TransportConfig{MaxIdleConnsPerHost: 100, IdleConnTimeout: 90 * time.Second, DialTimeout: 10 * time.Second, TLSHandshakeTimeout: 10 * time.Second})
+			if err != nil {
+				b.Fatal(err)
+			}
+			shared.TLSClientConfig = tls.TLSClientConfig.Clone()
+		}
+		return &http.Client{Transport: shared}
+	})
+}
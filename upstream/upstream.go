@@ -0,0 +1,259 @@
+// Package upstream calls AI provider endpoints with retries and failover.
+// A call goes to a pool of targets serving the same model: failed attempts
+// move on to the next healthy target, and once none is left wait out a
+// jittered exponential backoff, or the Retry-After the provider asked for.
+// Targets that keep failing have their circuit opened, so that calls fail
+// fast instead of waiting on an endpoint that is down.
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Target is an endpoint serving a call
+type Target struct {
+	// Name identifies the endpoint in health stats
+	Name   string
+	URL    string
+	Header http.Header
+}
+
+// Routes of calls, each with its own timeout
+const (
+	RouteChat       = "chat"
+	RouteStream     = "stream"
+	RouteEmbeddings = "embeddings"
+)
+
+// Policy bounds the calls of a client
+type Policy struct {
+	// Timeouts bound calls by route, from the first attempt until their
+	// response body is closed; routes without one are only bound by the
+	// caller's context
+	Timeouts map[string]time.Duration
+
+	// MaxAttempts is the number of attempts of a call across all targets
+	MaxAttempts int
+	// BaseDelay is the backoff after the first failure of a target, doubled
+	// after each consecutive failure up to MaxDelay
+	BaseDelay time.Duration
+	// MaxDelay is the longest a call waits before an attempt. Calls whose
+	// targets are all unavailable for longer give up.
+	MaxDelay time.Duration
+
+	// FailureThreshold is the number of consecutive failures opening the
+	// circuit of a target, zero never opens it
+	FailureThreshold int
+	// OpenTimeout is how long an open circuit fails calls fast before it
+	// lets probes through
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of concurrent probes of a half-open
+	// circuit, at least one
+	HalfOpenProbes int
+}
+
+// Client sends calls to pools of targets. It is safe for concurrent use.
+type Client struct {
+	http   *http.Client
+	policy Policy
+	health *Health
+	// sleep waits between attempts, replaced in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewClient returns a client sending requests with httpClient, which should
+// share a transport such as NewTransport's and have no Timeout of its own so
+// that streamed responses can outlive it
+func NewClient(httpClient *http.Client, policy Policy) *Client {
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	return &Client{
+		http:   httpClient,
+		policy: policy,
+		health: NewHealth(policy),
+		sleep:  sleep,
+	}
+}
+
+// Health returns the health of the targets the client called
+func (c *Client) Health() *Health {
+	return c.health
+}
+
+// Do POSTs body to the first available target, retrying failed attempts on
+// the others. The call is bound by ctx and the timeout of its route; the
+// response body must be closed to release them. Transport errors and 408,
+// 429 and 5xx responses are retried; other responses are returned as they
+// are. When every attempt failed, the last response is returned if there
+// was one, so that callers can relay the provider's error. When the
+// circuits of all the targets are open it returns a *CircuitOpenError
+// without calling any.
+//
+// Attempts resend the same body, so a call retried after a failure is still
+// one call for the caller's accounting.
+func (c *Client) Do(ctx context.Context, route string, targets []Target, body []byte) (*http.Response, error) {
+	if len(targets) == 0 {
+		return nil, errors.New("upstream: no target")
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if timeout := c.policy.Timeouts[route]; timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	resp, err := c.do(ctx, targets, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) do(ctx context.Context, targets []Target, body []byte) (*http.Response, error) {
+	var lastResp *http.Response
+	var lastErr error
+	for attempt := 0; attempt < c.policy.MaxAttempts; attempt++ {
+		target, wait, probe, err := c.health.next(targets)
+		if err != nil {
+			if attempt > 0 {
+				break
+			}
+			return nil, err
+		}
+		if wait > c.policy.MaxDelay {
+			if attempt > 0 {
+				c.health.release(target.Name, probe)
+				break
+			}
+			// Don't hold a new call for long, try the target anyway
+			wait = 0
+		}
+		if wait > 0 {
+			if err := c.sleep(ctx, wait); err != nil {
+				c.health.release(target.Name, probe)
+				return nil, err
+			}
+		}
+
+		resp, err := c.send(ctx, target, body)
+		if err == nil && !Retryable(resp.StatusCode) {
+			c.health.succeed(target.Name, probe)
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			c.health.release(target.Name, probe)
+			return nil, ctx.Err()
+		}
+
+		// Being busy is no reason to open the circuit
+		down := err != nil || resp.StatusCode != http.StatusTooManyRequests
+		delay, ok := time.Duration(0), false
+		if err != nil {
+			lastResp, lastErr = nil, err
+		} else {
+			delay, ok = RetryAfter(resp.Header, time.Now())
+			// Keep the body of failed responses to return the last one
+			data, readErr := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+			lastResp, lastErr = resp, readErr
+			err = errors.New(resp.Status)
+		}
+		c.health.fail(target.Name, err, delay, ok, down, probe)
+	}
+
+	if lastResp != nil && lastErr == nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// cancelBody releases the context of a call once its response is read
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (c *Client) send(ctx context.Context, target Target, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range target.Header {
+		req.Header[key] = values
+	}
+	return c.http.Do(req)
+}
+
+// Retryable reports whether a call answered with status may succeed later
+func Retryable(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// RetryAfter returns how long a provider asked to wait before retrying,
+// from the retry-after-ms header Azure sends or the standard Retry-After,
+// in seconds or as an HTTP date
+func RetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if ms, err := strconv.ParseFloat(h.Get("retry-after-ms"), 64); err == nil && ms >= 0 {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+	value := h.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// backoff returns the jittered delay after the given number of consecutive
+// failures: half the exponential delay plus a random part of the other half
+func backoff(policy Policy, failures int) time.Duration {
+	delay := policy.BaseDelay
+	for i := 1; i < failures && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, policy.MaxDelay)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
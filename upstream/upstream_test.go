@@ -0,0 +1,224 @@
+package upstream
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUpstream answers with the statuses in order, repeating the last one
+func fakeUpstream(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"messages":[]}`, string(body))
+		assert.Equal(t, "secret", r.Header.Get("api-key"))
+		n := int(calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		if status != http.StatusOK {
+			for key, values := range header {
+				w.Header()[key] = values
+			}
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, http.StatusText(status))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func newTestClient(policy Policy) (*Client, *[]time.Duration) {
+	client := NewClient(http.DefaultClient, policy)
+	waits := &[]time.Duration{}
+	client.sleep = func(ctx context.Context, d time.Duration) error {
+		*waits = append(*waits, d)
+		return nil
+	}
+	return client, waits
+}
+
+func target(name string, server *httptest.Server) Target {
+	return Target{Name: name, URL: server.URL, Header: http.Header{"Api-Key": {"secret"}}}
+}
+
+var body = []byte(`{"messages":[]}`)
+
+func TestClient_RetriesHonorRetryAfter(t *testing.T) {
+	server, calls := fakeUpstream(t, http.Header{"Retry-After-Ms": {"1500"}}, http.StatusTooManyRequests, http.StatusOK)
+	client, waits := newTestClient(Policy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: 10 * time.Second})
+
+	resp, err := client.Do(context.Background(), RouteChat, []Target{target("us", server)}, body)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), calls.Load())
+	require.Len(t, *waits, 1)
+	assert.InDelta(t, 1500*time.Millisecond, (*waits)[0], float64(50*time.Millisecond))
+
+	stats := client.Health().Stats()
+	require.Len(t, stats, 1)
+	assert.Equal(t, TargetStats{Name: "us", State: StateClosed, Available: true, Successes: 1, Failures: 1, LastError: "429 Too Many Requests"}, stats[0])
+}
+
+func TestClient_FailsOver(t *testing.T) {
+	down, downCalls := fakeUpstream(t, nil, http.StatusServiceUnavailable)
+	up, upCalls := fakeUpstream(t, nil, http.StatusOK)
+	client, waits := newTestClient(Policy{MaxAttempts: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second})
+	pool := []Target{target("us", down), target("eu", up)}
+
+	// The next resource is tried right away
+	resp, err := client.Do(context.Background(), RouteChat, pool, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, *waits)
+
+	// Calls skip the failed resource while it backs off
+	resp, err = client.Do(context.Background(), RouteChat, pool, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(1), downCalls.Load())
+	assert.Equal(t, int32(2), upCalls.Load())
+
+	stats := client.Health().Stats()
+	require.Len(t, stats, 2)
+	assert.False(t, stats[0].Available)
+	assert.NotNil(t, stats[0].AvailableAt)
+	assert.Equal(t, uint64(2), stats[1].Successes)
+}
+
+func TestClient_GivesUp(t *testing.T) {
+	// Other errors are the caller's to handle
+	server, calls := fakeUpstream(t, nil, http.StatusBadRequest)
+	client, _ := newTestClient(Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second})
+	resp, err := client.Do(context.Background(), RouteChat, []Target{target("us", server)}, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+
+	// The last failure is returned once attempts run out, with its body
+	server, calls = fakeUpstream(t, nil, http.StatusBadGateway)
+	client, waits := newTestClient(Policy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second})
+	resp, err = client.Do(context.Background(), RouteChat, []Target{target("us", server)}, body)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(resp.Body)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, "Bad Gateway", string(data))
+	assert.Equal(t, int32(3), calls.Load())
+	require.Len(t, *waits, 2)
+	assert.GreaterOrEqual(t, (*waits)[1], 100*time.Millisecond) // backoff doubled to 200ms, half of it jittered
+
+	// Calls don't wait longer than MaxDelay
+	server, calls = fakeUpstream(t, http.Header{"Retry-After": {"60"}}, http.StatusTooManyRequests)
+	client, _ = newTestClient(Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Second})
+	resp, err = client.Do(context.Background(), RouteChat, []Target{target("us", server)}, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		header http.Header
+		delay  time.Duration
+		ok     bool
+	}{
+		{http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, 250 * time.Millisecond, true},
+		{http.Header{"Retry-After": {"3"}}, 3 * time.Second, true},
+		{http.Header{"Retry-After": {now.Add(time.Minute).Format(http.TimeFormat)}}, time.Minute, true},
+		{http.Header{"Retry-After": {"soon"}}, 0, false},
+		{http.Header{}, 0, false},
+	} {
+		delay, ok := RetryAfter(tt.header, now)
+		assert.Equal(t, tt.ok, ok, tt.header)
+		assert.Equal(t, tt.delay, delay, tt.header)
+	}
+
+	policy := Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for failures, max := range []time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if max == 0 {
+			continue
+		}
+		delay := backoff(policy, failures)
+		assert.GreaterOrEqual(t, delay, max/2)
+		assert.LessOrEqual(t, delay, max)
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	failing.Store(true)
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	client, _ := newTestClient(Policy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Second, FailureThreshold: 3, OpenTimeout: 30 * time.Second})
+	client.health.now = func() time.Time { return now }
+	pool := []Target{target("us", server)}
+
+	// Three failures in a row open the circuit
+	for i := 0; i < 2; i++ {
+		resp, err := client.Do(context.Background(), RouteChat, pool, body)
+		require.NoError(t, err)
+		resp.Body.Close()
+		now = now.Add(time.Second)
+	}
+	assert.Equal(t, int32(3), calls.Load())
+	stats := client.Health().Stats()
+	assert.Equal(t, StateOpen, stats[0].State)
+	assert.False(t, stats[0].Available)
+
+	// Open circuits fail fast
+	_, err := client.Do(context.Background(), RouteChat, pool, body)
+	var open *CircuitOpenError
+	require.ErrorAs(t, err, &open)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 29*time.Second, open.RetryAfter)
+	assert.Equal(t, int32(3), calls.Load())
+
+	// A failed probe opens the circuit again
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, StateHalfOpen, client.Health().Stats()[0].State)
+	resp, err := client.Do(context.Background(), RouteChat, pool, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, int32(4), calls.Load())
+	assert.Equal(t, StateOpen, client.Health().Stats()[0].State)
+
+	// A successful probe closes it
+	now = now.Add(30 * time.Second)
+	failing.Store(false)
+	resp, err = client.Do(context.Background(), RouteChat, pool, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	stats = client.Health().Stats()
+	assert.Equal(t, StateClosed, stats[0].State)
+	assert.Zero(t, stats[0].ConsecutiveFailures)
+
+	// Rate limits don't open circuits
+	limited, _ := fakeUpstream(t, http.Header{"Retry-After-Ms": {"0"}}, http.StatusTooManyRequests)
+	client, _ = newTestClient(Policy{MaxAttempts: 5, MaxDelay: time.Second, FailureThreshold: 1, OpenTimeout: time.Minute})
+	resp, err = client.Do(context.Background(), RouteChat, []Target{target("us", limited)}, body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, StateClosed, client.Health().Stats()[0].State)
+}